@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/randomsean/tiler/tiler"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var flagAnimate bool
+
+func init() {
+	flag.BoolVar(&flagAnimate, "animate", false, "tile an animated GIF source into animated PNG tiles, one file per grid position")
+}
+
+// animation is a decoded animated source. Every frame is fully composited,
+// and delays are in hundredths of a second.
+type animation struct {
+	Frames []image.Image
+	Delays []int
+	Loops  int // 0 loops forever
+}
+
+// loadAnimation decodes the animated GIF at path, applying the source
+// corrections requested by flags to every frame.
+func loadAnimation(path string) (*animation, error) {
+	defer timings.Since(stageDecode, 0, time.Now())
+
+	if isRemote(path) {
+		local, err := fetchSource(path)
+		if err != nil {
+			return nil, err
+		}
+		path = local
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &animation{}
+	switch {
+	case g.LoopCount < 0:
+		a.Loops = 1
+	case g.LoopCount > 0:
+		a.Loops = g.LoopCount + 1
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var prev *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			prev = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		img, err := preprocess(cloneRGBA(canvas))
+		if err != nil {
+			return nil, err
+		}
+
+		// Browsers play GIF frames without a delay at 10/100s.
+		delay := 10
+		if i < len(g.Delay) && g.Delay[i] > 0 {
+			delay = g.Delay[i]
+		}
+		a.Frames = append(a.Frames, img)
+		a.Delays = append(a.Delays, delay)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = prev
+		}
+	}
+	return a, nil
+}
+
+// tileAnimation generates every level from 0 to level for a, writing one
+// animated PNG per tile.
+func tileAnimation(a *animation, level int, dir string) {
+	if flagEncoding != "png" {
+		abortRun(errors.New("-animate writes PNG tiles, use -e png"))
+	}
+	prepareLevels(a.Frames[0].Bounds(), level, dir)
+
+	for i := level; i >= flagMinZoom; i-- {
+		if zoomWanted(i) {
+			splitAnimation(a, i, dir)
+		}
+	}
+}
+
+// splitAnimation is splitLevel for every frame of a.
+func splitAnimation(a *animation, level int, dir string) {
+	ctx, span := tracer.Start(jobCtx, "level", trace.WithAttributes(
+		attribute.Int("tiler.zoom", level),
+		attribute.String("tiler.dir", dir),
+	))
+	defer span.End()
+
+	bounds := a.Frames[0].Bounds()
+
+	resized := a.Frames
+	for _, tileSize := range flagTileSizes {
+		width, height := levelSize(bounds, level, tileSize)
+
+		tiles := levelTiles(bounds, level, tileSize)
+		if tiles.Empty() {
+			continue
+		}
+		sdir := sizeDir(dir, tileSize)
+
+		start := time.Now()
+		frames := make([]image.Image, len(resized))
+		for i, f := range resized {
+			frames[i] = resize.Resize(uint(width), uint(height), f, interpFor(level))
+		}
+		resized = frames
+		timings.Since(stageScale, level, start)
+
+		cropLevel(ctx, tiles, tileSize, level, sdir, func(ctx context.Context, x, y int) error {
+			start := time.Now()
+			tile := make([]*image.RGBA, len(frames))
+			for i, f := range frames {
+				tile[i] = tiler.Crop(f, tileSize, x, y)
+			}
+			timings.Since(stageCrop, level, start)
+
+			start = time.Now()
+			var buf bytes.Buffer
+			err := encodeAPNG(&buf, tile, a.Delays, a.Loops)
+			timings.Since(stageEncode, level, start)
+			if err != nil {
+				return err
+			}
+			return storeTile(ctx, buf.Bytes(), "", tileSize, x, y, level, sdir)
+		})
+	}
+}
+
+// encodeAPNG writes frames as an animated PNG. Runs of identical frames
+// are merged into one frame shown for their combined delay.
+func encodeAPNG(w io.Writer, frames []*image.RGBA, delays []int, loops int) error {
+	var keep []*image.RGBA
+	var keepDelays []int
+	for i, f := range frames {
+		if n := len(keep); n > 0 && bytes.Equal(keep[n-1].Pix, f.Pix) {
+			keepDelays[n-1] += delays[i]
+			continue
+		}
+		keep = append(keep, f)
+		keepDelays = append(keepDelays, delays[i])
+	}
+
+	b := keep[0].Rect
+	width, height := b.Dx(), b.Dy()
+
+	if _, err := io.WriteString(w, pngSignature); err != nil {
+		return err
+	}
+	if err := writeChunk(w, "IHDR", pngHeader(width, height, 6)); err != nil {
+		return err
+	}
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(keep)))
+	binary.BigEndian.PutUint32(actl[4:], uint32(loops))
+	if err := writeChunk(w, "acTL", actl); err != nil {
+		return err
+	}
+
+	var seq uint32
+	for i, f := range keep {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(width))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(height))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(keepDelays[i]))
+		binary.BigEndian.PutUint16(fctl[22:], 100)
+		// dispose_op none, blend_op source: every frame is a whole tile.
+		if err := writeChunk(w, "fcTL", fctl); err != nil {
+			return err
+		}
+		seq++
+
+		nrgba := image.NewNRGBA(f.Rect)
+		draw.Draw(nrgba, nrgba.Rect, f, f.Rect.Min, draw.Src)
+		data, err := pngImageData(nrgba, 4, png.DefaultCompression, func(dst, src []byte) {
+			copy(dst, src)
+		})
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			err = writeChunk(w, "IDAT", data)
+		} else {
+			fdat := make([]byte, 4+len(data))
+			binary.BigEndian.PutUint32(fdat, seq)
+			copy(fdat[4:], data)
+			err = writeChunk(w, "fdAT", fdat)
+			seq++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return writeChunk(w, "IEND", nil)
+}
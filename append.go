@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var flagAppend bool
+
+func init() {
+	flag.BoolVar(&flagAppend, "append", false, "extend the tileset in the output directory: keep complete levels and generate only the missing ones, downsampling shallower levels from existing deeper tiles")
+}
+
+// keptLevels holds the levels -append found complete in the output
+// directory, which the run leaves alone.
+var keptLevels = make(map[int]bool)
+
+// planAppend records in keptLevels which of the levels 0 to level
+// already exist below dir in the output directory.
+func planAppend(level int, dir string) {
+	if _, ok := output.(dirWriter); !ok {
+		log.Fatalln("-append needs a directory output")
+	}
+	keptLevels = make(map[int]bool)
+	mosaics = make(map[int]image.Image)
+	for z := 0; z <= level; z++ {
+		if levelComplete(z, dir) {
+			keptLevels[z] = true
+		}
+	}
+}
+
+// levelComplete reports whether every tile of level z exists at every
+// tile size.
+func levelComplete(z int, dir string) bool {
+	side := 1 << uint(z)
+	for _, size := range flagTileSizes {
+		sdir := sizeDir(dir, size)
+		for y := 0; y < side; y++ {
+			for x := 0; x < side; x++ {
+				if _, err := os.Stat(filepath.Join(flagOutDir, tileName(sdir, z, x, y, size))); err != nil {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// mosaics holds the levels reassembled by appendSource, which is called
+// for one level at a time.
+var mosaics = make(map[int]image.Image)
+
+// appendSource returns the image to generate the missing level z from:
+// the mosaic of the nearest complete deeper level, or img if there is
+// none or its tiles cannot be read.
+func appendSource(img image.Image, z, level int, dir string) image.Image {
+	for d := z + 1; d <= level; d++ {
+		if !keptLevels[d] {
+			continue
+		}
+		if m, ok := mosaics[d]; ok {
+			return m
+		}
+		m, err := mosaicLevel(d, dir)
+		if err != nil {
+			log.Printf("level %d: %v, tiling from the source", z, err)
+			return img
+		}
+		mosaics[d] = m
+		return m
+	}
+	return img
+}
+
+// mosaicLevel reassembles the largest tiles of level z below dir.
+func mosaicLevel(z int, dir string) (image.Image, error) {
+	size := flagTileSizes[0]
+	sdir := sizeDir(dir, size)
+	side := 1 << uint(z)
+
+	m := image.NewRGBA(image.Rect(0, 0, side*size, side*size))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			name := tileName(sdir, z, x, y, size)
+			data, err := ioutil.ReadFile(filepath.Join(flagOutDir, name))
+			if err != nil {
+				return nil, err
+			}
+			if tileCipher != nil {
+				if data, err = tileCipher.Open(name, data); err != nil {
+					return nil, fmt.Errorf("%s: decrypt: %v", name, err)
+				}
+			}
+			tile, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			r := image.Rect(x*size, y*size, (x+1)*size, (y+1)*size)
+			draw.Draw(m, r, tile, tile.Bounds().Min, draw.Src)
+		}
+	}
+	return m, nil
+}
+
+// Merge adds the records of the manifest previously written to path, if
+// any, so an appended tileset's manifest still lists the kept tiles.
+func (m *Manifest) Merge(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var prev Manifest
+	if err := json.Unmarshal(data, &prev); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, src := range prev.Sources {
+		m.Sources[name] = src
+	}
+	for name, etag := range prev.Missing {
+		m.Missing[name] = etag
+	}
+	for name, kind := range prev.Empty {
+		m.Empty[name] = kind
+	}
+	for z, ttl := range prev.TTL {
+		m.TTL[z] = ttl
+	}
+	for name, etag := range prev.Tiles {
+		m.Tiles[name] = etag
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"math"
+)
+
+var flagKeepAspect bool
+
+func init() {
+	flag.BoolVar(&flagKeepAspect, "keep-aspect", false, "keep the aspect ratio of non-square sources: the longer side fills the tile grid and the tiles past the shorter side are left out, with the edge tiles filled according to -edge")
+}
+
+// levelSize returns the size in pixels of a level of a source with bounds
+// src. Levels are square unless -keep-aspect is set, when the shorter
+// side is scaled by as much as the longer one.
+func levelSize(src image.Rectangle, level, tileSize int) (width, height int) {
+	side := (1 << uint(level)) * tileSize
+	if !flagKeepAspect || src.Empty() {
+		return side, side
+	}
+	w, h := float64(src.Dx()), float64(src.Dy())
+	scaled := func(short, long float64) int {
+		return int(math.Max(1, math.Round(short*float64(side)/long)))
+	}
+	if w >= h {
+		return side, scaled(h, w)
+	}
+	return scaled(w, h), side
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+var flagAudit string
+
+func init() {
+	flag.StringVar(&flagAudit, "audit", "audit.log", "file in the output directory that every run appends a record of itself to (empty to disable)")
+}
+
+// auditRecord describes how a run changed the tileset: who ran it, when,
+// with which options and from which sources. Records are appended one
+// JSON object per line and never rewritten.
+type auditRecord struct {
+	Time     time.Time         `json:"time"`
+	User     string            `json:"user"`
+	Host     string            `json:"host"`
+	Args     []string          `json:"args"`
+	Options  map[string]string `json:"options"`
+	Sources  []auditSource     `json:"sources"`
+	Status   string            `json:"status"`
+	Error    string            `json:"error,omitempty"`
+	Tiles    int               `json:"tiles"`
+	Failed   int               `json:"failed"`
+	Duration float64           `json:"duration_seconds"`
+}
+
+// auditSource is a source tiled during the run.
+type auditSource struct {
+	Path string `json:"path"`
+	Fingerprint
+}
+
+// writeAudit appends the record of the run with summary s to -audit.
+// Problems are logged but never change the outcome of the run.
+func writeAudit(s runSummary) {
+	if flagAudit == "" {
+		return
+	}
+	r := auditRecord{
+		Time:     time.Now().UTC(),
+		User:     auditUser(),
+		Args:     os.Args[1:],
+		Options:  make(map[string]string),
+		Status:   s.Status,
+		Error:    s.Error,
+		Tiles:    s.Tiles,
+		Failed:   s.Failed,
+		Duration: s.Duration,
+	}
+	r.Host, _ = os.Hostname()
+	flag.Visit(func(f *flag.Flag) {
+		r.Options[f.Name] = f.Value.String()
+	})
+	for _, path := range s.Inputs {
+		src := auditSource{Path: path}
+		if recorded, ok := manifestFingerprint(path); ok {
+			src.Fingerprint = recorded
+		} else if fp, err := fingerprint(path); err == nil {
+			src.Fingerprint = fp
+		} else {
+			log.Printf("audit: %s: %v", path, err)
+		}
+		r.Sources = append(r.Sources, src)
+	}
+
+	data, err := json.Marshal(&r)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	if err := ensureDir(flagOutDir); err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(flagOutDir, flagAudit), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("audit: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// auditUser returns the name of the user running tiler.
+func auditUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// manifestFingerprint returns the fingerprint the manifest recorded for
+// the source at path, saving hashing it again.
+func manifestFingerprint(path string) (Fingerprint, bool) {
+	if manifest == nil {
+		return Fingerprint{}, false
+	}
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	if src := manifest.Sources[path]; src != nil && src.Checksum != "" {
+		return src.Fingerprint, true
+	}
+	return Fingerprint{}, false
+}
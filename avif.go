@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var (
+	flagAVIFQuality int
+	flagAVIFSpeed   int
+	flagAVIFCmd     string
+)
+
+func init() {
+	flag.IntVar(&flagAVIFQuality, "avif-quality", 60, "AVIF quality from 0 to 100 for -e avif")
+	flag.IntVar(&flagAVIFSpeed, "avif-speed", 6, "AVIF encoder speed from 0 (slowest, smallest) to 10 for -e avif")
+	flag.StringVar(&flagAVIFCmd, "avif-cmd", "avifenc -q {quality} -s {speed} {in} {out}", "command encoding one PNG tile to AVIF for -e avif; {in}, {out}, {quality} and {speed} are substituted")
+}
+
+// checkAVIF validates the AVIF flags and that the -avif-cmd encoder can
+// be found, before any tile is rendered.
+func checkAVIF() error {
+	if flagAVIFQuality < 0 || flagAVIFQuality > 100 {
+		return errors.New("-avif-quality must be between 0 and 100")
+	}
+	if flagAVIFSpeed < 0 || flagAVIFSpeed > 10 {
+		return errors.New("-avif-speed must be between 0 and 10")
+	}
+	args := strings.Fields(flagAVIFCmd)
+	if len(args) == 0 {
+		return errors.New("-avif-cmd is empty")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return fmt.Errorf("-e avif needs an AVIF encoder such as libavif's avifenc: %v", err)
+	}
+	return nil
+}
+
+// encodeAVIF writes img as AVIF. Go has no AV1 encoder, so the tile is
+// handed to the -avif-cmd encoder as a lossless PNG.
+func encodeAVIF(w io.Writer, img image.Image) error {
+	in, err := tempFile("avif-*.png")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(in.Name())
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(in, img); err != nil {
+		in.Close()
+		return err
+	}
+	if err := in.Close(); err != nil {
+		return err
+	}
+
+	out := strings.TrimSuffix(in.Name(), ".png") + ".avif"
+	defer os.Remove(out)
+
+	args := strings.Fields(flagAVIFCmd)
+	for i, a := range args {
+		a = strings.Replace(a, "{in}", in.Name(), -1)
+		a = strings.Replace(a, "{out}", out, -1)
+		a = strings.Replace(a, "{quality}", strconv.Itoa(flagAVIFQuality), -1)
+		a = strings.Replace(a, "{speed}", strconv.Itoa(flagAVIFSpeed), -1)
+		args[i] = a
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("avif: %v: %s", err, strings.TrimSpace(string(msg)))
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
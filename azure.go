@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var flagAzureEndpoint string
+
+func init() {
+	flag.StringVar(&flagAzureEndpoint, "azure-endpoint", "", "push and -upload: Blob service endpoint for az:// destinations, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite (default https://<account>.blob.core.windows.net)")
+}
+
+// azureVersion is the Blob service REST API version requests ask for.
+const azureVersion = "2020-04-08"
+
+// azureContainer talks to a container of Azure Blob Storage. Requests are
+// signed with the AZURE_STORAGE_KEY of the AZURE_STORAGE_ACCOUNT, or carry
+// the shared access signature AZURE_STORAGE_SAS_TOKEN instead.
+//
+// Azure has no multipart uploads as such: the parts of a large file are
+// uncommitted blocks of the blob, named after the upload ID, until the
+// block list commits them. Blocks left uncommitted for a week are
+// discarded, after which committing reports an upload that expired.
+type azureContainer struct {
+	endpoint  *url.URL
+	account   string
+	container string
+	prefix    string
+
+	key []byte
+	sas url.Values
+
+	// limit paces request bodies to -bandwidth-limit, or is nil.
+	limit *bandwidth
+}
+
+// openAzure opens the destination az://container/prefix, u parsed.
+func openAzure(u *url.URL) (*azureContainer, error) {
+	c := &azureContainer{
+		account:   os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		container: u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+	}
+	if c.container == "" {
+		return nil, fmt.Errorf("%s: no container", u)
+	}
+	if c.account == "" {
+		return nil, errors.New("AZURE_STORAGE_ACCOUNT must be set")
+	}
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		v, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_SAS_TOKEN: %v", err)
+		}
+		c.sas = v
+	} else if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		k, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_KEY: %v", err)
+		}
+		c.key = k
+	} else {
+		return nil, errors.New("AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN must be set")
+	}
+
+	endpoint := flagAzureEndpoint
+	if endpoint == "" {
+		endpoint = "https://" + c.account + ".blob.core.windows.net"
+	}
+	var err error
+	if c.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	if flagBandwidthLimit > 0 {
+		c.limit = &bandwidth{rate: float64(flagBandwidthLimit)}
+	}
+	return c, nil
+}
+
+// objectKey returns the blob name of the tileset file name.
+func (c *azureContainer) objectKey(name string) string {
+	if c.prefix == "" {
+		return name
+	}
+	return c.prefix + "/" + name
+}
+
+// do sends a signed request for the blob key and returns the response
+// headers. Errors come back in the same XML shape as S3's.
+func (c *azureContainer) do(method, key string, query url.Values, header http.Header, body []byte) (http.Header, error) {
+	u := *c.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	u.Path = base + "/" + c.container + "/" + key
+	u.RawPath = s3Escape(base) + "/" + s3Escape(c.container) + "/" + s3Escape(key)
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range c.sas {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Version", azureVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	if c.limit != nil && len(body) > 0 {
+		// ContentLength stays as set for the whole body.
+		req.Body = &pacedReader{bytes.NewReader(body), c.limit}
+		req.GetBody = nil
+	}
+	if c.key != nil {
+		c.sign(req, u.RawPath, query)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		e := &s3Error{Status: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		return nil, fmt.Errorf("%s %s: %w", method, key, e)
+	}
+	return resp.Header, nil
+}
+
+// sign adds the Shared Key Authorization header to req, whose escaped
+// path is path and whose query, less any SAS, is query.
+func (c *azureContainer) sign(req *http.Request, path string, query url.Values) {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var h strings.Builder
+	h.WriteString(req.Method + "\n")
+	for _, name := range []string{"Content-Encoding", "Content-Language"} {
+		h.WriteString(req.Header.Get(name) + "\n")
+	}
+	h.WriteString(length + "\n")
+	for _, name := range []string{"Content-Md5", "Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		h.WriteString(req.Header.Get(name) + "\n")
+	}
+
+	var names []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		h.WriteString(n + ":" + strings.TrimSpace(req.Header.Get(n)) + "\n")
+	}
+
+	h.WriteString("/" + c.account + path)
+	var params []string
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		vs := append([]string(nil), query[k]...)
+		sort.Strings(vs)
+		h.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(vs, ","))
+	}
+
+	sig := base64.StdEncoding.EncodeToString(hmacSum(c.key, h.String()))
+	req.Header.Set("Authorization", "SharedKey "+c.account+":"+sig)
+}
+
+// blobHeader returns the headers a blob is stored with: its content type
+// and, if not "", the Cache-Control it is served with.
+func blobHeader(contentType, cacheControl string) http.Header {
+	h := http.Header{"X-Ms-Blob-Content-Type": {contentType}}
+	if cacheControl != "" {
+		h.Set("X-Ms-Blob-Cache-Control", cacheControl)
+	}
+	return h
+}
+
+// Put stores data as the blob key.
+func (c *azureContainer) Put(key string, data []byte, contentType, cacheControl string) error {
+	h := blobHeader(contentType, cacheControl)
+	h.Set("X-Ms-Blob-Type", "BlockBlob")
+	_, err := c.do("PUT", key, nil, h, data)
+	return err
+}
+
+// CreateUpload returns a new upload ID to name the blocks of key after.
+// Nothing is sent until the first block.
+func (c *azureContainer) CreateUpload(key, contentType, cacheControl string) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// blockID names block n of upload id. The IDs of the blocks of a blob
+// must all be the same length.
+func blockID(id string, n int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%05d", id, n)))
+}
+
+// UploadPart stores block n, counted from 1, of upload id and returns its
+// block ID.
+func (c *azureContainer) UploadPart(key, id string, n int, data []byte) (string, error) {
+	block := blockID(id, n)
+	_, err := c.do("PUT", key, url.Values{"comp": {"block"}, "blockid": {block}}, nil, data)
+	if err != nil {
+		return "", err
+	}
+	return block, nil
+}
+
+// CompleteUpload commits the blocks of an upload, given by their IDs in
+// order, as the blob.
+func (c *azureContainer) CompleteUpload(key, id string, blocks []string, contentType, cacheControl string) error {
+	var req struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}
+	req.Latest = blocks
+	body, err := xml.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	_, err = c.do("PUT", key, url.Values{"comp": {"blocklist"}}, blobHeader(contentType, cacheControl), body)
+	return err
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	flagBands     string
+	flagBandMath  string
+	flagBandRange string
+)
+
+func init() {
+	flag.StringVar(&flagBands, "bands", "", "build the image from these source bands, counted from 1: one for gray or three for red, green and blue (e.g. 4,3,2)")
+	flag.StringVar(&flagBandMath, "band-math", "", "compute the image per pixel from source bands b1, b2, ... in [0, 1]: one expression for gray or three separated by ; for red, green and blue (e.g. NDVI: (b4-b3)/(b4+b3))")
+	flag.StringVar(&flagBandRange, "band-range", "0,1", "min,max of -band-math results, stretched to black and white")
+}
+
+// multiband is implemented by sources holding more bands than a color
+// model, such as multispectral scenes. Other images have the bands red,
+// green, blue and alpha.
+type multiband interface {
+	image.Image
+	Bands() int
+	// Band returns band i, counted from 0, of the pixel at x, y in [0, 1].
+	Band(x, y, i int) float64
+}
+
+// bandExpr computes one output channel from the bands of a pixel.
+type bandExpr func(bands []float64) float64
+
+// sourceBands returns the number of bands in img and a function reading
+// them at x, y into bands.
+func sourceBands(img image.Image) (int, func(x, y int, bands []float64)) {
+	if m, ok := img.(multiband); ok {
+		n := m.Bands()
+		return n, func(x, y int, bands []float64) {
+			for i := 0; i < n; i++ {
+				bands[i] = m.Band(x, y, i)
+			}
+		}
+	}
+	return 4, func(x, y int, bands []float64) {
+		c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+		bands[0] = float64(c.R) / 0xffff
+		bands[1] = float64(c.G) / 0xffff
+		bands[2] = float64(c.B) / 0xffff
+		bands[3] = float64(c.A) / 0xffff
+	}
+}
+
+// selectBands applies -bands and -band-math to img. Pixels whose
+// expressions are not finite, such as NDVI over 0/0, are transparent;
+// others keep the alpha of sources without extra bands.
+func selectBands(img image.Image) (image.Image, error) {
+	if flagBands != "" && flagBandMath != "" {
+		return nil, errors.New("-bands and -band-math are exclusive")
+	}
+	n, read := sourceBands(img)
+	_, extra := img.(multiband)
+
+	var exprs []bandExpr
+	lo, hi := 0.0, 1.0
+	if flagBands != "" {
+		for _, s := range strings.Split(flagBands, ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || i < 1 || i > n {
+				return nil, fmt.Errorf("invalid band %q: source has bands 1-%d", s, n)
+			}
+			exprs = append(exprs, func(bands []float64) float64 { return bands[i-1] })
+		}
+	} else {
+		for _, s := range strings.Split(flagBandMath, ";") {
+			e, err := parseBandExpr(s, n)
+			if err != nil {
+				return nil, fmt.Errorf("-band-math %q: %v", s, err)
+			}
+			exprs = append(exprs, e)
+		}
+		var err error
+		if lo, hi, err = parseBandRange(flagBandRange); err != nil {
+			return nil, err
+		}
+	}
+	if len(exprs) != 1 && len(exprs) != 3 {
+		return nil, errors.New("select one band for gray or three for red, green and blue")
+	}
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(b)
+	bands := make([]float64, n)
+	out := make([]uint8, 3)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			read(x, y, bands)
+			ok := true
+			for i := range out {
+				v := exprs[i%len(exprs)](bands)
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					ok = false
+					break
+				}
+				out[i] = uint8(math.Round(255 * clamp01((v-lo)/(hi-lo))))
+			}
+			if !ok {
+				continue
+			}
+			a := uint8(0xff)
+			if !extra {
+				a = uint8(math.Round(255 * bands[3]))
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{out[0], out[1], out[2], a})
+		}
+	}
+	return dst, nil
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// parseBandRange parses the min,max of -band-range.
+func parseBandRange(s string) (lo, hi float64, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) == 2 {
+		lo, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		if err == nil {
+			hi, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		}
+	}
+	if len(parts) != 2 || err != nil || lo >= hi {
+		return 0, 0, fmt.Errorf("invalid -band-range %q: want min,max with min < max", s)
+	}
+	return lo, hi, nil
+}
+
+// parseBandExpr compiles an arithmetic expression of numbers, the bands
+// b1 to bn, + - * /, unary minus and parentheses.
+func parseBandExpr(s string, n int) (bandExpr, error) {
+	p := &exprParser{s: s, bands: n}
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q", p.s[p.pos:])
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	s     string
+	pos   int
+	bands int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+// next consumes and returns the next operator byte if it is one of ops.
+func (p *exprParser) next(ops string) byte {
+	p.skipSpace()
+	if p.pos < len(p.s) && strings.IndexByte(ops, p.s[p.pos]) >= 0 {
+		p.pos++
+		return p.s[p.pos-1]
+	}
+	return 0
+}
+
+func (p *exprParser) sum() (bandExpr, error) {
+	l, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.next("+-")
+		if op == 0 {
+			return l, nil
+		}
+		r, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr(op, l, r)
+	}
+}
+
+func (p *exprParser) product() (bandExpr, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.next("*/")
+		if op == 0 {
+			return l, nil
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr(op, l, r)
+	}
+}
+
+func (p *exprParser) unary() (bandExpr, error) {
+	if p.next("-") != 0 {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(b []float64) float64 { return -e(b) }, nil
+	}
+	return p.operand()
+}
+
+func (p *exprParser) operand() (bandExpr, error) {
+	if p.next("(") != 0 {
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.next(")") == 0 {
+			return nil, errors.New("missing )")
+		}
+		return e, nil
+	}
+
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && (p.s[p.pos] == '.' || unicode.IsLetter(rune(p.s[p.pos])) || unicode.IsDigit(rune(p.s[p.pos]))) {
+		p.pos++
+	}
+	tok := p.s[start:p.pos]
+	if tok == "" {
+		return nil, errors.New("missing operand")
+	}
+	if tok[0] == 'b' {
+		i, err := strconv.Atoi(tok[1:])
+		if err != nil || i < 1 || i > p.bands {
+			return nil, fmt.Errorf("unknown band %s: source has bands b1-b%d", tok, p.bands)
+		}
+		return func(b []float64) float64 { return b[i-1] }, nil
+	}
+	v, err := strconv.ParseFloat(tok, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %s", tok)
+	}
+	return func([]float64) float64 { return v }, nil
+}
+
+func binaryExpr(op byte, l, r bandExpr) bandExpr {
+	switch op {
+	case '+':
+		return func(b []float64) float64 { return l(b) + r(b) }
+	case '-':
+		return func(b []float64) float64 { return l(b) - r(b) }
+	case '*':
+		return func(b []float64) float64 { return l(b) * r(b) }
+	default:
+		return func(b []float64) float64 { return l(b) / r(b) }
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var flagBase string
+
+func init() {
+	flag.StringVar(&flagBase, "base", "", "composite every tile over the tile of the same name in this existing tileset, which is only read")
+}
+
+// compositeBase draws dst over its base tile and returns the result, or
+// dst itself if the base tileset has no such tile.
+func compositeBase(dst *image.RGBA, name string) (*image.RGBA, error) {
+	data, err := ioutil.ReadFile(filepath.Join(flagBase, name))
+	if os.IsNotExist(err) {
+		return dst, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tileCipher != nil {
+		if data, err = tileCipher.Open(name, data); err != nil {
+			return nil, fmt.Errorf("base: decrypt: %v", err)
+		}
+	}
+	base, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("base: %v", err)
+	}
+	if base.Bounds().Size() != dst.Bounds().Size() {
+		return nil, fmt.Errorf("base tile is %v, not %v", base.Bounds().Size(), dst.Bounds().Size())
+	}
+
+	m := image.NewRGBA(dst.Bounds())
+	draw.Draw(m, m.Bounds(), base, base.Bounds().Min, draw.Src)
+	draw.Draw(m, m.Bounds(), dst, dst.Bounds().Min, draw.Over)
+	return m, nil
+}
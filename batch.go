@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+var (
+	flagBatchReport string
+	flagBatchDir    string
+)
+
+func init() {
+	flag.StringVar(&flagBatchReport, "report", "batch-report.json", "file recording inputs that batch could not decode")
+	flag.StringVar(&flagBatchDir, "batch-dir", "{name}", "batch: output subdirectory of each input, where {name} is the input file name slugified; {name} may also appear in -p")
+}
+
+// batchFailure records an input that was skipped during a batch run.
+type batchFailure struct {
+	Input string `json:"input"`
+	Error string `json:"error"`
+}
+
+// runBatch tiles every input into its own subdirectory of the output
+// directory. Inputs that fail to decode are reported and skipped rather
+// than aborting the remaining work.
+func runBatch(args []string) {
+	checkFlags()
+
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: tiler batch [flags] [1-n] [filename...]")
+		os.Exit(2)
+	}
+
+	level := parseLevel(args[0])
+
+	if err := ensureDir(flagOutDir); err != nil {
+		log.Fatal(err)
+	}
+
+	startRun(args[1:]...)
+
+	var ref *histogram
+	if flagMatchHistogram != "" {
+		var err error
+		if ref, err = referenceHistogram(args[1:]); err != nil {
+			log.Fatalf("-match-histogram: %v", err)
+		}
+	}
+
+	names := batchNames(args[1:])
+	pattern := flagPattern
+	defer func() { flagPattern = pattern }()
+
+	var failures []batchFailure
+	for _, path := range args[1:] {
+		img, err := safeDecode(path)
+		if err != nil {
+			log.Printf("%s: %v", path, err)
+			failures = append(failures, batchFailure{Input: path, Error: err.Error()})
+			continue
+		}
+		if ref != nil {
+			img = matchHistogram(img, ref)
+		}
+
+		dir := strings.Replace(flagBatchDir, "{name}", names[path], -1)
+		flagPattern = strings.Replace(pattern, "{name}", names[path], -1)
+		if err := output.Mkdir(dir); err != nil {
+			log.Fatal(err)
+		}
+
+		if manifest != nil {
+			manifest.AddSource(path, img)
+		}
+		noteInput(path, level)
+		georeference(path)
+		tileLevels(img, level, dir)
+		forgetCached(img)
+	}
+
+	var err error
+	if len(failures) > 0 {
+		if err := writeBatchReport(flagBatchReport, failures); err != nil {
+			log.Fatal(err)
+		}
+		err = fmt.Errorf("%d of %d inputs failed, see %s", len(failures), len(args)-1, flagBatchReport)
+	}
+
+	finishRun(err)
+}
+
+// batchNames gives each input a {name} slugified from its file name,
+// numbering repeats in argument order so inputs such as a/scene.tif and
+// b/Scene.TIF do not overwrite each other's tiles.
+func batchNames(paths []string) map[string]string {
+	names := make(map[string]string)
+	used := make(map[string]bool)
+	for _, path := range paths {
+		if _, ok := names[path]; ok {
+			continue
+		}
+		base := slugify(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+		name := base
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s-%d", base, n)
+		}
+		if name != base {
+			log.Printf("%s: %s is taken, naming it %s", path, base, name)
+		}
+		used[name] = true
+		names[path] = name
+	}
+	return names
+}
+
+// slugify lowercases s and replaces each run of characters other than
+// letters and digits with a single dash.
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "input"
+	}
+	return b.String()
+}
+
+// safeDecode loads the source at path, turning decoder panics on corrupt data into
+// errors.
+func safeDecode(path string) (img image.Image, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decoder panic: %v", r)
+		}
+	}()
+	return loadSource(path)
+}
+
+func writeBatchReport(path string, failures []batchFailure) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(failures)
+}
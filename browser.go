@@ -0,0 +1,146 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+	"syscall/js"
+)
+
+func init() {
+	serveJS = func() {
+		js.Global().Set("tilerTile", js.FuncOf(jsTile))
+		select {}
+	}
+}
+
+// jsMu serializes browser calls, which share the flag-driven settings.
+var jsMu sync.Mutex
+
+// jsTile implements the browser entry point
+//
+//	tilerTile(data, levels, options, onProgress) → Promise<{name: Uint8Array}>
+//
+// data is the encoded source image as a Uint8Array. options may set size,
+// encoding, quality, pattern and interp like the command line flags, and
+// onProgress(name, done, total) is called as each tile is produced.
+func jsTile(this js.Value, args []js.Value) interface{} {
+	if len(args) < 2 {
+		return js.Global().Get("Promise").Call("reject", "tilerTile(data, levels, [options], [onProgress])")
+	}
+
+	src := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(src, args[0])
+	levels := args[1].Int()
+
+	var opts, onProgress js.Value
+	if len(args) > 2 {
+		opts = args[2]
+	}
+	if len(args) > 3 {
+		onProgress = args[3]
+	}
+
+	executor := js.FuncOf(func(this js.Value, p []js.Value) interface{} {
+		resolve, reject := p[0], p[1]
+		go func() {
+			tiles, err := runJSTile(src, levels, opts, onProgress)
+			if err != nil {
+				reject.Invoke(err.Error())
+				return
+			}
+
+			result := js.Global().Get("Object").New()
+			for name, data := range tiles {
+				arr := js.Global().Get("Uint8Array").New(len(data))
+				js.CopyBytesToJS(arr, data)
+				result.Set(name, arr)
+			}
+			resolve.Invoke(result)
+		}()
+		return nil
+	})
+	defer executor.Release()
+
+	return js.Global().Get("Promise").New(executor)
+}
+
+func runJSTile(src []byte, levels int, opts, onProgress js.Value) (map[string][]byte, error) {
+	jsMu.Lock()
+	defer jsMu.Unlock()
+
+	if levels < 0 {
+		return nil, errors.New("levels must not be negative")
+	}
+	if err := applyJSOptions(opts); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	if img, err = preprocess(img); err != nil {
+		return nil, err
+	}
+
+	mem := newMemWriter()
+	output = mem
+	failures = failureList{}
+	progress = tileProgress{}
+	stats = runStats{sizes: make(map[int][]int)}
+	budget = sizeBudget{quality: -1}
+	if onProgress.Type() == js.TypeFunction {
+		progress.fn = func(name string, done, total int) {
+			onProgress.Invoke(name, done, total)
+		}
+	}
+
+	tileLevels(img, levels, "")
+
+	if n := failures.Len(); n > 0 {
+		return nil, fmt.Errorf("%d tiles failed: %v", n, failures.tiles[0].Error)
+	}
+	return mem.tiles, nil
+}
+
+// applyJSOptions copies the recognised fields of opts onto the flags.
+func applyJSOptions(opts js.Value) error {
+	if opts.Type() != js.TypeObject {
+		return nil
+	}
+
+	if v := opts.Get("size"); v.Type() == js.TypeNumber {
+		flagTileSizes = sizeList{v.Int()}
+	}
+	if v := opts.Get("encoding"); v.Type() == js.TypeString {
+		flagEncoding = v.String()
+	}
+	if v := opts.Get("quality"); v.Type() == js.TypeNumber {
+		flagJpegQuality = v.Int()
+	}
+	if v := opts.Get("pattern"); v.Type() == js.TypeString {
+		flagPattern = v.String()
+	}
+	if v := opts.Get("interp"); v.Type() == js.TypeString {
+		if err := flagInterpFunc.Set(v.String()); err != nil {
+			return err
+		}
+	}
+
+	for _, size := range flagTileSizes {
+		if size <= 0 {
+			return errors.New("tile size must be a positive integer")
+		}
+	}
+	for _, enc := range validEncodings {
+		if enc == flagEncoding {
+			return checkPattern(opts.Get("pattern").Type() == js.TypeString)
+		}
+	}
+	return fmt.Errorf("unsupported encoding %q", flagEncoding)
+}
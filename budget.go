@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// byteSize is a flag.Value accepting sizes such as 4096, 512K, 20MB or 1.5G.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(v string) error {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	scale := 1.0
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, scale = strings.TrimSuffix(s, u.suffix), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*b = byteSize(n * scale)
+	return nil
+}
+
+var (
+	flagMaxTotalSize byteSize
+	flagBudgetMode   string
+)
+
+func init() {
+	flag.Var(&flagMaxTotalSize, "max-total-size", "storage budget for all tiles of the run, e.g. 20GB (0 disables)")
+	flag.StringVar(&flagBudgetMode, "budget-mode", "abort", "what to do when the budget is projected to be exceeded (abort or quality)")
+}
+
+const (
+	// budgetSample is how many tiles are written before projections are
+	// trusted, and how long to wait between quality adjustments.
+	budgetSample = 64
+
+	budgetQualityStep = 10
+	budgetMinQuality  = 10
+)
+
+// sizeBudget projects the final output size from the tiles written so far
+// and enforces -max-total-size, either by aborting early or by lowering the
+// JPEG or lossy WebP quality for the remaining tiles.
+type sizeBudget struct {
+	mu       sync.Mutex
+	expected int64
+	done     int64
+	written  int64
+	quality  int
+	lastStep int64
+}
+
+var budget = sizeBudget{quality: -1}
+
+// Expect adds n tiles to the number the run is going to write.
+func (b *sizeBudget) Expect(n int) {
+	b.mu.Lock()
+	b.expected += int64(n)
+	b.mu.Unlock()
+}
+
+// Quality returns the JPEG or WebP quality tiles should currently be
+// encoded at.
+func (b *sizeBudget) Quality() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.quality < 0 {
+		return encodingQuality(flagEncoding)
+	}
+	return b.quality
+}
+
+// Record accounts for a written tile of n bytes and reacts if the budget
+// is, or is projected to be, exceeded.
+func (b *sizeBudget) Record(n int) {
+	if flagMaxTotalSize <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.done++
+	b.written += int64(n)
+
+	limit := int64(flagMaxTotalSize)
+	if b.written > limit {
+		abortRun(fmt.Errorf("output size budget of %d bytes exceeded after %d of %d tiles", limit, b.done, b.expected))
+	}
+	if b.done < budgetSample || b.done-b.lastStep < budgetSample {
+		return
+	}
+
+	projected := b.written + (b.expected-b.done)*b.written/b.done
+	if projected <= limit {
+		return
+	}
+
+	if flagBudgetMode != "quality" || !lossyEncoding() {
+		abortRun(fmt.Errorf("projected output of %d bytes exceeds budget of %d bytes", projected, limit))
+	}
+
+	if b.quality < 0 {
+		b.quality = encodingQuality(flagEncoding)
+	}
+	if b.quality <= budgetMinQuality {
+		return
+	}
+	b.quality -= budgetQualityStep
+	if b.quality < budgetMinQuality {
+		b.quality = budgetMinQuality
+	}
+	b.lastStep = b.done
+	log.Printf("projected output of %d bytes exceeds budget, lowering quality to %d", projected, b.quality)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var flagCacheDir string
+
+func init() {
+	flag.StringVar(&flagCacheDir, "cache-dir", "", "cache decoded sources and resized levels in this directory across runs")
+}
+
+// cacheKeys maps images read from or written to the cache to their keys,
+// so levels resized from them can be cached too.
+var cacheKeys sync.Map
+
+// sourceKey returns the cache key of the source at path: a checksum of its
+// contents, the images it references and the flags that affect decoding.
+func sourceKey(path string) (string, error) {
+	files, err := sourceFiles(path)
+	if err != nil {
+		return "", err
+	}
+	if flagFlatField != "" {
+		files = append(files, flagFlatField)
+	}
+	h := sha256.New()
+	for _, file := range files {
+		if err := hashFile(h, file); err != nil {
+			return "", err
+		}
+	}
+	fmt.Fprintf(h, "vignette=%g bands=%s math=%s range=%s lens=%s affine=%s rotate=%g register=%d colorkey=%s",
+		flagVignette, flagBands, flagBandMath, flagBandRange, flagLens, flagAffine, flagRotate, flagRegisterWindow, flagColorKey)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sourceFiles returns the files the source at path is decoded from: path
+// itself and, for montages, every image the layout references.
+func sourceFiles(path string) ([]string, error) {
+	files := []string{path}
+	if filepath.Ext(path) == ".montage" {
+		tiles, err := readMontage(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tiles {
+			files = append(files, t.Path)
+		}
+	}
+	return files, nil
+}
+
+func hashFile(w io.Writer, path string) error {
+	if isRemote(path) {
+		local, err := fetchSource(path)
+		if err != nil {
+			return err
+		}
+		path = local
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// resizeKey returns the cache key of src resized to width by height with
+// the interpolation function interp, or "" if src did not come from the
+// cache.
+func resizeKey(src image.Image, width, height uint, interp string) string {
+	parent, ok := cacheKeys.Load(src)
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %dx%d %s", parent, width, height, interp)))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadCached is loadSource backed by the -cache-dir cache.
+func loadCached(path string) (image.Image, error) {
+	if isRemote(path) {
+		local, err := fetchSource(path)
+		if err != nil {
+			return nil, err
+		}
+		path = local
+	}
+	key, err := sourceKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if img, ok := readCached(key); ok {
+		return img, nil
+	}
+
+	img, err := decodeFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if img, err = preprocess(img); err != nil {
+		return nil, err
+	}
+	return writeCached(key, img), nil
+}
+
+func cachePath(key string) string {
+	return filepath.Join(flagCacheDir, key+".rgba")
+}
+
+// readCached returns the image cached under key, if any.
+func readCached(key string) (*image.RGBA, bool) {
+	f, err := os.Open(cachePath(key))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var b image.Rectangle
+	if _, err := fmt.Fscanf(r, "rgba %d %d %d %d\n", &b.Min.X, &b.Min.Y, &b.Max.X, &b.Max.Y); err != nil {
+		return nil, false
+	}
+	img := image.NewRGBA(b)
+	if _, err := io.ReadFull(r, img.Pix); err != nil {
+		return nil, false
+	}
+	cacheKeys.Store(image.Image(img), key)
+	return img, true
+}
+
+// writeCached stores img under key and returns it as the image to use in
+// its place. Failing to write the cache only costs the next run time, so
+// errors are logged.
+func writeCached(key string, img image.Image) image.Image {
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Rect, img, rgba.Rect.Min, draw.Src)
+	}
+
+	if err := writeRGBA(cachePath(key), rgba); err != nil {
+		log.Println("cache:", err)
+	}
+	cacheKeys.Store(image.Image(rgba), key)
+	return rgba
+}
+
+// writeRGBA writes img to path in the cache format, replacing the file
+// atomically like tiler.WriteFile.
+func writeRGBA(path string, img *image.RGBA) error {
+	if err := ensureDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	b := img.Rect
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "rgba %d %d %d %d\n", b.Min.X, b.Min.Y, b.Max.X, b.Max.Y)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := img.PixOffset(b.Min.X, y)
+		w.Write(img.Pix[i : i+4*b.Dx()])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// cachedResize returns the cached result of resizing src to width by
+// height, calling scale and caching its result on a miss.
+func cachedResize(width, height uint, src image.Image, interp string, scale func() image.Image) image.Image {
+	key := resizeKey(src, width, height, interp)
+	if key == "" {
+		return scale()
+	}
+	if img, ok := readCached(key); ok {
+		return img
+	}
+	return writeCached(key, scale())
+}
+
+// forgetCached drops the key recorded for img once nothing more will be
+// resized from it.
+func forgetCached(img image.Image) {
+	cacheKeys.Delete(img)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// parseColor parses "transparent" or a hex color in #rgb, #rrggbb or
+// #rrggbbaa form. The leading # is optional.
+func parseColor(s string) (color.RGBA, error) {
+	if strings.EqualFold(s, "transparent") {
+		return color.RGBA{}, nil
+	}
+
+	h := strings.TrimPrefix(s, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	if len(h) == 6 {
+		h += "ff"
+	}
+	if len(h) != 8 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+
+	v, err := strconv.ParseUint(h, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+
+	// Stored premultiplied, as color.RGBA requires.
+	c := color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}
+	return color.RGBAModel.Convert(c).(color.RGBA), nil
+}
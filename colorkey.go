@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+var flagColorKey string
+
+func init() {
+	flag.StringVar(&flagColorKey, "colorkey", "", "make source pixels of this hex color transparent, optionally with a tolerance per channel after a colon, e.g. #ff00ff or #ff00ff:16, for images that mark transparency with a key color")
+}
+
+// parseColorKey parses -colorkey into the key color and its tolerance.
+func parseColorKey(s string) (color.RGBA, int, error) {
+	hex, tol := s, 0
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		var err error
+		hex = s[:i]
+		if tol, err = strconv.Atoi(s[i+1:]); err != nil || tol < 0 || tol > 255 {
+			return color.RGBA{}, 0, fmt.Errorf("invalid -colorkey %q: the tolerance must be from 0 to 255", s)
+		}
+	}
+	c, err := parseColor(hex)
+	if err != nil || c.A != 0xff {
+		return color.RGBA{}, 0, fmt.Errorf("invalid -colorkey %q: want an opaque hex color such as #ff00ff", s)
+	}
+	return c, tol, nil
+}
+
+// keyColor returns img with the pixels whose channels all lie within tol
+// of those of key made transparent.
+func keyColor(img image.Image, key color.RGBA, tol int) *image.RGBA {
+	out := cloneRGBA(img)
+	near := func(v, k uint8) bool {
+		d := int(v) - int(k)
+		return d <= tol && d >= -tol
+	}
+	for y := out.Rect.Min.Y; y < out.Rect.Max.Y; y++ {
+		row := out.Pix[out.PixOffset(out.Rect.Min.X, y):]
+		for i := 0; i < 4*out.Rect.Dx(); i += 4 {
+			a := uint32(row[i+3])
+			if a == 0 {
+				continue
+			}
+			// Compare unpremultiplied, as the key names a color.
+			r, g, b := uint32(row[i])*255/a, uint32(row[i+1])*255/a, uint32(row[i+2])*255/a
+			if near(uint8(r), key.R) && near(uint8(g), key.G) && near(uint8(b), key.B) {
+				row[i], row[i+1], row[i+2], row[i+3] = 0, 0, 0, 0
+			}
+		}
+	}
+	return out
+}
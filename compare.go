@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nfnt/resize"
+	"github.com/randomsean/tiler/tiler"
+)
+
+var (
+	flagCompareSettings string
+	flagCompareSamples  int
+)
+
+func init() {
+	flag.StringVar(&flagCompareSettings, "settings", "png,jpeg:50,jpeg:75,jpeg:90", "encoding[:quality] list evaluated by compare, of png, jpeg, webp and avif; webp with a quality is lossy")
+	flag.IntVar(&flagCompareSamples, "samples", 16, "number of tiles sampled by compare")
+}
+
+// encodeSetting is one encoding/quality combination evaluated by compare.
+// Lossy is set for WebP given a quality, which is encoded lossy whatever
+// -webp says.
+type encodeSetting struct {
+	Encoding string
+	Quality  int
+	Lossy    bool
+}
+
+func (s encodeSetting) String() string {
+	if s.Encoding == "jpeg" || s.Lossy {
+		return s.Encoding + ":" + strconv.Itoa(s.Quality)
+	}
+	return s.Encoding
+}
+
+// encode encodes tile at s.
+func (s encodeSetting) encode(w io.Writer, tile image.Image) error {
+	if s.Lossy {
+		return encodeWebP(w, tile, "lossy", s.Quality)
+	}
+	return encodeTile(w, tile, s.Encoding, s.Quality)
+}
+
+func parseSettings(list string) ([]encodeSetting, error) {
+	var settings []encodeSetting
+	for _, item := range strings.Split(list, ",") {
+		s := encodeSetting{Encoding: item, Quality: encodingQuality(item)}
+		i := strings.IndexByte(item, ':')
+		if i >= 0 {
+			q, err := strconv.Atoi(item[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quality in %q", item)
+			}
+			s.Encoding, s.Quality = item[:i], q
+		}
+		switch s.Encoding {
+		case "png", "jpeg":
+		case "webp":
+			s.Lossy = i >= 0
+		case "avif":
+			if i >= 0 {
+				return nil, fmt.Errorf("invalid setting %q: avif is encoded at -avif-quality", item)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported encoding %q", s.Encoding)
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+// sampleTiles crops n tiles spread evenly over a level that is side tiles
+// across, or every tile if n is not positive.
+func sampleTiles(resized image.Image, tileSize, side, n int) []*image.RGBA {
+	total := side * side
+	if n <= 0 || n > total {
+		n = total
+	}
+
+	var tiles []*image.RGBA
+	for i := 0; i < n; i++ {
+		t := i * total / n
+		tiles = append(tiles, tiler.Crop(resized, tileSize, t%side, t/side))
+	}
+	return tiles
+}
+
+// runCompare encodes a sample of tiles from one level at several settings
+// and prints their size next to PSNR and SSIM against the raw tile.
+func runCompare(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: tiler compare [flags] [level] [filename]")
+		os.Exit(2)
+	}
+
+	settings, err := parseSettings(flagCompareSettings)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	level := parseLevel(args[0])
+
+	img, err := loadSource(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tileSize := flagTileSizes[0]
+	side := 1 << uint(level)
+	size := uint(side * tileSize)
+	resized := resize.Resize(size, size, img, interpFor(level))
+
+	total := side * side
+	tiles := sampleTiles(resized, tileSize, side, flagCompareSamples)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "setting\tavg bytes\test. level bytes\tpsnr (dB)\tssim")
+
+	for _, s := range settings {
+		var bytesTotal int
+		var psnrTotal, ssimTotal float64
+
+		for _, tile := range tiles {
+			var buf bytes.Buffer
+			if err := s.encode(&buf, tile); err != nil {
+				log.Fatal(err)
+			}
+			bytesTotal += buf.Len()
+			if s.Encoding == "avif" {
+				// There is no AVIF decoder to measure the quality with.
+				continue
+			}
+
+			dec, _, err := image.Decode(&buf)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			psnrTotal += psnr(tile, dec)
+			ssimTotal += ssim(tile, dec)
+		}
+
+		avg := bytesTotal / len(tiles)
+		if s.Encoding == "avif" {
+			fmt.Fprintf(w, "%s\t%d\t%d\t-\t-\n", s, avg, avg*total)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.2f\t%.4f\n", s, avg, avg*total,
+			psnrTotal/float64(len(tiles)), ssimTotal/float64(len(tiles)))
+	}
+
+	w.Flush()
+}
+
+// psnr returns the peak signal-to-noise ratio of b against a over the RGB
+// channels. Identical images report +Inf.
+func psnr(a, b image.Image) float64 {
+	bounds := a.Bounds()
+
+	var sum float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			for _, d := range []float64{
+				float64(r1>>8) - float64(r2>>8),
+				float64(g1>>8) - float64(g2>>8),
+				float64(b1>>8) - float64(b2>>8),
+			} {
+				sum += d * d
+			}
+		}
+	}
+
+	mse := sum / float64(bounds.Dx()*bounds.Dy()*3)
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+// ssim returns the mean structural similarity of the luma of b against a,
+// computed over non-overlapping 8×8 windows.
+func ssim(a, b image.Image) float64 {
+	const (
+		win = 8
+		c1  = (0.01 * 255) * (0.01 * 255)
+		c2  = (0.03 * 255) * (0.03 * 255)
+	)
+
+	bounds := a.Bounds()
+
+	var total float64
+	var windows int
+
+	for wy := bounds.Min.Y; wy+win <= bounds.Max.Y; wy += win {
+		for wx := bounds.Min.X; wx+win <= bounds.Max.X; wx += win {
+			var sa, sb, saa, sbb, sab float64
+			for y := wy; y < wy+win; y++ {
+				for x := wx; x < wx+win; x++ {
+					la, lb := luma(a, x, y), luma(b, x, y)
+					sa += la
+					sb += lb
+					saa += la * la
+					sbb += lb * lb
+					sab += la * lb
+				}
+			}
+
+			n := float64(win * win)
+			ma, mb := sa/n, sb/n
+			va := saa/n - ma*ma
+			vb := sbb/n - mb*mb
+			cov := sab/n - ma*mb
+
+			total += ((2*ma*mb + c1) * (2*cov + c2)) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			windows++
+		}
+	}
+
+	if windows == 0 {
+		return 1
+	}
+	return total / float64(windows)
+}
+
+func luma(img image.Image, x, y int) float64 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	flagContactCell int
+	flagContactOut  string
+)
+
+func init() {
+	flag.IntVar(&flagContactCell, "cell", 64, "size in pixels of each tile on the contact sheet")
+	flag.StringVar(&flagContactOut, "sheet", "contact.png", "file the contact sheet is written to")
+}
+
+var (
+	contactMissing = color.RGBA{0x80, 0x80, 0x80, 0xff}
+	contactGrid    = color.RGBA{0xff, 0x00, 0xff, 0xff}
+)
+
+// runContact assembles every tile of one zoom level in the output
+// directory into a single labelled PNG for visual QA of seams.
+func runContact(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: tiler contact [flags] [zoom]")
+		os.Exit(2)
+	}
+
+	zoom, err := strconv.Atoi(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if zoom < 0 {
+		log.Fatalln("zoom must not be negative")
+	}
+	if flagContactCell <= 0 {
+		log.Fatalln("cell size must be a positive integer")
+	}
+
+	side := 1 << uint(zoom)
+	cell := flagContactCell
+	size := flagTileSizes[0]
+
+	sheet := image.NewRGBA(image.Rect(0, 0, side*cell+1, side*cell+1))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(contactGrid), image.Point{}, draw.Src)
+
+	label := &font.Drawer{
+		Dst:  sheet,
+		Src:  image.NewUniform(color.White),
+		Face: basicfont.Face7x13,
+	}
+
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			r := image.Rect(x*cell+1, y*cell+1, (x+1)*cell, (y+1)*cell)
+
+			path := filepath.Join(flagOutDir, tileName(sizeDir("", size), zoom, x, y, size))
+			tile, err := readTile(path)
+			if err != nil {
+				draw.Draw(sheet, r, image.NewUniform(contactMissing), image.Point{}, draw.Src)
+			} else {
+				thumb := resize.Resize(uint(r.Dx()), uint(r.Dy()), tile, resize.Bilinear)
+				draw.Draw(sheet, r, thumb, thumb.Bounds().Min, draw.Src)
+			}
+
+			label.Dot = fixed.P(r.Min.X+2, r.Min.Y+basicfont.Face7x13.Ascent+1)
+			label.DrawString(strconv.Itoa(x) + "," + strconv.Itoa(y))
+		}
+	}
+
+	f, err := os.Create(flagContactOut)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, sheet); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readTile decodes a previously written tile, whatever its encoding.
+func readTile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+var (
+	flagListen       string
+	flagQueueDir     string
+	flagDaemonJobs   int
+	flagDaemonCPUs   int
+	flagDaemonMemory byteSize
+)
+
+func init() {
+	flag.StringVar(&flagListen, "listen", "127.0.0.1:8700", "address the daemon API or tile server listens on")
+	flag.StringVar(&flagQueueDir, "queue-dir", "tiler-queue", "directory the daemon persists its job queue in")
+	flag.IntVar(&flagDaemonJobs, "daemon-jobs", 2, "number of jobs the daemon runs at once")
+	flag.IntVar(&flagDaemonCPUs, "daemon-cpus", runtime.NumCPU(), "CPUs shared between the daemon's running jobs by weight")
+	flag.Var(&flagDaemonMemory, "daemon-memory", "memory limit shared between the daemon's running jobs by weight, e.g. 16G (0 for none)")
+}
+
+// Job states.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// Job is one tiling run managed by the daemon. Args are the command line
+// arguments the run is executed with, e.g. ["-o", "out", "5", "map.png"].
+// Running jobs share the daemon's CPUs and memory in proportion to their
+// Weight.
+type Job struct {
+	ID       string    `json:"id"`
+	Args     []string  `json:"args"`
+	Priority int       `json:"priority"`
+	Weight   int       `json:"weight"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Started  time.Time `json:"started,omitzero"`
+	Finished time.Time `json:"finished,omitzero"`
+}
+
+// jobQueue holds the daemon's jobs and persists every change as one JSON
+// file per job, so queued and interrupted jobs survive restarts.
+type jobQueue struct {
+	mu    sync.Mutex
+	dir   string
+	jobs  map[string]*Job
+	procs map[string]*exec.Cmd
+	wake  chan struct{}
+}
+
+func openQueue(dir string) (*jobQueue, error) {
+	if err := ensureDir(dir); err != nil {
+		return nil, err
+	}
+
+	q := &jobQueue{
+		dir:   dir,
+		jobs:  make(map[string]*Job),
+		procs: make(map[string]*exec.Cmd),
+		wake:  make(chan struct{}, 1),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var j Job
+		if err := json.Unmarshal(data, &j); err != nil {
+			log.Printf("%s: %v", file, err)
+			continue
+		}
+		if j.Weight <= 0 {
+			j.Weight = 1
+		}
+		// A job that was running when the daemon stopped starts over.
+		if j.State == jobRunning {
+			j.State = jobQueued
+			j.Started = time.Time{}
+			if err := q.save(&j); err != nil {
+				return nil, err
+			}
+		}
+		q.jobs[j.ID] = &j
+	}
+	return q, nil
+}
+
+// save persists j. The caller must hold q.mu or own j exclusively.
+func (q *jobQueue) save(j *Job) error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tiler.WriteFile(filepath.Join(q.dir, j.ID+".json"), data)
+}
+
+func (q *jobQueue) Submit(args []string, priority, weight int) (*Job, error) {
+	if weight <= 0 {
+		weight = 1
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	j := &Job{
+		ID:       hex.EncodeToString(id),
+		Args:     args,
+		Priority: priority,
+		Weight:   weight,
+		State:    jobQueued,
+		Created:  time.Now().UTC(),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.save(j); err != nil {
+		return nil, err
+	}
+	q.jobs[j.ID] = j
+	q.signal()
+	return j, nil
+}
+
+// List returns copies of all jobs, highest priority first, then oldest.
+func (q *jobQueue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := make([]Job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		list = append(list, *j)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		if list[a].Priority != list[b].Priority {
+			return list[a].Priority > list[b].Priority
+		}
+		return list[a].Created.Before(list[b].Created)
+	})
+	return list
+}
+
+func (q *jobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+func (q *jobQueue) SetPriority(id string, priority int) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	j.Priority = priority
+	return *j, q.save(j)
+}
+
+// SetWeight changes a job's share of resources, rebalancing the running
+// jobs if it is one of them.
+func (q *jobQueue) SetWeight(id string, weight int) (Job, error) {
+	if weight <= 0 {
+		return Job{}, errors.New("weight must be a positive integer")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	j.Weight = weight
+	if j.State == jobRunning {
+		q.rebalance()
+	}
+	return *j, q.save(j)
+}
+
+// Cancel stops a queued or running job.
+func (q *jobQueue) Cancel(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	switch j.State {
+	case jobQueued:
+	case jobRunning:
+		if cmd := q.procs[id]; cmd != nil && cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	default:
+		return *j, fmt.Errorf("job %s is already %s", id, j.State)
+	}
+	j.State = jobCancelled
+	j.Finished = time.Now().UTC()
+	return *j, q.save(j)
+}
+
+func (q *jobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next marks the best queued job as running and returns it, unless
+// -daemon-jobs are already running.
+func (q *jobQueue) next() *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var best *Job
+	running := 0
+	for _, j := range q.jobs {
+		if j.State == jobRunning {
+			running++
+		}
+		if j.State != jobQueued {
+			continue
+		}
+		if best == nil || j.Priority > best.Priority ||
+			j.Priority == best.Priority && j.Created.Before(best.Created) {
+			best = j
+		}
+	}
+	if best == nil || running >= flagDaemonJobs {
+		return nil
+	}
+
+	best.State = jobRunning
+	best.Started = time.Now().UTC()
+	best.Error = ""
+	if err := q.save(best); err != nil {
+		log.Println(err)
+	}
+	return best
+}
+
+// work starts queued jobs as child processes of this binary, up to
+// -daemon-jobs at a time.
+func (q *jobQueue) work() {
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		j := q.next()
+		if j == nil {
+			<-q.wake
+			continue
+		}
+		go q.run(self, j)
+	}
+}
+
+// run executes j and records its outcome. The child follows its share of
+// resources through the file named by TILER_SHARE_FILE.
+func (q *jobQueue) run(self string, j *Job) {
+	q.mu.Lock()
+	if j.State != jobRunning {
+		// Cancelled since next picked it.
+		q.mu.Unlock()
+		q.finish(j, nil)
+		return
+	}
+	cmd := exec.Command(self, j.Args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "TILER_SHARE_FILE="+q.shareFile(j.ID))
+	q.rebalance()
+	err := cmd.Start()
+	if err == nil {
+		q.procs[j.ID] = cmd
+	}
+	q.mu.Unlock()
+
+	if err == nil {
+		err = cmd.Wait()
+	}
+	q.finish(j, err)
+}
+
+func (q *jobQueue) shareFile(id string) string {
+	return filepath.Join(q.dir, id+".share")
+}
+
+// rebalance divides -daemon-cpus and -daemon-memory between the running
+// jobs by weight and writes each job's share for it to pick up. The caller
+// must hold q.mu.
+func (q *jobQueue) rebalance() {
+	total := 0
+	for _, j := range q.jobs {
+		if j.State == jobRunning {
+			total += j.Weight
+		}
+	}
+	for _, j := range q.jobs {
+		if j.State != jobRunning {
+			continue
+		}
+		s := resourceShare{
+			CPUs:   flagDaemonCPUs * j.Weight / total,
+			Memory: int64(flagDaemonMemory) * int64(j.Weight) / int64(total),
+		}
+		if s.CPUs < 1 {
+			s.CPUs = 1
+		}
+		if err := s.Write(q.shareFile(j.ID)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (q *jobQueue) finish(j *Job, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.procs, j.ID)
+	os.Remove(q.shareFile(j.ID))
+	if j.State != jobCancelled {
+		j.Finished = time.Now().UTC()
+		if err != nil {
+			j.State = jobFailed
+			j.Error = err.Error()
+		} else {
+			j.State = jobDone
+		}
+		if err := q.save(j); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// Hand the job's share to the others and let a queued job start.
+	q.rebalance()
+	q.signal()
+}
+
+var errJobNotFound = errors.New("job not found")
+
+// commandFlags are the flags running commands of their own, which jobs
+// submitted by args or template vars cannot set: anyone reaching the API
+// could otherwise run anything as the daemon. Templates, which the
+// operator writes, may.
+var commandFlags = map[string]bool{
+	"on-complete":     true,
+	"on-error":        true,
+	"encrypt-key-cmd": true,
+	"superres":        true,
+	"avif-cmd":        true,
+	"scale-cmd":       true,
+}
+
+// checkJobCommand rejects args naming a subcommand, which the job child
+// would run in place of a tiling run: "job" runs any template file it is
+// given, and "daemon" or "serve" would hold the job's slot forever.
+func checkJobCommand(args []string) error {
+	if len(args) > 0 {
+		if _, ok := commands[args[0]]; ok {
+			return fmt.Errorf("jobs cannot run the %s subcommand", args[0])
+		}
+	}
+	return nil
+}
+
+// checkJobArgs rejects args, or values expanded into them, setting any of
+// the commandFlags.
+func checkJobArgs(args []string) error {
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		name := strings.TrimLeft(a, "-")
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name = name[:i]
+		}
+		if commandFlags[name] {
+			return fmt.Errorf("jobs cannot set -%s, which runs a command; use a -template-dir template", name)
+		}
+	}
+	return nil
+}
+
+// runDaemon serves the job API:
+//
+//	POST /jobs                 {"args": [...], "priority": n, "weight": n} submits a job
+//	GET  /jobs                 lists all jobs
+//	GET  /jobs/{id}            shows one job
+//	POST /jobs/{id}/cancel     cancels a queued or running job
+//	POST /jobs/{id}/priority   {"priority": n} reprioritizes a job
+//	POST /jobs/{id}/weight     {"weight": n} changes a job's resource share
+//
+// The API is unauthenticated, so -listen should stay on loopback or behind
+// an authenticating proxy.
+func runDaemon(args []string) {
+	q, err := openQueue(flagQueueDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go q.work()
+
+	http.HandleFunc("/jobs", q.handleJobs)
+	http.HandleFunc("/jobs/", q.handleJob)
+
+	log.Printf("daemon listening on %s", flagListen)
+	log.Fatal(http.ListenAndServe(flagListen, nil))
+}
+
+func (q *jobQueue) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, q.List())
+	case "POST":
+		var req struct {
+			Args     []string          `json:"args"`
+			Template string            `json:"template"`
+			Vars     map[string]string `json:"vars"`
+			Priority int               `json:"priority"`
+			Weight   int               `json:"weight"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (len(req.Args) == 0) == (req.Template == "") {
+			http.Error(w, "want {\"args\": [...] or \"template\": name, \"vars\": {...}, \"priority\": n, \"weight\": n}", http.StatusBadRequest)
+			return
+		}
+		values := append([]string(nil), req.Args...)
+		for _, v := range req.Vars {
+			values = append(values, v)
+		}
+		if err := checkJobCommand(req.Args); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkJobArgs(values); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Template != "" {
+			path, err := templatePath(req.Template)
+			if err == nil {
+				req.Args, err = loadTemplate(path, req.Vars)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		j, err := q.Submit(req.Args, req.Priority, req.Weight)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, j)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (q *jobQueue) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	id := parts[0]
+
+	var j Job
+	var err error
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		var ok bool
+		if j, ok = q.Get(id); !ok {
+			err = errJobNotFound
+		}
+	case len(parts) == 2 && parts[1] == "cancel" && r.Method == "POST":
+		j, err = q.Cancel(id)
+	case len(parts) == 2 && parts[1] == "priority" && r.Method == "POST":
+		var req struct {
+			Priority int `json:"priority"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "want {\"priority\": n}", http.StatusBadRequest)
+			return
+		}
+		j, err = q.SetPriority(id, req.Priority)
+	case len(parts) == 2 && parts[1] == "weight" && r.Method == "POST":
+		var req struct {
+			Weight int `json:"weight"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "want {\"weight\": n}", http.StatusBadRequest)
+			return
+		}
+		j, err = q.SetWeight(id, req.Weight)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case err == errJobNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeJSON(w, http.StatusOK, j)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubmitRejectsCommands(t *testing.T) {
+	q, err := openQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		body string
+		code int
+	}{
+		{`{"args": ["job", "/any/path.job"]}`, http.StatusBadRequest},
+		{`{"args": ["daemon", "-listen", ":0"]}`, http.StatusBadRequest},
+		{`{"args": ["serve"]}`, http.StatusBadRequest},
+		{`{"args": ["push", "s3://bucket"]}`, http.StatusBadRequest},
+		{`{"args": ["batch", "list.txt"]}`, http.StatusBadRequest},
+		{`{"args": ["-superres", "sh -c id", "3", "in.png"]}`, http.StatusBadRequest},
+		{`{"args": ["-o", "out", "3", "in.png"]}`, http.StatusCreated},
+	} {
+		w := httptest.NewRecorder()
+		q.handleJobs(w, httptest.NewRequest("POST", "/jobs", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%s: got status %d, want %d: %s", tt.body, w.Code, tt.code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+	if n := len(q.List()); n != 1 {
+		t.Errorf("queued %d jobs, want 1", n)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+var flagDownsample string
+
+func init() {
+	flag.StringVar(&flagDownsample, "downsample", "", "kernel deriving each level from the deeper one: box, gaussian or lanczos (default the -interp function); box softens fine detail such as text the most, lanczos the least")
+}
+
+// downsampleKernels are the -downsample kernels, in units of destination
+// pixels: x/image/draw widens them by the reduction factor.
+var downsampleKernels = map[string]*draw.Kernel{
+	"box": {Support: 0.5, At: func(t float64) float64 { return 1 }},
+	"gaussian": {Support: 1.5, At: func(t float64) float64 {
+		return math.Exp(-2 * t * t) // sigma 0.5
+	}},
+	"lanczos": {Support: 3, At: func(t float64) float64 {
+		if t == 0 {
+			return 1
+		}
+		return 3 * math.Sin(math.Pi*t) * math.Sin(math.Pi*t/3) / (math.Pi * math.Pi * t * t)
+	}},
+}
+
+// checkDownsample validates -downsample.
+func checkDownsample() error {
+	if _, ok := downsampleKernels[flagDownsample]; !ok && flagDownsample != "" {
+		return fmt.Errorf("unknown -downsample kernel %q, valid are box, gaussian and lanczos", flagDownsample)
+	}
+	return nil
+}
+
+// downsampleKernel returns the -downsample kernel, or nil to derive
+// levels with the -interp function.
+func downsampleKernel() *draw.Kernel {
+	return downsampleKernels[flagDownsample]
+}
+
+// levelKernel returns the scaler deriving level zoom from tiles of the
+// level below it.
+func levelKernel(zoom int) draw.Scaler {
+	if k := downsampleKernel(); k != nil {
+		return k
+	}
+	return interpKernel(zoom)
+}
+
+// downsample scales img, a deeper level, down to w×h with k.
+func downsample(img image.Image, w, h int, k *draw.Kernel) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	k.Scale(dst, dst.Rect, img, img.Bounds(), draw.Src, nil)
+	return dst
+}
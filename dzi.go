@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+var (
+	flagDZI        string
+	flagDZIOverlap int
+)
+
+func init() {
+	flag.StringVar(&flagDZI, "dzi", "", "write a Deep Zoom pyramid named this instead of square levels: <name>.dzi and <name>_files/<level>/<x>_<y> in the output directory")
+	flag.IntVar(&flagDZIOverlap, "dzi-overlap", 1, "pixels each Deep Zoom tile overlaps its neighbours by")
+}
+
+// dziImage is the Deep Zoom descriptor read by viewers such as
+// OpenSeadragon.
+type dziImage struct {
+	XMLName  xml.Name `xml:"http://schemas.microsoft.com/deepzoom/2008 Image"`
+	TileSize int      `xml:"TileSize,attr"`
+	Overlap  int      `xml:"Overlap,attr"`
+	Format   string   `xml:"Format,attr"`
+	Size     struct {
+		Width  int `xml:"Width,attr"`
+		Height int `xml:"Height,attr"`
+	} `xml:"Size"`
+}
+
+// tileExts maps encodings to the file extensions Deep Zoom and IIIF name
+// tiles with.
+var tileExts = map[string]string{
+	"png":  "png",
+	"jpeg": "jpg",
+	"webp": "webp",
+	"avif": "avif",
+}
+
+// dziLevels returns the highest Deep Zoom level of a w×h image. Level n
+// is the full image, and each level below halves it, rounding up, down to
+// 1×1 at level 0.
+func dziLevels(w, h int) int {
+	n := 0
+	for s := 1; s < w || s < h; s <<= 1 {
+		n++
+	}
+	return n
+}
+
+// tileDZI writes img as a Deep Zoom pyramid. Unlike the square levels,
+// its depth follows from the image size, and edge tiles are cut short
+// rather than padded.
+func tileDZI(img image.Image) {
+	if len(flagTileSizes) != 1 {
+		log.Fatalln("-dzi takes a single tile size")
+	}
+	if flagDZIOverlap < 0 {
+		log.Fatalln("-dzi-overlap must not be negative")
+	}
+	size := flagTileSizes[0]
+	b := img.Bounds()
+	top := dziLevels(b.Dx(), b.Dy())
+	files := flagDZI + "_files"
+	ext := tileExts[flagEncoding]
+
+	scaleLevels(img, top, size, func(z int, level image.Image) {
+		splitShortLevel(level, z, size, flagDZIOverlap, func(x, y int) string {
+			return dziTileName(files, z, x, y, ext)
+		})
+	})
+
+	desc := dziImage{TileSize: size, Overlap: flagDZIOverlap, Format: ext}
+	desc.Size.Width, desc.Size.Height = b.Dx(), b.Dy()
+	data, err := xml.MarshalIndent(&desc, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	data = append([]byte(xml.Header), append(data, '\n')...)
+	if err := output.WriteTile(flagDZI+".dzi", data); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// dziTileName returns the name of tile x, y of level z under files.
+func dziTileName(files string, z, x, y int, ext string) string {
+	return path.Join(files, fmt.Sprint(z), fmt.Sprintf("%d_%d.%s", x, y, ext))
+}
+
+// dziLevelSize returns the size of a w×h image halved shrink times,
+// rounding up.
+func dziLevelSize(w, h, shrink int) (int, int) {
+	d := 1 << uint(shrink)
+	return (w + d - 1) / d, (h + d - 1) / d
+}
+
+// scaleLevels calls fn with levels top to 0 of img, level z being img
+// halved top-z times. Each level is scaled from the one above it. The
+// tiles the levels are cut into at size are announced beforehand.
+func scaleLevels(img image.Image, top, size int, fn func(z int, level image.Image)) {
+	b := img.Bounds()
+	for z := 0; z <= top; z++ {
+		w, h := dziLevelSize(b.Dx(), b.Dy(), top-z)
+		n := ((w + size - 1) / size) * ((h + size - 1) / size)
+		budget.Expect(n)
+		progress.Expect(z, n)
+	}
+
+	src := img
+	for z := top; z >= 0; z-- {
+		w, h := dziLevelSize(b.Dx(), b.Dy(), top-z)
+		switch k := downsampleKernel(); {
+		case w == src.Bounds().Dx() && h == src.Bounds().Dy():
+		case k != nil && src != img:
+			src = downsample(src, w, h, k)
+		default:
+			src = resize.Resize(uint(w), uint(h), src, interpFor(z))
+		}
+		fn(z, src)
+	}
+}
+
+// splitShortLevel writes the tiles of level z, which img holds at its
+// size, as the files name returns. Edge tiles are cut short, and tiles
+// overlap their neighbours by overlap pixels.
+func splitShortLevel(img image.Image, z, size, overlap int, name func(x, y int) string) {
+	b := img.Bounds()
+	cols, rows := (b.Dx()+size-1)/size, (b.Dy()+size-1)/size
+
+	var wg sync.WaitGroup
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			name, r := name(x, y), shortTileRect(x, y, size, overlap, b)
+			wg.Add(1)
+			workers.Go(func() {
+				defer wg.Done()
+				if err := saveShortTile(img, r, z, name); err != nil {
+					log.Printf("%s: %v", name, err)
+					failures.Add(name, err)
+				}
+			})
+		}
+	}
+	wg.Wait()
+}
+
+// shortTileRect returns the area of tile x, y within b, extended by
+// overlap on every side that has a neighbour.
+func shortTileRect(x, y, size, overlap int, b image.Rectangle) image.Rectangle {
+	r := image.Rect(x*size, y*size, (x+1)*size, (y+1)*size).Add(b.Min)
+	r.Min.X -= overlap
+	r.Min.Y -= overlap
+	r.Max.X += overlap
+	r.Max.Y += overlap
+	return r.Intersect(b)
+}
+
+// saveShortTile encodes the area r of img and writes it as name.
+func saveShortTile(img image.Image, r image.Rectangle, z int, name string) error {
+	if err := output.Mkdir(path.Dir(name)); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	timings.Since(stageCrop, z, start)
+	if watermark != nil {
+		dst = stampWatermark(dst)
+	}
+
+	buf := getBuffer()
+	defer tileBuffers.Put(buf)
+	start = time.Now()
+	tile := image.Image(dst)
+	if flagEncoding == "png" {
+		tile = pngColor(dst, flagPNGColor.For(z))
+	}
+	err := encodeLimited(buf, tile, flagEncoding, budget.Quality())
+	timings.Since(stageEncode, z, start)
+	if err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+	if tileCipher != nil {
+		data = tileCipher.Seal(name, data)
+	}
+	start = time.Now()
+	if err := retry(func() error { return output.WriteTile(name, data) }); err != nil {
+		return err
+	}
+	timings.Since(stageWrite, z, start)
+
+	if manifest != nil {
+		manifest.Add(name, data)
+	}
+	stats.Add(z, len(data))
+	budget.Record(len(data))
+	progress.Done(name, z)
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+var (
+	flagEdge string
+	flagBG   string
+)
+
+func init() {
+	flag.StringVar(&flagEdge, "edge", "transparent", "fill for the parts of tiles beyond the image at levels that do not fill the tile grid: transparent, mirror (reflect the edge pixels) or a hex color")
+	flag.StringVar(&flagBG, "bg", "", "background color for the padding of tiles that extend past the image, as a hex color or transparent; JPEG tiles otherwise show black there")
+}
+
+// edgeFill is the parsed -edge. With neither mirror nor a color set the
+// area beyond the image is transparent.
+var edgeFill struct {
+	mirror bool
+	color  *color.RGBA
+}
+
+// parseEdge sets edgeFill from -edge, or from -bg, which takes the place
+// of an -edge color.
+func parseEdge() error {
+	edgeFill.mirror, edgeFill.color = false, nil
+	if flagBG != "" {
+		if !strings.EqualFold(flagEdge, "transparent") {
+			return errors.New("-bg and -edge both set the fill beyond the image; give only one")
+		}
+		c, err := parseColor(flagBG)
+		if err != nil {
+			return fmt.Errorf("invalid -bg %q: want transparent or a hex color", flagBG)
+		}
+		if c.A != 0 {
+			edgeFill.color = &c
+		}
+		return nil
+	}
+	switch {
+	case strings.EqualFold(flagEdge, "mirror"):
+		edgeFill.mirror = true
+	case !strings.EqualFold(flagEdge, "transparent"):
+		c, err := parseColor(flagEdge)
+		if err != nil {
+			return fmt.Errorf("invalid -edge %q: want transparent, mirror or a hex color", flagEdge)
+		}
+		edgeFill.color = &c
+	}
+	return nil
+}
+
+// cropTile stores tile x, y of the level img in dst, filling the part of
+// it beyond img according to -edge.
+func cropTile(dst *image.RGBA, img image.Image, x, y int) {
+	tiler.CropInto(dst, img, x, y)
+
+	size := dst.Rect.Dx()
+	area := image.Rect(x*size, y*size, (x+1)*size, (y+1)*size)
+	b := img.Bounds()
+	if area.In(b) || b.Empty() || (!edgeFill.mirror && edgeFill.color == nil) {
+		return
+	}
+	for py := area.Min.Y; py < area.Max.Y; py++ {
+		for px := area.Min.X; px < area.Max.X; px++ {
+			if (image.Point{px, py}).In(b) {
+				continue
+			}
+			var c color.Color
+			if edgeFill.mirror {
+				c = img.At(reflect(px, b.Min.X, b.Max.X), reflect(py, b.Min.Y, b.Max.Y))
+			} else {
+				c = *edgeFill.color
+			}
+			dst.Set(px-area.Min.X, py-area.Min.Y, c)
+		}
+	}
+}
+
+// reflect mirrors v into [min, max) across the nearer end, repeating the
+// edge pixel when v is further out than the range is wide.
+func reflect(v, min, max int) int {
+	switch {
+	case v < min:
+		v = 2*min - 1 - v
+	case v >= max:
+		v = 2*max - 1 - v
+	}
+	if v < min {
+		return min
+	}
+	if v >= max {
+		return max - 1
+	}
+	return v
+}
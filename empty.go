@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+var flagSkipEmpty bool
+
+func init() {
+	flag.BoolVar(&flagSkipEmpty, "skip-empty", false, "do not write tiles that are entirely transparent or entirely the -bg color; the -manifest lists them under empty_tiles")
+}
+
+// skippedTiles counts the tiles -skip-empty left out.
+var skippedTiles int64
+
+// emptyTile reports whether the rendered tile dst shows nothing but
+// transparency or the background, returning which.
+func emptyTile(dst *image.RGBA) (string, bool) {
+	c, ok := uniformColor(dst)
+	switch {
+	case !ok:
+		return "", false
+	case c.A == 0:
+		return "transparent", true
+	case edgeFill.color != nil && c == *edgeFill.color:
+		return "background", true
+	}
+	return "", false
+}
+
+// skipTile records that tile x, y is left out as empty. A copy written
+// by an earlier run is removed, so the tile does not keep showing stale
+// contents.
+func skipTile(kind string, tileSize, x, y, level int, dir string) error {
+	name := tileName(dir, level, x, y, tileSize)
+	if _, ok := output.(dirWriter); ok {
+		if err := os.Remove(filepath.Join(flagOutDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if manifest != nil {
+		manifest.AddEmpty(name, kind)
+	}
+	atomic.AddInt64(&skippedTiles, 1)
+	budget.Record(0)
+	progress.Done(name, level)
+	return nil
+}
+
+// reportSkipped logs how many tiles -skip-empty left out.
+func reportSkipped() {
+	if n := atomic.LoadInt64(&skippedTiles); n > 0 {
+		log.Printf("skipped %d empty tiles", n)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	flagEncrypt       bool
+	flagEncryptKeyCmd string
+)
+
+func init() {
+	flag.BoolVar(&flagEncrypt, "encrypt", false, "encrypt every tile with AES-256-GCM using the key in $TILER_TILE_KEY or printed by -encrypt-key-cmd")
+	flag.StringVar(&flagEncryptKeyCmd, "encrypt-key-cmd", "", "shell command printing the tile key, e.g. a KMS decrypt call")
+}
+
+// Encrypted tiles are stored as nonce || ciphertext || tag, with the tile's
+// path in the output directory as additional data so tiles cannot be
+// swapped. The nonce is derived from the key, path and contents, so an
+// unchanged tile encrypts to the same bytes and keeps its ETag.
+const tileNonceSize = 12
+
+// ManifestEncryption tells readers of the manifest how its tiles are
+// encrypted. KeyID identifies the key without revealing it.
+type ManifestEncryption struct {
+	Algorithm      string `json:"algorithm"`
+	KeyID          string `json:"key_id"`
+	NonceSize      int    `json:"nonce_size"`
+	AdditionalData string `json:"additional_data"`
+}
+
+type tileSealer struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+	keyID    string
+}
+
+// tileCipher encrypts tiles when -encrypt is set.
+var tileCipher *tileSealer
+
+// loadTileKey reads the 256-bit tile key, given in hex or base64.
+func loadTileKey() (*tileSealer, error) {
+	text := os.Getenv("TILER_TILE_KEY")
+	if flagEncryptKeyCmd != "" {
+		out, err := shellCommand(flagEncryptKeyCmd).Output()
+		if err != nil {
+			return nil, fmt.Errorf("-encrypt-key-cmd: %v", err)
+		}
+		text = string(out)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errors.New("no tile key: set $TILER_TILE_KEY or -encrypt-key-cmd")
+	}
+
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(text)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("tile key must be 32 bytes in hex or base64")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(append([]byte("tiler key id\x00"), key...))
+	return &tileSealer{
+		aead:     aead,
+		nonceKey: derive(key, "tiler nonce"),
+		keyID:    hex.EncodeToString(id[:8]),
+	}, nil
+}
+
+func derive(key []byte, label string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
+
+// Manifest returns the manifest entry describing s.
+func (s *tileSealer) Manifest() *ManifestEncryption {
+	return &ManifestEncryption{
+		Algorithm:      "AES-256-GCM",
+		KeyID:          s.keyID,
+		NonceSize:      tileNonceSize,
+		AdditionalData: "tile path",
+	}
+}
+
+// Seal encrypts the tile data stored at the relative path name.
+func (s *tileSealer) Seal(name string, data []byte) []byte {
+	name = filepath.ToSlash(name)
+	m := hmac.New(sha256.New, s.nonceKey)
+	m.Write([]byte(name))
+	m.Write([]byte{0})
+	m.Write(data)
+	nonce := m.Sum(nil)[:tileNonceSize]
+	return s.aead.Seal(nonce, nonce, data, []byte(name))
+}
+
+// Open decrypts the sealed tile stored at the relative path name.
+func (s *tileSealer) Open(name string, sealed []byte) ([]byte, error) {
+	if len(sealed) < tileNonceSize {
+		return nil, errors.New("encrypted tile too short")
+	}
+	nonce, ciphertext := sealed[:tileNonceSize], sealed[tileNonceSize:]
+	return s.aead.Open(nil, nonce, ciphertext, []byte(filepath.ToSlash(name)))
+}
+
+// sealTile encrypts data if -encrypt is set.
+func sealTile(name string, data []byte) []byte {
+	if tileCipher == nil {
+		return data
+	}
+	return tileCipher.Seal(name, data)
+}
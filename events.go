@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"time"
+)
+
+var (
+	flagProgress      string
+	flagProgressEvery int
+)
+
+func init() {
+	flag.StringVar(&flagProgress, "progress", "text", "how to report progress: text on stderr, or json for progress events on stdout, one JSON object per line, for programs wrapping tiler")
+	flag.IntVar(&flagProgressEvery, "progress-every", 100, "-progress json: tiles stored between progress events")
+}
+
+// checkProgress validates -progress and -progress-every.
+func checkProgress() error {
+	switch {
+	case flagProgress != "text" && flagProgress != "json":
+		return errors.New("-progress must be text or json")
+	case flagProgressEvery < 1:
+		return errors.New("-progress-every must be at least 1")
+	}
+	return nil
+}
+
+// progressEvents writes the progress of the run to stdout for -progress
+// json, one JSON object per line: a tiles event every -progress-every
+// tiles and after the last one expected, a level event as each level is
+// complete and a done event when the run ends. Its methods are called
+// with progress.mu held, so events appear in the order tiles are stored.
+type progressEvents struct {
+	start time.Time
+	enc   *json.Encoder
+}
+
+// progressEvent is one line of -progress json. Done and Total count the
+// tiles of the whole run; Zoom and Tiles are set for level events.
+type progressEvent struct {
+	Event   string  `json:"event"`
+	Zoom    *int    `json:"zoom,omitempty"`
+	Tiles   int     `json:"tiles,omitempty"`
+	Done    int     `json:"done"`
+	Total   int     `json:"total"`
+	Percent float64 `json:"percent"`
+	Elapsed float64 `json:"elapsed"`
+	ETA     float64 `json:"eta,omitempty"`
+	Failed  int     `json:"failed,omitempty"`
+}
+
+// startProgressEvents starts writing progress events.
+func startProgressEvents() {
+	progress.mu.Lock()
+	progress.events = &progressEvents{start: time.Now(), enc: json.NewEncoder(os.Stdout)}
+	progress.mu.Unlock()
+}
+
+// stopProgressEvents writes the done event and stops writing events.
+func stopProgressEvents() {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	e := progress.events
+	if e == nil {
+		return
+	}
+	progress.events = nil
+	ev := e.event("done", &progress)
+	ev.ETA = 0
+	ev.Failed = failures.Len()
+	e.enc.Encode(&ev)
+}
+
+// stored writes the events due once a tile of zoom is stored.
+func (e *progressEvents) stored(p *tileProgress, zoom int) {
+	if p.done%flagProgressEvery == 0 || p.done == p.total {
+		ev := e.event("tiles", p)
+		e.enc.Encode(&ev)
+	}
+	if l := p.levels[zoom]; l.done == l.total {
+		ev := e.event("level", p)
+		ev.Zoom, ev.Tiles = &zoom, l.total
+		e.enc.Encode(&ev)
+	}
+}
+
+// event returns an event reporting the run-wide counts of p.
+func (e *progressEvents) event(name string, p *tileProgress) progressEvent {
+	ev := progressEvent{
+		Event:   name,
+		Done:    p.done,
+		Total:   p.total,
+		Elapsed: time.Since(e.start).Seconds(),
+	}
+	if p.total > 0 {
+		ev.Percent = 100 * float64(p.done) / float64(p.total)
+	}
+	if p.done > 0 && p.done < p.total {
+		ev.ETA = ev.Elapsed * float64(p.total-p.done) / float64(p.done)
+	}
+	return ev
+}
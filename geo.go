@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	flagBounds     string
+	flagCRS        string
+	flagWorldFiles bool
+)
+
+func init() {
+	flag.StringVar(&flagBounds, "bounds", "", "georeference the tiles: extent of the source in map units as minx,miny,maxx,maxy, recorded per level in bounds.json (default from GeoTIFF sources)")
+	flag.StringVar(&flagCRS, "crs", "", "coordinate reference system of -bounds, e.g. EPSG:3857, recorded in bounds.json")
+	flag.BoolVar(&flagWorldFiles, "world-files", false, "write a world file beside every tile, e.g. 3_1_2.pgw for 3_1_2.png, placing it at -bounds or the GeoTIFF bounds in GIS tools")
+}
+
+// boundsFile is the name of the georeferencing file of a tileset.
+const boundsFile = "bounds.json"
+
+// geoBounds is the extent of the source being tiled, minx, miny, maxx,
+// maxy, from -bounds or the GeoTIFF source, or nil.
+var geoBounds *[4]float64
+
+// parseBounds validates -bounds, -crs and -world-files.
+func parseBounds() error {
+	if (flagBounds != "" || flagWorldFiles) && (flagDZI != "" || flagIIIF != "") {
+		return errors.New("-bounds and -world-files cannot be combined with -dzi or -iiif")
+	}
+	if flagBounds == "" {
+		if flagCRS != "" {
+			return errors.New("-crs needs -bounds")
+		}
+		return nil
+	}
+	var b [4]float64
+	parts := strings.Split(flagBounds, ",")
+	if len(parts) != len(b) {
+		return fmt.Errorf("invalid -bounds %q: want minx,miny,maxx,maxy", flagBounds)
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return fmt.Errorf("invalid -bounds %q: %v", flagBounds, err)
+		}
+		b[i] = v
+	}
+	if b[0] >= b[2] || b[1] >= b[3] {
+		return fmt.Errorf("invalid -bounds %q: the minimum must be below the maximum", flagBounds)
+	}
+	geoBounds, boundsGiven = &b, true
+	return nil
+}
+
+// geoLevel is the georeferencing of one level in bounds.json, numbered as
+// its tiles are named.
+type geoLevel struct {
+	Zoom      int        `json:"zoom"`
+	TileSize  int        `json:"tile_size"`
+	Width     int        `json:"width"`
+	Height    int        `json:"height"`
+	PixelSize [2]float64 `json:"pixel_size"`
+	Tiles     [2]int     `json:"tiles"`
+}
+
+// pixelSize returns the width and height in map units of a pixel of
+// level, whose tiles are tileSize pixels, stretched over -bounds.
+func pixelSize(level, tileSize int) (float64, float64) {
+	w, h := levelSize(tileSource, level, tileSize)
+	b := geoBounds
+	return (b[2] - b[0]) / float64(w), (b[3] - b[1]) / float64(h)
+}
+
+// writeBounds writes bounds.json into dir, describing where the levels 0
+// to level of the source, of bounds src, lie on the map.
+func writeBounds(src image.Rectangle, level int, dir string) {
+	desc := struct {
+		Bounds  [4]float64 `json:"bounds"`
+		CRS     string     `json:"crs,omitempty"`
+		Pattern string     `json:"pattern"`
+		Scheme  string     `json:"scheme"`
+		Levels  []geoLevel `json:"levels"`
+	}{Bounds: *geoBounds, CRS: flagCRS, Pattern: flagPattern, Scheme: flagScheme}
+	for z := 0; z <= level; z++ {
+		for _, size := range flagTileSizes {
+			w, h := levelSize(src, z, size)
+			px, py := pixelSize(z, size)
+			t := levelTiles(src, z, size)
+			gz, _, _ := remapTile(z, 0, 0)
+			desc.Levels = append(desc.Levels, geoLevel{gz, size, w, h, [2]float64{px, py}, [2]int{t.Dx(), t.Dy()}})
+		}
+	}
+
+	data, err := json.MarshalIndent(&desc, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	name := filepath.Join(dir, boundsFile)
+	data = sealTile(name, append(data, '\n'))
+	if err := retry(func() error { return output.WriteTile(name, data) }); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// worldFileName returns the name of the world file of the tile name: the
+// first and last letters of its extension followed by w, as in .pgw for
+// .png, or .wld without one.
+func worldFileName(name string) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if len(ext) < 3 {
+		return stem + ".wld"
+	}
+	return stem + "." + ext[1:2] + ext[len(ext)-1:] + "w"
+}
+
+// writeWorldFile writes the world file of tile x, y of level, named
+// name: the pixel size and the map position of the centre of its top-left
+// pixel, which world files place the tile by.
+func writeWorldFile(name string, tileSize, x, y, level int) error {
+	px, py := pixelSize(level, tileSize)
+	cx := geoBounds[0] + (float64(x*tileSize)+0.5)*px
+	cy := geoBounds[3] - (float64(y*tileSize)+0.5)*py
+	data := []byte(fmt.Sprintf("%.12g\n0\n0\n%.12g\n%.12g\n%.12g\n", px, -py, cx, cy))
+
+	wld := worldFileName(name)
+	data = sealTile(wld, data)
+	return retry(func() error { return output.WriteTile(wld, data) })
+}
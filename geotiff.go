@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+)
+
+// GeoTIFF tags and GeoKeys read by readGeoTIFF.
+const (
+	tagModelPixelScale     = 33550
+	tagModelTiepoint       = 33922
+	tagModelTransformation = 34264
+	tagGeoKeyDirectory     = 34735
+
+	geoKeyRasterType    = 1025
+	geoKeyGeographicCRS = 2048
+	geoKeyProjectedCRS  = 3072
+)
+
+// geoRef is where a GeoTIFF lies on the map.
+type geoRef struct {
+	bounds [4]float64 // minx, miny, maxx, maxy
+	epsg   int        // 0 if the CRS is not an EPSG code
+}
+
+// boundsGiven records whether -bounds was given, rather than taken from
+// a GeoTIFF input.
+var boundsGiven bool
+
+// georeference takes -bounds and -crs from the GeoTIFF at path unless
+// -bounds is given, and places its tiles in the global web mercator
+// tileset, as with -offset, if it covers exactly one tile of it. Inputs
+// that are not GeoTIFFs leave the tiles without georeferencing.
+func georeference(path string) {
+	if boundsGiven || flagDZI != "" || flagIIIF != "" || isRemote(path) {
+		return
+	}
+	geoBounds, flagCRS, geoNode = nil, "", nil
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	g, ok := readGeoTIFF(f, fi.Size())
+	if !ok {
+		return
+	}
+	if flagAffine != "" || flagRotate != 0 || flagLens != "" {
+		log.Printf("%s: ignoring its georeferencing, which -affine, -rotate and -lens would invalidate", path)
+		return
+	}
+	geoBounds = &g.bounds
+	crs := "an unknown CRS"
+	if g.epsg != 0 {
+		flagCRS = fmt.Sprintf("EPSG:%d", g.epsg)
+		crs = flagCRS
+	}
+	log.Printf("%s: GeoTIFF in %s covering %g,%g,%g,%g", path, crs, g.bounds[0], g.bounds[1], g.bounds[2], g.bounds[3])
+	if n := g.mercatorNode(); n != nil && flagOffset == "" {
+		geoNode = n
+		log.Printf("%s: covers web mercator tile %d/%d/%d, numbering tiles to match", path, n[0], n[1], n[2])
+	}
+}
+
+// readGeoTIFF reads the georeferencing of the first image of the TIFF r,
+// of size bytes. It reports false if r is not a GeoTIFF north up, as
+// rotated and sheared rasters cannot be described by bounds.
+func readGeoTIFF(r io.ReaderAt, size int64) (*geoRef, bool) {
+	order, first, ok := readTIFFHeader(r)
+	if !ok {
+		return nil, false
+	}
+	tags, _, ok := readIFD(r, size, order, first)
+	if !ok {
+		return nil, false
+	}
+	doubles, ok := readIFDDoubles(r, size, order, first)
+	if !ok {
+		return nil, false
+	}
+	w, h := float64(firstValue(tags, tagImageWidth)), float64(firstValue(tags, tagImageLength))
+	if w == 0 || h == 0 {
+		return nil, false
+	}
+
+	// The pixel (i, j) is at (x0 + i*sx, y0 - j*sy): the corner of the
+	// top-left pixel is at (x0, y0).
+	var x0, y0, sx, sy float64
+	scale, tie, m := doubles[tagModelPixelScale], doubles[tagModelTiepoint], doubles[tagModelTransformation]
+	switch {
+	case len(m) == 16:
+		if m[1] != 0 || m[4] != 0 {
+			return nil, false
+		}
+		x0, y0, sx, sy = m[3], m[7], m[0], -m[5]
+	case len(scale) >= 2 && len(tie) >= 6:
+		sx, sy = scale[0], scale[1]
+		x0, y0 = tie[3]-tie[0]*sx, tie[4]+tie[1]*sy
+	default:
+		return nil, false
+	}
+
+	g := &geoRef{}
+	keys := geoKeys(tags[tagGeoKeyDirectory])
+	if keys[geoKeyRasterType] == 2 {
+		// PixelIsPoint: the tiepoint is the centre of its pixel.
+		x0, y0 = x0-sx/2, y0+sy/2
+	}
+	x1, y1 := x0+w*sx, y0-h*sy
+	g.bounds = [4]float64{math.Min(x0, x1), math.Min(y0, y1), math.Max(x0, x1), math.Max(y0, y1)}
+	if code := keys[geoKeyProjectedCRS]; code > 0 && code < 32767 {
+		g.epsg = int(code)
+	} else if code := keys[geoKeyGeographicCRS]; code > 0 && code < 32767 {
+		g.epsg = int(code)
+	}
+	return g, true
+}
+
+// firstValue returns the first value of tag, or 0.
+func firstValue(tags map[uint16][]uint32, tag uint16) uint32 {
+	if vs := tags[tag]; len(vs) > 0 {
+		return vs[0]
+	}
+	return 0
+}
+
+// geoKeys returns the GeoKeys stored in the GeoKeyDirectory itself. Keys
+// stored in other tags, such as citations, are left out.
+func geoKeys(dir []uint32) map[uint32]uint32 {
+	keys := make(map[uint32]uint32)
+	if len(dir) < 4 {
+		return keys
+	}
+	for e := dir[4:]; len(e) >= 4; e = e[4:] {
+		if e[1] == 0 {
+			keys[e[0]] = e[3]
+		}
+	}
+	return keys
+}
+
+// readIFDDoubles returns the DOUBLE tags of the IFD at off.
+func readIFDDoubles(r io.ReaderAt, size int64, order binary.ByteOrder, off int64) (map[uint16][]float64, bool) {
+	var n [2]byte
+	if _, err := r.ReadAt(n[:], off); err != nil {
+		return nil, false
+	}
+	entries := make([]byte, 12*int(order.Uint16(n[:])))
+	if _, err := r.ReadAt(entries, off+2); err != nil {
+		return nil, false
+	}
+
+	tags := make(map[uint16][]float64)
+	for e := entries; len(e) >= 12; e = e[12:] {
+		if order.Uint16(e[2:]) != 12 {
+			continue
+		}
+		count := int64(order.Uint32(e[4:]))
+		at := int64(order.Uint32(e[8:]))
+		if count > 1<<16 || at+8*count > size {
+			return nil, false
+		}
+		data := make([]byte, 8*count)
+		if _, err := r.ReadAt(data, at); err != nil {
+			return nil, false
+		}
+		vs := make([]float64, count)
+		for i := range vs {
+			vs[i] = math.Float64frombits(order.Uint64(data[8*i:]))
+		}
+		tags[order.Uint16(e)] = vs
+	}
+	return tags, true
+}
+
+// webMercatorEPSG are the codes of the spherical mercator projection of
+// web map tilesets.
+var webMercatorEPSG = map[int]bool{3857: true, 3785: true, 900913: true, 102100: true}
+
+// mercatorWorld is the width of the world in web mercator metres.
+const mercatorWorld = 2 * 20037508.342789244
+
+// mercatorNode returns the zoom, x and y of the web mercator tile g
+// covers exactly, or nil if it is not in web mercator or covers no single
+// tile.
+func (g *geoRef) mercatorNode() *[3]int {
+	if !webMercatorEPSG[g.epsg] {
+		return nil
+	}
+	b := g.bounds
+	zoom := int(math.Round(math.Log2(mercatorWorld / (b[2] - b[0]))))
+	if zoom < 0 || zoom > 30 {
+		return nil
+	}
+	node := mercatorWorld / float64(int(1)<<uint(zoom))
+	x := (b[0] + mercatorWorld/2) / node
+	y := (mercatorWorld/2 - b[3]) / node
+	const tolerance = 1e-6
+	for _, v := range []float64{(b[2] - b[0]) / node, (b[3] - b[1]) / node} {
+		if math.Abs(v-1) > tolerance {
+			return nil
+		}
+	}
+	if math.Abs(x-math.Round(x)) > tolerance || math.Abs(y-math.Round(y)) > tolerance {
+		return nil
+	}
+	return &[3]int{zoom, int(math.Round(x)), int(math.Round(y))}
+}
+
+// geoNode is the web mercator tile the GeoTIFF being tiled covers, used
+// by setOffset without -offset, or nil.
+var geoNode *[3]int
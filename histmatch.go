@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"log"
+)
+
+var flagMatchHistogram string
+
+func init() {
+	flag.StringVar(&flagMatchHistogram, "match-histogram", "", "batch: match the histogram of every input to this reference image, or to the combined histogram of all inputs with all, so that adjacent scenes tile without exposure jumps at their seams")
+}
+
+// histogram counts the unpremultiplied red, green and blue values of the
+// pixels of one or more images that are not fully transparent.
+type histogram [3][256]float64
+
+// add counts the pixels of img.
+func (h *histogram) add(img image.Image) {
+	m := toRGBA(img)
+	for i := 0; i < len(m.Pix); i += 4 {
+		a := uint32(m.Pix[i+3])
+		if a == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			h[c][uint32(m.Pix[i+c])*255/a]++
+		}
+	}
+}
+
+// lut returns the table mapping each channel value of h to the value of
+// ref at the same point of its cumulative distribution.
+func (h *histogram) lut(ref *histogram) [3][256]uint8 {
+	var t [3][256]uint8
+	for c := 0; c < 3; c++ {
+		in, out := cumulative(h[c]), cumulative(ref[c])
+		r := 0
+		for v := 0; v < 256; v++ {
+			for r < 255 && out[r] < in[v] {
+				r++
+			}
+			t[c][v] = uint8(r)
+		}
+	}
+	return t
+}
+
+// cumulative returns the cumulative distribution of the counts, from 0 to
+// 1.
+func cumulative(counts [256]float64) [256]float64 {
+	var cdf [256]float64
+	var sum float64
+	for v, n := range counts {
+		sum += n
+		cdf[v] = sum
+	}
+	if sum > 0 {
+		for v := range cdf {
+			cdf[v] /= sum
+		}
+	}
+	return cdf
+}
+
+// matchHistogram returns img with its histogram matched to ref.
+func matchHistogram(img image.Image, ref *histogram) *image.RGBA {
+	out := cloneRGBA(img)
+	var h histogram
+	h.add(out)
+	t := h.lut(ref)
+	for i := 0; i < len(out.Pix); i += 4 {
+		a := uint32(out.Pix[i+3])
+		if a == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			v := t[c][uint32(out.Pix[i+c])*255/a]
+			out.Pix[i+c] = uint8((uint32(v)*a + 127) / 255)
+		}
+	}
+	return out
+}
+
+// referenceHistogram returns the histogram -match-histogram asks batch
+// inputs to be matched to, reading every input for all. Inputs that fail
+// to decode are left out here and reported when they are tiled.
+func referenceHistogram(paths []string) (*histogram, error) {
+	ref := new(histogram)
+	if flagMatchHistogram != "all" {
+		img, err := decodeFile(flagMatchHistogram)
+		if err != nil {
+			return nil, err
+		}
+		ref.add(img)
+		return ref, nil
+	}
+	for _, path := range paths {
+		img, err := safeDecode(path)
+		if err != nil {
+			continue
+		}
+		ref.add(img)
+		forgetCached(img)
+	}
+	log.Printf("matching histograms to the %d inputs combined", len(paths))
+	return ref, nil
+}
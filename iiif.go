@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"path"
+)
+
+var flagIIIF string
+
+func init() {
+	flag.StringVar(&flagIIIF, "iiif", "", "write IIIF Image API level 0 static tiles and info.json instead of square levels, for the image service at this URL, which serves the output directory")
+}
+
+// iiifInfo is the IIIF Image API 2.1 image information document.
+type iiifInfo struct {
+	Context     string        `json:"@context"`
+	ID          string        `json:"@id"`
+	Protocol    string        `json:"protocol"`
+	Width       int           `json:"width"`
+	Height      int           `json:"height"`
+	Profile     []interface{} `json:"profile"`
+	Tiles       []iiifTiles   `json:"tiles"`
+	Sizes       []iiifSize    `json:"sizes"`
+	Attribution string        `json:"attribution,omitempty"`
+	License     string        `json:"license,omitempty"`
+}
+
+type iiifTiles struct {
+	Width        int   `json:"width"`
+	Height       int   `json:"height"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+type iiifSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// tileIIIF writes img as the static tiles a IIIF level 0 image service
+// serves: one file per tile at every scale factor, named by the image
+// request it answers, {region}/{size}/0/default.{format}. The regions are
+// in full image pixels, and levels small enough to fit one tile are
+// requested whole, as viewers such as OpenSeadragon, and so Mirador and
+// Universal Viewer, do.
+func tileIIIF(img image.Image) {
+	if len(flagTileSizes) != 1 {
+		log.Fatalln("-iiif takes a single tile size")
+	}
+	size := flagTileSizes[0]
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	top := iiifTop(w, h, size)
+	ext := tileExts[flagEncoding]
+
+	info := iiifInfo{
+		Context:  "http://iiif.io/api/image/2/context.json",
+		ID:       flagIIIF,
+		Protocol: "http://iiif.io/api/image",
+		Width:    w,
+		Height:   h,
+		Profile:  []interface{}{"http://iiif.io/api/image/2/level0.json"},
+		Tiles:    []iiifTiles{{Width: size, Height: size}},
+	}
+	if ext != "jpg" {
+		info.Profile = append(info.Profile, map[string][]string{"formats": {ext}})
+	}
+	if l := layerInfo(); l != nil {
+		info.Attribution, info.License = l.Attribution, l.License
+	}
+
+	scaleLevels(img, top, size, func(z int, level image.Image) {
+		s := 1 << uint(top-z)
+		lw, lh := level.Bounds().Dx(), level.Bounds().Dy()
+		whole := lw < size && lh < size
+		splitShortLevel(level, z, size, 0, func(x, y int) string {
+			return iiifTileName(level.Bounds(), w, h, size, s, x, y, ext)
+		})
+		info.Tiles[0].ScaleFactors = append(info.Tiles[0].ScaleFactors, s)
+		if whole {
+			info.Sizes = append([]iiifSize{{lw, lh}}, info.Sizes...)
+		}
+	})
+	if info.Sizes == nil {
+		info.Sizes = []iiifSize{}
+	}
+
+	data, err := json.MarshalIndent(&info, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := output.WriteTile("info.json", append(data, '\n')); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// iiifTop returns the deepest level of a w×h image, the first halving
+// that fits within one tile of size.
+func iiifTop(w, h, size int) int {
+	top := 0
+	for lw, lh := w, h; lw > size || lh > size; top++ {
+		lw, lh = dziLevelSize(w, h, top+1)
+	}
+	return top
+}
+
+// iiifTileName returns the image request naming tile x, y of the level
+// with bounds b, the w×h image reduced by the scale factor s.
+func iiifTileName(b image.Rectangle, w, h, size, s, x, y int, ext string) string {
+	region := "full"
+	if b.Dx() >= size || b.Dy() >= size {
+		rx, ry := x*size*s, y*size*s
+		rw, rh := size*s, size*s
+		if rx+rw > w {
+			rw = w - rx
+		}
+		if ry+rh > h {
+			rh = h - ry
+		}
+		region = fmt.Sprintf("%d,%d,%d,%d", rx, ry, rw, rh)
+	}
+	return path.Join(region, iiifSizeParam(b, x, y, size, w), "0", "default."+ext)
+}
+
+// iiifSizeParam returns the size parameter requesting tile x, y of a
+// level with bounds b: its width, or full at the image width w.
+func iiifSizeParam(b image.Rectangle, x, y, size, w int) string {
+	tw := shortTileRect(x, y, size, 0, b).Dx()
+	if tw == w {
+		return "full"
+	}
+	return fmt.Sprintf("%d,", tw)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/nfnt/resize"
+)
+
+// inspectSamples bounds how many pixels along each axis inspect examines.
+const inspectSamples = 512
+
+// sourceTraits summarizes the pixels of a source.
+type sourceTraits struct {
+	Alpha  string // "none", "binary" or "partial"
+	Gray   bool
+	Colors int // distinct colors sampled, capped at 257
+}
+
+// runInspect reports what tiling a source would involve, so the settings
+// of a long run can be chosen up front.
+func runInspect(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: tiler inspect [flags] [filename]")
+		os.Exit(2)
+	}
+
+	img, err := loadSource(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := img.Bounds()
+	t := traits(img)
+
+	tileSize := flagTileSizes[0]
+	zoom := nativeZoom(b, tileSize)
+
+	// Deep pyramids make for millions of files; larger tiles cut that by
+	// four per level at little cost to viewers.
+	suggestedSize := 256
+	if nativeZoom(b, 256) >= 8 {
+		suggestedSize = 512
+	}
+
+	setting, colorType := "jpeg", ""
+	switch {
+	case t.Alpha != "none" && t.Gray:
+		setting, colorType = "png", "gray-alpha"
+	case t.Alpha != "none":
+		setting = "png"
+	case t.Colors <= 256:
+		setting, colorType = "png", "palette"
+	case t.Gray:
+		setting, colorType = "png", "gray"
+	}
+
+	side := 1 << uint(zoom)
+	resized := resize.Resize(uint(side*tileSize), uint(side*tileSize), img, interpFor(zoom))
+	var sampled int
+	tiles := sampleTiles(resized, tileSize, side, flagCompareSamples)
+	for _, tile := range tiles {
+		var buf bytes.Buffer
+		var tileImg image.Image = tile
+		if setting == "png" {
+			tileImg = pngColor(tile, colorType)
+		}
+		if err := encodeTile(&buf, tileImg, setting, encodingQuality(setting)); err != nil {
+			log.Fatal(err)
+		}
+		sampled += buf.Len()
+	}
+	count := 0
+	for z := 0; z <= zoom; z++ {
+		count += 1 << uint(2*z)
+	}
+	projected := int64(sampled) / int64(len(tiles)) * int64(count)
+
+	colors := fmt.Sprint(t.Colors)
+	if t.Colors > 256 {
+		colors = "more than 256"
+	}
+	suggested := "-e " + setting
+	if colorType != "" {
+		suggested += " -png-color " + colorType
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "dimensions\t%dx%d\n", b.Dx(), b.Dy())
+	fmt.Fprintf(w, "color model\t%s\n", colorModelName(img))
+	fmt.Fprintf(w, "alpha\t%s\n", t.Alpha)
+	fmt.Fprintf(w, "grayscale\t%v\n", t.Gray)
+	fmt.Fprintf(w, "colors\t%s\n", colors)
+	fmt.Fprintf(w, "native max zoom\t%d at %dpx tiles\n", zoom, tileSize)
+	fmt.Fprintf(w, "suggested tile size\t%d\n", suggestedSize)
+	fmt.Fprintf(w, "suggested encoding\t%s\n", suggested)
+	fmt.Fprintf(w, "projected output\t%d tiles, about %s\n", count, formatBytes(projected))
+	w.Flush()
+}
+
+// nativeZoom returns the first zoom at which the level is at least as large
+// as the source, so no detail is lost.
+func nativeZoom(b image.Rectangle, tileSize int) int {
+	size := b.Dx()
+	if b.Dy() > size {
+		size = b.Dy()
+	}
+	zoom := 0
+	for (1<<uint(zoom))*tileSize < size {
+		zoom++
+	}
+	return zoom
+}
+
+// traits samples img on a grid of at most inspectSamples pixels per axis.
+func traits(img image.Image) sourceTraits {
+	b := img.Bounds()
+	sx := (b.Dx() + inspectSamples - 1) / inspectSamples
+	sy := (b.Dy() + inspectSamples - 1) / inspectSamples
+
+	t := sourceTraits{Alpha: "none", Gray: true}
+	colors := make(map[[4]uint32]bool)
+	for y := b.Min.Y; y < b.Max.Y; y += sy {
+		for x := b.Min.X; x < b.Max.X; x += sx {
+			r, g, bl, a := img.At(x, y).RGBA()
+			switch {
+			case a != 0xffff && a != 0:
+				t.Alpha = "partial"
+			case a == 0 && t.Alpha == "none":
+				t.Alpha = "binary"
+			}
+			if r != g || g != bl {
+				t.Gray = false
+			}
+			if len(colors) <= 256 {
+				colors[[4]uint32{r, g, bl, a}] = true
+			}
+		}
+	}
+	t.Colors = len(colors)
+	return t
+}
+
+func colorModelName(img image.Image) string {
+	switch img.(type) {
+	case *image.RGBA:
+		return "RGBA"
+	case *image.RGBA64:
+		return "RGBA64"
+	case *image.NRGBA:
+		return "NRGBA"
+	case *image.NRGBA64:
+		return "NRGBA64"
+	case *image.Gray:
+		return "Gray"
+	case *image.Gray16:
+		return "Gray16"
+	case *image.Paletted:
+		return "Paletted"
+	case *image.YCbCr:
+		return "YCbCr"
+	case *image.CMYK:
+		return "CMYK"
+	}
+	return fmt.Sprintf("%T", img)
+}
+
+// formatBytes formats n with a binary unit suffix, as accepted by byteSize.
+func formatBytes(n int64) string {
+	for _, u := range []struct {
+		suffix string
+		scale  int64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n >= u.scale {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(u.scale), u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
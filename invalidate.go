@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var flagExpireTiles string
+
+func init() {
+	flag.StringVar(&flagExpireTiles, "expire-tiles", "", "write the new or changed tiles to this file as z/x/y lines, the expiry list format of osm2pgsql and tile cache tools")
+}
+
+// ChangeList collects the relative paths of tiles whose contents differ
+// from what was previously on disk, for targeted CDN invalidations.
+type ChangeList struct {
+	mu    sync.Mutex
+	paths []string
+	tiles map[string]bool
+}
+
+func NewChangeList() *ChangeList {
+	return &ChangeList{tiles: make(map[string]bool)}
+}
+
+// Check compares data against the file currently stored at path and
+// records name and its tile coordinate if the tile is new or its contents
+// changed.
+func (c *ChangeList) Check(path, name string, zoom, x, y int, data []byte) {
+	old, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(old, data) {
+		return
+	}
+	c.mu.Lock()
+	c.paths = append(c.paths, filepath.ToSlash(name))
+	c.tiles[fmt.Sprintf("%d/%d/%d", zoom, x, y)] = true
+	c.mu.Unlock()
+}
+
+// Write stores the sorted list of changed paths, one per line.
+func (c *ChangeList) Write(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sort.Strings(c.paths)
+	return writeLines(path, c.paths)
+}
+
+// WriteExpired stores the sorted list of changed tile coordinates, one
+// z/x/y per line. Tiles changed at several -tile-size values are listed
+// once.
+func (c *ChangeList) WriteExpired(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tiles := make([]string, 0, len(c.tiles))
+	for t := range c.tiles {
+		tiles = append(tiles, t)
+	}
+	sort.Strings(tiles)
+	return writeLines(path, tiles)
+}
+
+func writeLines(path string, lines []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, l := range lines {
+		w.WriteString(l + "\n")
+	}
+	return w.Flush()
+}
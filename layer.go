@@ -0,0 +1,29 @@
+package main
+
+import "flag"
+
+// Layer describes the tileset for the metadata artifacts written with it.
+type Layer struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Attribution string `json:"attribution,omitempty"`
+	License     string `json:"license,omitempty"`
+}
+
+var layer Layer
+
+func init() {
+	flag.StringVar(&layer.Name, "name", "", "layer name written into tileset metadata")
+	flag.StringVar(&layer.Description, "description", "", "layer description written into tileset metadata")
+	flag.StringVar(&layer.Attribution, "attribution", "", "attribution written into tileset metadata, e.g. \"© Example Survey\"")
+	flag.StringVar(&layer.License, "license", "", "license written into tileset metadata, e.g. CC-BY-4.0")
+}
+
+// layerInfo returns the layer metadata given by flags, or nil if none was.
+func layerInfo() *Layer {
+	if layer == (Layer{}) {
+		return nil
+	}
+	l := layer
+	return &l
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var flagLens string
+
+func init() {
+	flag.StringVar(&flagLens, "lens", "", "correct Brown-Conrady lens distortion with coefficients k1,k2,p1,p2")
+}
+
+// lensParams holds radial (K1, K2) and tangential (P1, P2) distortion
+// coefficients. Coordinates are normalized so the image center is the
+// origin and half the longer side has length 1.
+type lensParams struct {
+	K1, K2, P1, P2 float64
+}
+
+func parseLens(s string) (lensParams, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return lensParams{}, fmt.Errorf("invalid lens parameters %q: want k1,k2,p1,p2", s)
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return lensParams{}, fmt.Errorf("invalid lens parameters %q: %v", s, err)
+		}
+		v[i] = f
+	}
+	return lensParams{v[0], v[1], v[2], v[3]}, nil
+}
+
+// undistort removes lens distortion from img. Each pixel of the corrected
+// image is looked up at the position the distortion model moves it to in
+// the captured image.
+func undistort(img image.Image, p lensParams) *image.RGBA {
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	cx, cy := w/2, h/2
+	f := math.Max(w, h) / 2
+
+	return warp(img, image.Rect(0, 0, b.Dx(), b.Dy()), func(x, y float64) (float64, float64) {
+		xn, yn := (x-cx)/f, (y-cy)/f
+		r2 := xn*xn + yn*yn
+		radial := 1 + p.K1*r2 + p.K2*r2*r2
+		xd := xn*radial + 2*p.P1*xn*yn + p.P2*(r2+2*xn*xn)
+		yd := yn*radial + p.P1*(r2+2*yn*yn) + 2*p.P2*xn*yn
+		return xd*f + cx, yd*f + cy
+	})
+}
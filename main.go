@@ -1,67 +1,267 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"image"
-	"image/draw"
-	"image/jpeg"
+	_ "image/gif"
+	_ "image/jpeg"
 	"image/png"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/nfnt/resize"
-	"golang.org/x/image/bmp"
+	"github.com/randomsean/tiler/tiler"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 var (
-	flagTileSize    int
+	flagTileSizes   = sizeList{256}
 	flagJpegQuality int
 	flagEncoding    string
 	flagPattern     string
-	flagInterpFunc  string
+	flagInterpFunc  = zoomFlag{def: "Bicubic", check: checkInterp}
 	flagOutDir      string
+	flagManifest    string
+	flagInvalidate  string
+	flagRegion      string
+	flagDiff        string
 )
 
 func init() {
-	flag.IntVar(&flagTileSize, "size", 256, "tile size in pixels")
+	flag.Var(&flagTileSizes, "size", "tile size in pixels, or a comma separated list of sizes")
 	flag.IntVar(&flagJpegQuality, "q", 5, "jpeg quality setting")
-	flag.StringVar(&flagEncoding, "e", "png", "image encoding (png or jpeg)")
-	flag.StringVar(&flagPattern, "p", "{zoom}_{x}_{y}.png", "naming pattern for output files")
-	flag.StringVar(&flagInterpFunc, "interp", "Bicubic", "cropping interpolation function")
+	flag.StringVar(&flagEncoding, "e", "png", "image encoding (png, jpeg, webp or avif)")
+	flag.StringVar(&flagPattern, "p", tiler.DefaultPattern, "naming pattern for output files")
+	flag.Var(&flagInterpFunc, "interp", "interpolation function used to scale levels, optionally per zoom, e.g. Bicubic,0-4=Lanczos3,12-14=NearestNeighbor")
 	flag.StringVar(&flagOutDir, "o", "tiles", "output directory for tile files")
+	flag.StringVar(&flagManifest, "manifest", "", "write a tile ETag manifest with this name into the output directory")
+	flag.StringVar(&flagInvalidate, "invalidate", "", "write the paths of new or changed tiles to this file")
+	flag.StringVar(&flagRegion, "region", "", "only regenerate tiles touching this source rect (x0,y0,x1,y1)")
+	flag.StringVar(&flagDiff, "diff", "", "only regenerate tiles that changed relative to this previous source snapshot")
 }
 
-var validEncodings = []string{"png", "jpeg"}
+var (
+	manifest *Manifest
+	changes  *ChangeList
+
+	// dirty limits regeneration to tiles touching this source rectangle.
+	// The zero value means the whole image.
+	dirty image.Rectangle
+)
+
+var validEncodings = []string{"png", "jpeg", "webp", "avif"}
+
+// commands maps subcommand names to their entry points. Subcommands share
+// the global flags, which are parsed from the arguments after the name.
+// It is filled in by init, as the daemon checks job arguments against it.
+var commands map[string]func(args []string)
 
-var interpFuncs = map[string]resize.InterpolationFunction{
-	"NearestNeighbor":   resize.NearestNeighbor,
-	"Bilinear":          resize.Bilinear,
-	"Bicubic":           resize.Bicubic,
-	"MitchellNetravali": resize.MitchellNetravali,
-	"Lanczos2":          resize.Lanczos2,
-	"Lanczos3":          resize.Lanczos3,
+func init() {
+	commands = map[string]func(args []string){
+		"batch":    runBatch,
+		"compare":  runCompare,
+		"contact":  runContact,
+		"daemon":   runDaemon,
+		"inspect":  runInspect,
+		"job":      runJob,
+		"push":     runPush,
+		"rename":   runRename,
+		"retry":    runRetry,
+		"rollback": runRollback,
+		"serve":    runServe,
+		"verify":   runVerify,
+	}
 }
 
+// serveJS, when set by a browser build, replaces the command line
+// interface with a JavaScript API.
+var serveJS func()
+
 func main() {
+	if serveJS != nil {
+		serveJS()
+		return
+	}
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			flag.CommandLine.Parse(os.Args[2:])
+			cmd(flag.Args())
+			return
+		}
+	}
+
 	flag.Parse()
 
-	if flagTileSize <= 0 {
-		log.Fatalln("tile size must be a positive integer")
+	checkFlags()
+
+	if flagCheckStale {
+		checkStale()
 	}
 
-	interpFunc, ok := interpFuncs[flagInterpFunc]
-	if !ok {
-		fmt.Fprint(os.Stderr, "Valid interpolation function parameters:")
-		for fn := range interpFuncs {
-			fmt.Fprint(os.Stderr, " "+fn)
+	args := flag.Args()
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: tiler [1-n] [filename]")
+		return
+	}
+
+	if err := ensureDir(flagOutDir); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// The run starts before the source is decoded, which is often its
+	// longest phase.
+	current.started = time.Now()
+
+	if flagAnimate {
+		a, err := loadAnimation(args[1])
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		startRun(args[1])
+		if manifest != nil {
+			manifest.AddSource(args[1], a.Frames[0])
+		}
+		tileAnimation(a, parseLevel(args[0]), "")
+		finishRun(nil)
+		return
+	}
+
+	if info, err := os.Stat(args[1]); err == nil && info.IsDir() {
+		t, err := openTiledInput(args[1])
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		level := parseLevel(args[0])
+		startRun(args[1])
+		tileTiledInput(t, level)
+		finishRun(nil)
+		return
+	}
+
+	georeference(args[1])
+	if flagStream > 0 {
+		checkStreamFlags()
+		s, err := openStream(args[1])
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if s != nil {
+			level := parseLevel(args[0])
+			startRun(args[1])
+			s.tileLevels(level, "")
+			if manifest != nil {
+				manifest.AddSource(args[1], s.overview)
+			}
+			finishRun(nil)
+			return
+		}
+		log.Printf("%s is not a striped TIFF, decoding it whole", args[1])
+	}
+
+	img, err := loadSource(args[1])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if flagRegion != "" {
+		dirty, err = parseRect(flagRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if flagDiff != "" {
+		prev, err := loadSource(flagDiff)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r, err := diffRect(prev, img)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if r.Empty() {
+			log.Println("source unchanged since previous snapshot")
+			return
+		}
+		dirty = dirty.Union(r)
+	}
+
+	// Deep Zoom and IIIF pyramids always reach the full image size, so
+	// the level argument does not apply to them.
+	if flagDZI != "" {
+		startRun(args[1])
+		if manifest != nil {
+			manifest.AddSource(args[1], img)
+		}
+		tileDZI(img)
+		finishRun(nil)
+		return
+	}
+	if flagIIIF != "" {
+		startRun(args[1])
+		if manifest != nil {
+			manifest.AddSource(args[1], img)
+		}
+		tileIIIF(img)
+		finishRun(nil)
+		return
+	}
+
+	level := parseLevel(args[0])
+
+	startRun(args[1])
+	if manifest != nil {
+		manifest.AddSource(args[1], img)
+	}
+	noteInput(args[1], level)
+	tileLevels(img, level, "")
+	finishRun(nil)
+}
+
+// checkFlags validates the flags shared by every tiling command.
+func checkFlags() {
+	for _, size := range flagTileSizes {
+		if size <= 0 {
+			log.Fatalln("tile size must be a positive integer")
 		}
 	}
+	if flagJobs < 1 {
+		log.Fatalln("-j must be at least 1")
+	}
+	if (flagMinZoom != 0 || flagMaxZoom >= 0) && (flagDZI != "" || flagIIIF != "") {
+		log.Fatalln("-min-zoom and -max-zoom cannot be combined with -dzi or -iiif, which number their own levels")
+	}
+	if flagUpload != "" && (flagZip != "" || flagZipShards != "" || flagTMSOut != "") {
+		log.Fatalln("-upload cannot be combined with -zip, -zip-shards or -tms-out")
+	}
+	if flagZipShards != "" && (flagZip != "" || flagDZI != "" || flagIIIF != "") {
+		log.Fatalln("-zip-shards cannot be combined with -zip, -dzi or -iiif")
+	}
+	if flagTileJSON != "" && (flagDZI != "" || flagIIIF != "") {
+		log.Fatalln("-tilejson describes square levels, so it cannot be combined with -dzi or -iiif")
+	}
+	if flagVersioned && (flagAppend || flagRegion != "" || flagDiff != "") {
+		log.Fatalln("-versioned writes every tile of each version, so it cannot be combined with -append, -region or -diff")
+	}
 
 	found := false
 	for _, enc := range validEncodings {
@@ -73,126 +273,648 @@ func main() {
 	if !found {
 		log.Fatalln("unsupported encoding:", validEncodings)
 	}
+	if flagEncoding == "webp" {
+		if flagWebPMode != "lossless" && flagWebPMode != "lossy" {
+			log.Fatalln("-webp must be lossless or lossy")
+		}
+		if flagWebPQuality < 1 || flagWebPQuality > 100 {
+			log.Fatalln("-webp-quality must be between 1 and 100")
+		}
+	}
+	if flagEncoding == "avif" {
+		if err := checkAVIF(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := checkProgress(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkPattern(patternGiven()); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkDownsample(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkScaleCmd(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseBounds(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadWatermark(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseEdge(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkOrigin(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkScheme(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	args := flag.Args()
-	if len(args) != 2 {
-		fmt.Fprintln(os.Stderr, "usage: tiler [1-n] [filename]")
-		return
+// checkInterp validates an -interp function name.
+func checkInterp(name string) error {
+	if _, ok := tiler.Interpolations[name]; ok {
+		return nil
+	}
+	var valid []string
+	for fn := range tiler.Interpolations {
+		valid = append(valid, fn)
 	}
+	sort.Strings(valid)
+	return fmt.Errorf("unknown interpolation function %q, valid are %s", name, strings.Join(valid, ", "))
+}
 
-	_, err := os.Stat(flagOutDir)
+// interpFor returns the -interp function for zoom.
+func interpFor(zoom int) resize.InterpolationFunction {
+	return tiler.Interpolations[flagInterpFunc.For(zoom)]
+}
+
+func parseLevel(s string) int {
+	level, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if level < 1 {
+		log.Fatalln("level must be at least 1")
+	}
+	return int(level)
+}
+
+func ensureDir(dir string) error {
+	_, err := os.Stat(dir)
 	if os.IsNotExist(err) {
-		if err := os.MkdirAll(flagOutDir, 0755); err != nil {
-			fmt.Println(err)
-			return
-		}
-	} else if err != nil {
-		fmt.Println(err)
-		return
+		return os.MkdirAll(dir, 0755)
 	}
+	return err
+}
 
-	f, err := os.Open(args[1])
-	if err != nil {
-		log.Println(err)
-		return
+// startRun sets up the per-run records requested by flags for a run
+// tiling inputs, timed from when main began loading them if it did.
+func startRun(inputs ...string) {
+	current.inputs = inputs
+	if current.started.IsZero() {
+		current.started = time.Now()
 	}
-	defer f.Close()
 
-	var img image.Image
+	if flagVersioned {
+		if err := startVersion(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	ext := filepath.Ext(f.Name())
+	startTrace(inputs)
+	startJobTimer()
+	followShare()
+	startProgress()
+	startStatus()
 
-	switch ext {
-	case ".png":
-		img, err = png.Decode(f)
-		break
-	case ".bmp":
-		img, err = bmp.Decode(f)
-		break
-	default:
-		log.Fatal("unsupported file format")
+	if flagEncrypt {
+		var err error
+		if tileCipher, err = loadTileKey(); err != nil {
+			log.Fatal(err)
+		}
 	}
-	if err != nil {
-		log.Println(err)
-		return
+	if flagZip != "" {
+		var err error
+		if zipOut, err = openZip(flagZip); err != nil {
+			log.Fatal(err)
+		}
+		output = zipOut
+	}
+	if flagZipShards != "" {
+		var err error
+		if shardOut, err = openShards(flagZipShards); err != nil {
+			log.Fatal(err)
+		}
+		output = shardOut
+	}
+	if flagUpload != "" {
+		var err error
+		if remoteOut, err = openRemote(flagUpload); err != nil {
+			log.Fatal(err)
+		}
+		output = remoteOut
 	}
 
-	level, err := strconv.ParseInt(args[0], 10, 64)
+	if flagManifest != "" {
+		manifest = NewManifest()
+		if flagAppend {
+			if err := manifest.Merge(filepath.Join(flagOutDir, flagManifest)); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if flagSignKey != "" {
+		if manifest == nil {
+			log.Fatalln("-sign-key needs -manifest")
+		}
+		var err error
+		if signer, err = loadSignKey(flagSignKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if flagInvalidate != "" || flagExpireTiles != "" {
+		changes = NewChangeList()
+	}
+	if flagMissingTile != "" {
+		if err := writeMissingTiles(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if flagUTFGrid != "" {
+		var err error
+		if gridMask, err = loadIDMask(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// finishRun writes out the per-run records set up by startRun and reports
+// the outcome of the run, which failed if err is not nil or any tile
+// failed.
+func finishRun(err error) {
+	stopProgress()
+	if zipOut != nil {
+		if err := zipOut.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if shardOut != nil {
+		if err := shardOut.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if remoteOut != nil {
+		remoteOut.Close()
+	}
+	if manifest != nil {
+		path := filepath.Join(flagOutDir, flagManifest)
+		if err := manifest.Write(path); err != nil {
+			log.Fatal(err)
+		}
+		if signer != nil {
+			if err := signManifest(path, signer); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if changes != nil {
+		if flagInvalidate != "" {
+			if err := changes.Write(flagInvalidate); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if flagExpireTiles != "" {
+			if err := changes.WriteExpired(flagExpireTiles); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if flagTimings != "" {
+		if err := timings.Write(flagTimings); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if flagSummary {
+		stats.Print(os.Stderr)
+	}
+	reportSkipped()
+	if err := writeQuarantine(); err != nil {
+		log.Fatal(err)
+	}
+	if tileErr := reportFailures(); err == nil {
+		err = tileErr
+	}
 	if err != nil {
+		abortRun(err)
+	}
+	if flagVersioned {
+		if err := publishVersion(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	endTrace(nil)
+	summary := summarize(nil)
+	writeAudit(summary)
+	notify(summary)
+	cleanScratch()
+}
+
+// tileLevels generates every level from 0 to level for img. Tile names are
+// prefixed with dir relative to the output directory.
+func tileLevels(img image.Image, level int, dir string) {
+	if flagAppend {
+		planAppend(level, dir)
+	}
+	prepareLevels(img.Bounds(), level, dir)
+
+	top := level
+	if flagMaxZoom >= 0 && flagMaxZoom < top {
+		top = flagMaxZoom
+	}
+	t := &tiler.Tiler{
+		Output:  output,
+		MinZoom: flagMinZoom,
+		Source: func(zoom int, deeper image.Image) image.Image {
+			if keptLevels[zoom] {
+				return nil
+			}
+			src := img
+			switch {
+			case deeper != nil:
+				src = deeper
+			case flagAppend:
+				src = appendSource(img, zoom, level, dir)
+			}
+			w, h := levelSize(img.Bounds(), zoom, flagTileSizes[0])
+			if ov := pickOverview(img, w, h, src.Bounds()); ov != nil {
+				src = ov
+			}
+			return src
+		},
+		Level: func(src image.Image, zoom int) (*tiler.Level, error) {
+			return splitLevel(src, img.Bounds(), flagTileSizes, zoom, dir), nil
+		},
+	}
+	if err := t.Tile(img, top); err != nil {
 		log.Fatal(err)
 	}
 
-	if level == 0 {
-		log.Fatalln("level must be at least 1")
+	if flagFillBBox != "" {
+		fillPlaceholders(level, dir)
 	}
+}
 
-	var wg sync.WaitGroup
+// prepareLevels creates the output directories for levels 0 to level of
+// a source with bounds src and announces how many tiles they will hold.
+func prepareLevels(src image.Rectangle, level int, dir string) {
+	tileSource = src
+	if err := setOffset(level); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkZoomRange(level); err != nil {
+		log.Fatal(err)
+	}
 
-	for i := level; i >= 0; i-- {
-		wg.Add(1)
-		go SplitTiles(img, flagTileSize, int(i), interpFunc, &wg)
+	for _, size := range flagTileSizes {
+		if err := output.Mkdir(sizeDir(dir, size)); err != nil {
+			log.Fatal(err)
+		}
+		if flagTMSOut != "" {
+			if err := ensureDir(filepath.Join(flagTMSOut, sizeDir(dir, size))); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
-	wg.Wait()
+	for i := 0; i <= level; i++ {
+		if keptLevels[i] || !zoomWanted(i) {
+			continue
+		}
+		for _, size := range flagTileSizes {
+			t := levelTiles(src, i, size)
+			budget.Expect(t.Dx() * t.Dy())
+			progress.Expect(i, t.Dx()*t.Dy())
+		}
+	}
+	if manifest != nil {
+		manifest.AddTTLs(level)
+	}
+	if geoBounds != nil {
+		writeBounds(src, level, dir)
+	}
+	if flagTileJSON != "" {
+		writeTileJSON(level, dir)
+	}
 }
 
-func SplitTiles(img image.Image, tileSize, level int, interp resize.InterpolationFunction, wg *sync.WaitGroup) {
-	defer wg.Done()
+func decodeFile(path string) (image.Image, error) {
+	if isRemote(path) {
+		local, err := fetchSource(path)
+		if err != nil {
+			return nil, err
+		}
+		path = local
+	}
 
-	side := 1 << uint(level)
-	width := uint(side) * uint(tileSize)
-	height := width
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	resized := resize.Resize(width, height, img, interp)
+	if filepath.Ext(f.Name()) == ".montage" {
+		return decodeMontage(path)
+	}
 
-	var lwg sync.WaitGroup
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	img, ok, err := decodeStrips(f, fi.Size())
+	if !ok {
+		// Formats are recognised by content, so any format registered
+		// with the image package can be tiled whatever the file is named.
+		var format string
+		img, format, err = image.Decode(f)
+		if err == image.ErrFormat {
+			return nil, errors.New("unsupported file format")
+		}
+		ok = format == "tiff"
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		noteOverviews(img, path, f, fi.Size())
+	}
+	return img, nil
+}
+
+// newLevel returns img, a level scaled at the largest tile size, for the
+// next level up the pyramid to be scaled from. release, if not nil, frees
+// it once nothing more is.
+func newLevel(img image.Image, release func()) *tiler.Level {
+	return &tiler.Level{Image: img, Release: func() {
+		forgetCached(img)
+		if release != nil {
+			release()
+		}
+	}}
+}
+
+// splitLevel writes the tiles of one level at every size in tileSizes,
+// which must be sorted largest first, from img, the source with bounds
+// src or a deeper level of it. Only the largest size is resized from img;
+// smaller sizes are scaled down from the previous size. The largest size
+// is returned for tiler.Tiler to scale the next level from, unless only
+// part of it was rendered.
+func splitLevel(img image.Image, src image.Rectangle, tileSizes []int, level int, dir string) *tiler.Level {
+	interp := interpFor(level)
+
+	ctx, span := tracer.Start(jobCtx, "level", trace.WithAttributes(
+		attribute.Int("tiler.zoom", level),
+		attribute.String("tiler.dir", dir),
+	))
+	defer span.End()
+
+	if !dirty.Empty() && renderRegion(ctx, img, src, tileSizes, level, dir) {
+		return nil
+	}
+
+	var largest *tiler.Level
+	var resized image.Image
+	for i, tileSize := range tileSizes {
+		w, h := levelSize(src, level, tileSize)
+		width, height := uint(w), uint(h)
+
+		tiles := levelTiles(src, level, tileSize)
+		if tiles.Empty() {
+			continue
+		}
+
+		sdir := sizeDir(dir, tileSize)
+
+		if flagSuperRes != "" && overzoomed(src, int(width), int(height)) {
+			cropLevel(ctx, tiles, tileSize, level, sdir, func(ctx context.Context, x, y int) error {
+				dst, err := superResTile(ctx, img, tileSize, level, x, y)
+				if err != nil {
+					return err
+				}
+				return saveTile(ctx, dst, tileSize, x, y, level, sdir)
+			})
+			continue
+		}
 
-	for y := 0; y < side; y++ {
-		lwg.Add(1)
-		go func(row int) {
-			defer lwg.Done()
-			for x := 0; x < side; x++ {
-				Crop(resized, tileSize, x, row, level)
+		start := time.Now()
+		from := img
+		if resized != nil {
+			from = resized
+		}
+		var release func()
+		method := flagInterpFunc.For(level)
+		scale := func() image.Image { return resize.Resize(width, height, from, interp) }
+		down := downsampleKernel()
+		if from == img && img.Bounds() == src {
+			down = nil
+		}
+		external := false
+		switch {
+		case down != nil:
+			method = "downsample-" + flagDownsample
+			scale = func() image.Image { return downsample(from, w, h, down) }
+		case flagScaleCmd != "":
+			method, external = "cmd-"+flagScaleCmd, true
+			scale = func() image.Image {
+				scaled, err := scaleByCmd(from, w, h)
+				if err != nil {
+					abortRun(err)
+				}
+				return scaled
+			}
+		}
+		resized = cachedResize(width, height, from, method, func() image.Image {
+			if flagSpill && !external {
+				var spilled image.Image
+				spilled, release = spillResize(from, w, h, tileSize, interp, down)
+				return spilled
 			}
-		}(y)
+			return scale()
+		})
+		timings.Since(stageScale, level, start)
+
+		cropLevel(ctx, tiles, tileSize, level, sdir, func(ctx context.Context, x, y int) error {
+			return saveCrop(ctx, resized, tileSize, x, y, level, sdir)
+		})
+
+		l := newLevel(resized, release)
+		if i == 0 {
+			largest = l
+		} else {
+			defer l.Release()
+		}
+	}
+	return largest
+}
+
+// levelTiles returns the range of tile indices to generate at a level of
+// a source with bounds src.
+func levelTiles(src image.Rectangle, level, tileSize int) image.Rectangle {
+	width, height := levelSize(src, level, tileSize)
+	if dirty.Empty() {
+		return image.Rect(0, 0, (width+tileSize-1)/tileSize, (height+tileSize-1)/tileSize)
+	}
+	return tileRange(dirty, src, width, height, tileSize)
+}
+
+// cropLevel calls tile for every tile index within tiles on the worker
+// pool, with a context cancelled once the tile exceeds -tile-timeout. It
+// returns once every tile has.
+func cropLevel(ctx context.Context, tiles image.Rectangle, tileSize, level int, dir string, tile func(ctx context.Context, x, y int) error) {
+	var lwg sync.WaitGroup
+
+	for y := tiles.Min.Y; y < tiles.Max.Y; y++ {
+		for x := tiles.Min.X; x < tiles.Max.X; x++ {
+			x, y := x, y
+			lwg.Add(1)
+			workers.Go(func() {
+				defer lwg.Done()
+				name := tileName(dir, level, x, y, tileSize)
+				tctx, span := tracer.Start(ctx, "tile", trace.WithAttributes(
+					attribute.String("tiler.tile", name),
+				))
+				err := withTimeout(tctx, flagTileTimeout, func(ctx context.Context) error {
+					return tile(ctx, x, y)
+				})
+				endSpan(span, err)
+				if err != nil {
+					log.Printf("%s: %v", name, err)
+					failures.AddTile(name, err, level, x, y, tileSize, dir)
+				}
+			})
+		}
 	}
 
 	lwg.Wait()
 }
 
-func Crop(img image.Image, tileSize, x, y, level int) {
-	area := image.Rect(x*tileSize, y*tileSize, tileSize+x*tileSize, tileSize+y*tileSize)
+// saveCrop saves tile x, y of the resized level img.
+func saveCrop(ctx context.Context, img image.Image, tileSize, x, y, level int, dir string) error {
+	start := time.Now()
+	dst := getTile(tileSize)
+	defer putTile(dst)
+	cropTile(dst, img, x, y)
+	timings.Since(stageCrop, level, start)
+	return saveTile(ctx, dst, tileSize, x, y, level, dir)
+}
+
+// saveTile encodes and writes the rendered tile dst, and records it.
+func saveTile(ctx context.Context, dst *image.RGBA, tileSize, x, y, level int, dir string) error {
+	buf := getBuffer()
+	defer tileBuffers.Put(buf)
+	var err error
 
-	tile := image.Rect(0, 0, tileSize, tileSize)
+	if flagBase != "" {
+		if dst, err = compositeBase(dst, tileName(dir, level, x, y, tileSize)); err != nil {
+			return err
+		}
+	}
+	if flagSkipEmpty {
+		if kind, ok := emptyTile(dst); ok {
+			return skipTile(kind, tileSize, x, y, level, dir)
+		}
+	}
+	if watermark != nil {
+		dst = stampWatermark(dst)
+	}
 
-	dst := image.NewRGBA(tile)
+	start := time.Now()
+	shared := ""
+	if flagUniform {
+		if c, ok := uniformColor(dst); ok {
+			shared = uniformKey(c, tileSize)
+			err = encodeUniform(buf, c, tileSize, flagEncoding, budget.Quality())
+		}
+	}
+	if shared == "" {
+		tile := image.Image(dst)
+		if flagEncoding == "png" {
+			tile = pngColor(dst, flagPNGColor.For(level))
+		}
+		err = encodeLimited(buf, tile, flagEncoding, budget.Quality())
+	}
+	timings.Since(stageEncode, level, start)
+	if err != nil {
+		return err
+	}
+	return storeTile(ctx, buf.Bytes(), shared, tileSize, x, y, level, dir)
+}
+
+// storeTile writes the encoded tile data and records it, unless ctx is
+// done. Tiles with a shared key are hardlinked to one copy when writing to
+// a directory.
+func storeTile(ctx context.Context, data []byte, shared string, tileSize, x, y, level int, dir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	name := tileName(dir, level, x, y, tileSize)
+	path := filepath.Join(flagOutDir, name)
 
-	draw.Draw(dst, tile.Bounds(), img, area.Bounds().Min, draw.Src)
+	if tileCipher != nil {
+		// Every tile encrypts differently, so there is nothing to share.
+		data, shared = tileCipher.Seal(name, data), ""
+	}
+	if changes != nil {
+		gz, gx, gy := placeTile(level, x, y, tileSize)
+		changes.Check(path, name, gz, gx, gy, data)
+	}
 
-	path := filepath.Join(flagOutDir, fileName(flagPattern, level, x, y))
-	f, err := os.Create(path)
+	start := time.Now()
+	err := retry(func() error {
+		if _, ok := output.(dirWriter); ok && shared != "" {
+			return uniforms.Link(path, shared, data)
+		}
+		return output.WriteTile(name, data)
+	})
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
-	defer f.Close()
 
-	switch flagEncoding {
+	if flagTMSOut != "" {
+		if err := linkTMS(path, dir, level, x, y, tileSize, data); err != nil {
+			return err
+		}
+	}
+	if gridMask != nil {
+		if err := writeGrid(name, tileSize, x, y, level); err != nil {
+			return err
+		}
+	}
+	if flagWorldFiles && geoBounds != nil {
+		if err := writeWorldFile(name, tileSize, x, y, level); err != nil {
+			return err
+		}
+	}
+	timings.Since(stageWrite, level, start)
+
+	if manifest != nil {
+		manifest.Add(name, data)
+	}
+	stats.Add(level, len(data))
+	budget.Record(len(data))
+	progress.Done(name, level)
+	return nil
+}
+
+func encodeTile(w io.Writer, img image.Image, encoding string, quality int) error {
+	switch encoding {
 	case "png":
-		err = png.Encode(f, dst)
-	case "jpeg":
-		err = jpeg.Encode(f, dst, &jpeg.Options{Quality: flagJpegQuality})
-	default:
-		err = errors.New("encoding not supported")
+		return encodePNG(w, img, png.DefaultCompression)
+	case "webp":
+		return encodeWebP(w, img, flagWebPMode, quality)
+	case "avif":
+		return encodeAVIF(w, img)
 	}
-	if err != nil {
-		log.Println(err)
+	return tiler.Encode(w, img, encoding, quality)
+}
+
+// encodingQuality returns the quality tiles of encoding are encoded at
+// unless the -max-total-size budget lowers it: -webp-quality for WebP and
+// -q otherwise.
+func encodingQuality(encoding string) int {
+	if encoding == "webp" {
+		return flagWebPQuality
 	}
+	return flagJpegQuality
 }
 
-func fileName(p string, zoom, x, y int) string {
-	p = strings.Replace(p, "{zoom}", strconv.Itoa(zoom), -1)
-	p = strings.Replace(p, "{x}", strconv.Itoa(x), -1)
-	p = strings.Replace(p, "{y}", strconv.Itoa(y), -1)
-	return p
+// tileName returns the path of a tile relative to the output directory.
+func tileName(dir string, zoom, x, y, size int) string {
+	zoom, x, y = placeTile(zoom, x, y, size)
+	return filepath.Join(dir, tiler.FileName(flagPattern, zoom, x, y, size))
 }
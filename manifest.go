@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Manifest maps every tile written during a run to a strong ETag derived
+// from its encoded contents, so origins can answer conditional requests
+// without hashing tiles themselves.
+type Manifest struct {
+	mu         sync.Mutex
+	Layer      *Layer                     `json:"layer,omitempty"`
+	Encryption *ManifestEncryption        `json:"encryption,omitempty"`
+	Sources    map[string]*ManifestSource `json:"sources,omitempty"`
+	Missing    map[string]string          `json:"missing_tiles,omitempty"`
+	Empty      map[string]string          `json:"empty_tiles,omitempty"`
+	TTL        map[int]int64              `json:"cache_ttl_seconds,omitempty"`
+	Tiles      map[string]string          `json:"tiles"`
+}
+
+// ManifestSource describes one source image tiled during the run.
+type ManifestSource struct {
+	Fingerprint
+	Palette
+}
+
+func NewManifest() *Manifest {
+	m := &Manifest{
+		Layer:   layerInfo(),
+		Sources: make(map[string]*ManifestSource),
+		Missing: make(map[string]string),
+		Empty:   make(map[string]string),
+		TTL:     make(map[int]int64),
+		Tiles:   make(map[string]string),
+	}
+	if tileCipher != nil {
+		m.Encryption = tileCipher.Manifest()
+	}
+	return m
+}
+
+// AddSource records metadata about the source image read from path.
+func (m *Manifest) AddSource(path string, img image.Image) {
+	fp, err := fingerprint(path)
+	if err != nil {
+		log.Printf("%s: %v", path, err)
+	}
+	src := &ManifestSource{
+		Fingerprint: fp,
+		Palette:     extractPalette(img),
+	}
+	m.mu.Lock()
+	m.Sources[path] = src
+	m.mu.Unlock()
+}
+
+// AddTTLs records the -cache-ttl of every zoom from 0 to level, so
+// servers and uploads can set Cache-Control per zoom.
+func (m *Manifest) AddTTLs(level int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for z := 0; z <= level; z++ {
+		if ttl := cacheTTL(z); ttl > 0 {
+			m.TTL[z] = int64(ttl / time.Second)
+		}
+	}
+}
+
+// Add records the ETag for the tile stored at the relative path name.
+func (m *Manifest) Add(name string, data []byte) {
+	etag := ETag(data)
+	m.mu.Lock()
+	m.Tiles[filepath.ToSlash(name)] = etag
+	delete(m.Empty, filepath.ToSlash(name))
+	m.mu.Unlock()
+}
+
+// AddEmpty records that the tile at name was left out by -skip-empty for
+// showing only kind, transparent or background.
+func (m *Manifest) AddEmpty(name, kind string) {
+	m.mu.Lock()
+	m.Empty[filepath.ToSlash(name)] = kind
+	delete(m.Tiles, filepath.ToSlash(name))
+	m.mu.Unlock()
+}
+
+// AddMissing records the ETag of the fallback tile stored at name, which
+// servers return for requests outside the tileset's coverage.
+func (m *Manifest) AddMissing(name string, data []byte) {
+	etag := ETag(data)
+	m.mu.Lock()
+	m.Missing[filepath.ToSlash(name)] = etag
+	m.mu.Unlock()
+}
+
+// Write stores the manifest as indented JSON at path.
+func (m *Manifest) Write(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// ETag returns a quoted strong entity tag for data.
+func ETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
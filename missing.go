@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+)
+
+var flagMissingTile string
+
+func init() {
+	flag.StringVar(&flagMissingTile, "missing-tile", "", "write a fallback tile for out-of-coverage requests: checkerboard, transparent or a hex color")
+}
+
+// missingChecker is the edge length of the fallback checkerboard squares.
+const missingChecker = 16
+
+var (
+	missingLight = color.RGBA{0xcc, 0xcc, 0xcc, 0xff}
+	missingDark  = color.RGBA{0x99, 0x99, 0x99, 0xff}
+)
+
+// missingTileImage renders the fallback tile described by spec.
+func missingTileImage(spec string, tileSize int) (image.Image, error) {
+	rect := image.Rect(0, 0, tileSize, tileSize)
+
+	if spec == "checkerboard" {
+		img := image.NewRGBA(rect)
+		for y := 0; y < tileSize; y += missingChecker {
+			for x := 0; x < tileSize; x += missingChecker {
+				c := missingLight
+				if (x/missingChecker+y/missingChecker)%2 == 1 {
+					c = missingDark
+				}
+				square := image.Rect(x, y, x+missingChecker, y+missingChecker)
+				draw.Draw(img, square, image.NewUniform(c), image.Point{}, draw.Src)
+			}
+		}
+		return img, nil
+	}
+
+	c, err := parseColor(spec)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(rect)
+	draw.Draw(img, rect, image.NewUniform(c), image.Point{}, draw.Src)
+	return img, nil
+}
+
+// writeMissingTiles writes the fallback tile for every tile size and
+// records it in the manifest.
+func writeMissingTiles() error {
+	for _, size := range flagTileSizes {
+		img, err := missingTileImage(flagMissingTile, size)
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := encodeTile(&buf, img, flagEncoding, encodingQuality(flagEncoding)); err != nil {
+			return err
+		}
+
+		dir := sizeDir("", size)
+		if err := output.Mkdir(dir); err != nil {
+			return err
+		}
+
+		name := filepath.Join(dir, "missing."+flagEncoding)
+		data := sealTile(name, buf.Bytes())
+		if err := output.WriteTile(name, data); err != nil {
+			return err
+		}
+		if manifest != nil {
+			manifest.AddMissing(name, data)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// montageTile is one input of a montage layout placed at a pixel offset.
+type montageTile struct {
+	Path   string
+	Offset image.Point
+}
+
+// readMontage parses a montage layout file. Each non-empty line that does
+// not start with # names an image and its x and y offset on the canvas:
+//
+//	sheet-a.png 0 0
+//	sheet-b.png 4096 0
+//
+// Relative paths are resolved against the directory of the layout file.
+func readMontage(path string) ([]montageTile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tiles []montageTile
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want \"image x y\"", path, n)
+		}
+		x, errX := strconv.Atoi(fields[1])
+		y, errY := strconv.Atoi(fields[2])
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("%s:%d: invalid offset", path, n)
+		}
+
+		p := fields[0]
+		if !filepath.IsAbs(p) && !isRemote(p) {
+			p = filepath.Join(filepath.Dir(path), p)
+		}
+		tiles = append(tiles, montageTile{Path: p, Offset: image.Pt(x, y)})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(tiles) == 0 {
+		return nil, fmt.Errorf("%s: empty montage", path)
+	}
+	return tiles, nil
+}
+
+// decodeMontage composites every image of the layout at path onto one
+// canvas just large enough to hold them all. Later entries are drawn over
+// earlier ones.
+func decodeMontage(path string) (image.Image, error) {
+	tiles, err := readMontage(path)
+	if err != nil {
+		return nil, err
+	}
+
+	imgs := make([]image.Image, len(tiles))
+	for i, t := range tiles {
+		img, err := decodeFile(t.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", t.Path, err)
+		}
+		imgs[i] = img
+	}
+
+	if flagRegisterWindow > 0 {
+		registerMontage(tiles, imgs, flagRegisterWindow)
+	}
+
+	var bounds image.Rectangle
+	for i, img := range imgs {
+		b := img.Bounds()
+		bounds = bounds.Union(b.Sub(b.Min).Add(tiles[i].Offset))
+	}
+
+	canvas := image.NewRGBA(bounds.Sub(bounds.Min))
+	for i, img := range imgs {
+		b := img.Bounds()
+		r := b.Sub(b.Min).Add(tiles[i].Offset).Sub(bounds.Min)
+		draw.Draw(canvas, r, img, b.Min, draw.Over)
+	}
+	return canvas, nil
+}
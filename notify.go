@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	flagWebhook         string
+	flagWebhookTemplate string
+	flagWebhookType     string
+	flagOnComplete      string
+	flagOnError         string
+)
+
+func init() {
+	flag.StringVar(&flagWebhook, "webhook", "", "URL to POST the job summary to when the run completes or fails")
+	flag.StringVar(&flagWebhookTemplate, "webhook-template", "", "text/template file rendering the webhook payload from the job summary (default JSON)")
+	flag.StringVar(&flagWebhookType, "webhook-type", "", "Content-Type of the -webhook-template payload (default application/json if it renders JSON, else sniffed)")
+	flag.StringVar(&flagOnComplete, "on-complete", "", "shell command run when the run completes, with the summary in TILER_* environment variables")
+	flag.StringVar(&flagOnError, "on-error", "", "shell command run when the run fails, with the summary in TILER_* environment variables")
+}
+
+// runSummary describes the outcome of a run for notifications.
+type runSummary struct {
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Inputs   []string  `json:"inputs"`
+	Output   string    `json:"output"`
+	Tiles    int       `json:"tiles"`
+	Bytes    int64     `json:"bytes"`
+	Failed   int       `json:"failed"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+// current tracks the run being performed, for its summary.
+var current struct {
+	inputs  []string
+	started time.Time
+}
+
+// summarize reports the run so far, as failed if err is not nil.
+func summarize(err error) runSummary {
+	tiles, bytes := stats.Totals()
+	s := runSummary{
+		Status:   "completed",
+		Inputs:   current.inputs,
+		Output:   flagOutDir,
+		Tiles:    tiles,
+		Bytes:    bytes,
+		Failed:   failures.Len(),
+		Started:  current.started,
+		Duration: time.Since(current.started).Seconds(),
+	}
+	if err != nil {
+		s.Status = "failed"
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// notify delivers the run summary to the configured hook command and
+// webhook. Delivery problems are logged but never change the outcome of
+// the run.
+func notify(s runSummary) {
+	hook := flagOnComplete
+	if s.Status != "completed" {
+		hook = flagOnError
+	}
+	if hook != "" {
+		runHook(hook, s)
+	}
+	if flagWebhook != "" {
+		postWebhook(s)
+	}
+}
+
+// runHook runs command through the shell with the summary exported as
+// TILER_* environment variables.
+func runHook(command string, s runSummary) {
+	cmd := shellCommand(command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"TILER_STATUS="+s.Status,
+		"TILER_ERROR="+s.Error,
+		"TILER_INPUTS="+strings.Join(s.Inputs, string(os.PathListSeparator)),
+		"TILER_OUTPUT="+s.Output,
+		"TILER_TILES="+strconv.Itoa(s.Tiles),
+		"TILER_BYTES="+strconv.FormatInt(s.Bytes, 10),
+		"TILER_FAILED="+strconv.Itoa(s.Failed),
+		"TILER_DURATION="+strconv.FormatFloat(s.Duration, 'f', 3, 64),
+	)
+	if err := cmd.Run(); err != nil {
+		log.Println("hook:", err)
+	}
+}
+
+// shellCommand returns a command running command through the shell.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+func postWebhook(s runSummary) {
+	var body bytes.Buffer
+	contentType := "application/json"
+	if flagWebhookTemplate != "" {
+		text, err := ioutil.ReadFile(flagWebhookTemplate)
+		if err != nil {
+			log.Println("webhook:", err)
+			return
+		}
+		t, err := template.New("webhook").Parse(string(text))
+		if err != nil {
+			log.Println("webhook:", err)
+			return
+		}
+		if err := t.Execute(&body, s); err != nil {
+			log.Println("webhook:", err)
+			return
+		}
+		switch {
+		case flagWebhookType != "":
+			contentType = flagWebhookType
+		case !json.Valid(body.Bytes()):
+			contentType = http.DetectContentType(body.Bytes())
+		}
+	} else if err := json.NewEncoder(&body).Encode(s); err != nil {
+		log.Println("webhook:", err)
+		return
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(flagWebhook, contentType, &body)
+	if err != nil {
+		log.Println("webhook:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Println("webhook:", resp.Status)
+	}
+}
+
+// abortRun ends a run that has started, reporting it as failed.
+func abortRun(err error) {
+	stopProgress()
+	log.Println(err)
+	endTrace(err)
+	summary := summarize(err)
+	writeAudit(summary)
+	notify(summary)
+	cleanScratch()
+	os.Exit(1)
+}
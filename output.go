@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+// dirWriter stores tiles as files below -o.
+type dirWriter struct{}
+
+func (dirWriter) Mkdir(dir string) error {
+	return tiler.Dir(flagOutDir).Mkdir(dir)
+}
+
+func (dirWriter) WriteTile(name string, data []byte) error {
+	return tiler.Dir(flagOutDir).WriteTile(name, data)
+}
+
+// memWriter keeps tiles in memory, for environments without a file system.
+type memWriter struct {
+	mu    sync.Mutex
+	tiles map[string][]byte
+}
+
+func newMemWriter() *memWriter {
+	return &memWriter{tiles: make(map[string][]byte)}
+}
+
+func (*memWriter) Mkdir(string) error { return nil }
+
+func (m *memWriter) WriteTile(name string, data []byte) error {
+	m.mu.Lock()
+	m.tiles[filepath.ToSlash(name)] = append([]byte(nil), data...)
+	m.mu.Unlock()
+	return nil
+}
+
+// output receives every tile written during the run.
+var output tiler.Output = dirWriter{}
+
+// tileProgress counts stored tiles against the number expected, in total
+// and per level, and reports each one to an optional callback.
+type tileProgress struct {
+	mu     sync.Mutex
+	total  int
+	done   int
+	levels []levelCount
+	fn     func(name string, done, total int)
+	events *progressEvents
+}
+
+// levelCount is the progress of one level.
+type levelCount struct {
+	total, done int
+}
+
+var progress tileProgress
+
+// level returns the count of zoom, growing levels to hold it. p.mu must
+// be held.
+func (p *tileProgress) level(zoom int) *levelCount {
+	for len(p.levels) <= zoom {
+		p.levels = append(p.levels, levelCount{})
+	}
+	return &p.levels[zoom]
+}
+
+// Expect adds n tiles of level zoom to the number the run is going to
+// store.
+func (p *tileProgress) Expect(zoom, n int) {
+	p.mu.Lock()
+	p.total += n
+	p.level(zoom).total += n
+	p.mu.Unlock()
+}
+
+// Done records that the tile name of level zoom was stored.
+func (p *tileProgress) Done(name string, zoom int) {
+	p.mu.Lock()
+	p.done++
+	p.level(zoom).done++
+	if p.events != nil {
+		p.events.stored(p, zoom)
+	}
+	done, total, fn := p.done, p.total, p.fn
+	p.mu.Unlock()
+
+	if fn != nil {
+		fn(name, done, total)
+	}
+}
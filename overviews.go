@@ -0,0 +1,121 @@
+package main
+
+import (
+	"image"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Pyramidal TIFFs carry reduced-resolution copies of the image, marked
+// by NewSubfileType in the IFD chain or as SubIFDs of the first image.
+// Each level is scaled from the smallest overview still at least as large
+// as the level instead of from the full-resolution image. Only striped
+// overviews in the layouts decodeStrips handles are used.
+
+// tiffOverviews are the overviews of a TIFF source, largest first.
+type tiffOverviews struct {
+	path    string
+	layouts []*stripLayout
+}
+
+// sourceOverviews maps decoded TIFF sources to their overviews. Sources
+// corrected by preprocess are new images, which have none.
+var sourceOverviews sync.Map
+
+// noteOverviews records the overviews of the TIFF r, of size bytes, read
+// from path and decoded as img.
+func noteOverviews(img image.Image, path string, r io.ReaderAt, size int64) {
+	layouts := readOverviews(r, size)
+	if len(layouts) == 0 {
+		return
+	}
+	b := img.Bounds()
+	kept := layouts[:0]
+	for _, l := range layouts {
+		if l.width < b.Dx() && l.height < b.Dy() {
+			kept = append(kept, l)
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+	sourceOverviews.Store(img, &tiffOverviews{path, kept})
+	log.Printf("%s: %d overviews, scaling levels from the closest one", path, len(kept))
+}
+
+// readOverviews returns the reduced-resolution images of the TIFF r that
+// decodeStrips handles, largest first.
+func readOverviews(r io.ReaderAt, size int64) []*stripLayout {
+	order, first, ok := readTIFFHeader(r)
+	if !ok {
+		return nil
+	}
+	var layouts []*stripLayout
+	queue := []int64{first}
+	seen := make(map[int64]bool)
+	for len(queue) > 0 && len(seen) < 64 {
+		off := queue[0]
+		queue = queue[1:]
+		if off == 0 || seen[off] {
+			continue
+		}
+		seen[off] = true
+		tags, next, ok := readIFD(r, size, order, off)
+		if !ok {
+			break
+		}
+		queue = append(queue, next)
+		for _, sub := range tags[tagSubIFDs] {
+			queue = append(queue, int64(sub))
+		}
+		if off == first {
+			continue
+		}
+		if t := tags[tagNewSubfileType]; len(t) == 0 || t[0]&1 == 0 {
+			continue
+		}
+		if l, ok := newStripLayout(tags, 1); ok {
+			layouts = append(layouts, l)
+		}
+	}
+	sort.Slice(layouts, func(i, j int) bool {
+		return layouts[i].width > layouts[j].width
+	})
+	return layouts
+}
+
+// pickOverview decodes the smallest overview of img at least width by
+// height pixels. It returns nil if there is none narrower than limit, the
+// bounds of what the level would be scaled from otherwise.
+func pickOverview(img image.Image, width, height int, limit image.Rectangle) image.Image {
+	v, ok := sourceOverviews.Load(img)
+	if !ok {
+		return nil
+	}
+	o := v.(*tiffOverviews)
+	var best *stripLayout
+	for _, l := range o.layouts {
+		if l.width >= width && l.height >= height {
+			best = l
+		}
+	}
+	if best == nil || best.width >= limit.Dx() {
+		return nil
+	}
+
+	f, err := os.Open(o.path)
+	if err != nil {
+		log.Printf("%s: %v", o.path, err)
+		return nil
+	}
+	defer f.Close()
+	m, err := best.decodeRows(f, 0, best.height)
+	if err != nil {
+		log.Printf("%s: overview %dx%d: %v", o.path, best.width, best.height, err)
+		return nil
+	}
+	return m
+}
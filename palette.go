@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+)
+
+const (
+	// paletteSamples bounds how many pixels along each axis are sampled.
+	paletteSamples = 256
+
+	// paletteColors is the number of dominant colors reported.
+	paletteColors = 5
+)
+
+// Palette summarises the colors of a source image so viewers can pick a
+// matching background while tiles load.
+type Palette struct {
+	Average  string   `json:"average_color"`
+	Dominant []string `json:"dominant_colors"`
+}
+
+// colorBin accumulates the pixels quantized into one 4-bit-per-channel bin.
+type colorBin struct {
+	n       int
+	r, g, b int
+}
+
+// extractPalette samples img on a regular grid and returns its average
+// color and most frequent colors. Fully transparent pixels are ignored.
+func extractPalette(img image.Image) Palette {
+	bounds := img.Bounds()
+
+	stepX := (bounds.Dx() + paletteSamples - 1) / paletteSamples
+	stepY := (bounds.Dy() + paletteSamples - 1) / paletteSamples
+
+	bins := make(map[int]*colorBin)
+	var total colorBin
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				continue
+			}
+			r, g, b := int(c.R), int(c.G), int(c.B)
+
+			key := r>>4<<8 | g>>4<<4 | b>>4
+			bin := bins[key]
+			if bin == nil {
+				bin = &colorBin{}
+				bins[key] = bin
+			}
+			for _, acc := range []*colorBin{bin, &total} {
+				acc.n++
+				acc.r += r
+				acc.g += g
+				acc.b += b
+			}
+		}
+	}
+
+	var p Palette
+	if total.n == 0 {
+		return p
+	}
+	p.Average = total.hex()
+
+	sorted := make([]*colorBin, 0, len(bins))
+	for _, bin := range bins {
+		sorted = append(sorted, bin)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].n != sorted[j].n {
+			return sorted[i].n > sorted[j].n
+		}
+		return sorted[i].hex() < sorted[j].hex()
+	})
+	for i := 0; i < len(sorted) && i < paletteColors; i++ {
+		p.Dominant = append(p.Dominant, sorted[i].hex())
+	}
+	return p
+}
+
+// hex returns the mean color of the bin as #rrggbb.
+func (b *colorBin) hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", b.r/b.n, b.g/b.n, b.b/b.n)
+}
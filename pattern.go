@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// numberVar matches the placeholders of a naming pattern that are
+// replaced by numbers.
+var numberVar = regexp.MustCompile(`\{(zoom|x|y|size)\}`)
+
+// checkPattern reconciles the extension of -p with -e and rejects patterns
+// under which different tiles would get the same name. When -p is not
+// given explicitly its extension follows the encoding, so -e jpeg names
+// tiles .jpg; an explicit pattern naming another image type is an error.
+// Patterns with an extension that is not an image type are kept as given.
+func checkPattern(explicit bool) error {
+	if flagDZI != "" || flagIIIF != "" {
+		return nil
+	}
+	p := filepath.ToSlash(flagPattern)
+	stem := strings.TrimSuffix(p, path.Ext(p))
+	for _, v := range []string{"{zoom}", "{x}", "{y}"} {
+		if !strings.Contains(stem, v) {
+			return fmt.Errorf("-p %q lacks %s, so different tiles would overwrite each other", flagPattern, v)
+		}
+	}
+
+	// Numbers run together unless something other than digits comes
+	// between them: under {x}{y}, tile 1,12 and tile 11,2 are both 112.
+	locs := numberVar.FindAllStringIndex(stem, -1)
+	for i := 1; i < len(locs); i++ {
+		gap := stem[locs[i-1][1]:locs[i][0]]
+		if strings.Trim(gap, "0123456789") == "" {
+			return fmt.Errorf("-p %q runs %s and %s together, so different tiles could get the same name; separate them, e.g. with _",
+				flagPattern, stem[locs[i-1][0]:locs[i-1][1]], stem[locs[i][0]:locs[i][1]])
+		}
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))
+	want := tileExts[flagEncoding]
+	if ext == want || ext == flagEncoding || !imageExt(ext) {
+		return nil
+	}
+	if explicit {
+		return fmt.Errorf("-p %q names .%s files, but -e %s writes %s tiles; end it in .%s", flagPattern, ext, flagEncoding, flagEncoding, want)
+	}
+	flagPattern = strings.TrimSuffix(flagPattern, path.Ext(flagPattern)) + "." + want
+	return nil
+}
+
+// imageExt reports whether ext, without its dot, names a tile encoding.
+func imageExt(ext string) bool {
+	for enc, e := range tileExts {
+		if ext == enc || ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// patternGiven reports whether -p was set on the command line.
+func patternGiven() bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "p" {
+			given = true
+		}
+	})
+	return given
+}
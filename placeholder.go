@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"log"
+)
+
+var (
+	flagFillBBox string
+	flagFill     string
+)
+
+func init() {
+	flag.StringVar(&flagFillBBox, "fill-bbox", "", "emit placeholder tiles for uncovered grid positions within this tile rect at the deepest level (x0,y0,x1,y1)")
+	flag.StringVar(&flagFill, "fill", "transparent", "placeholder tile used by -fill-bbox: checkerboard, transparent or a hex color")
+}
+
+// coverage returns the tile indices at level, of tiles size pixels, that
+// a source of bounds src covers, numbered as -offset places them. The
+// whole level counts, as -region only rewrites tiles that exist.
+func coverage(src image.Rectangle, level, size int) image.Rectangle {
+	width, height := levelSize(src, level, size)
+	_, x, y := remapTile(level, 0, 0)
+	return image.Rect(0, 0, (width+size-1)/size, (height+size-1)/size).Add(image.Pt(x, y))
+}
+
+// scaleBBox converts a tile rect given at the deepest level to the tiles
+// it overlaps at level.
+func scaleBBox(r image.Rectangle, level, maxLevel int) image.Rectangle {
+	shift := uint(maxLevel - level)
+	div := 1 << shift
+	return image.Rect(r.Min.X>>shift, r.Min.Y>>shift, (r.Max.X+div-1)>>shift, (r.Max.Y+div-1)>>shift)
+}
+
+// fillPlaceholders writes the -fill tile at every position within the
+// -fill-bbox that the source does not cover, for the levels 0 to maxLevel
+// within -min-zoom and -max-zoom. The bbox is in the global grid -offset
+// places the tiles in, so it may reach left of and above the image.
+func fillPlaceholders(maxLevel int, dir string) {
+	bbox, err := parseRect(flagFillBBox)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, size := range flagTileSizes {
+		img, err := missingTileImage(flagFill, size)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := encodeTile(&buf, img, flagEncoding, encodingQuality(flagEncoding)); err != nil {
+			log.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		for level := 0; level <= maxLevel; level++ {
+			if !zoomWanted(level) {
+				continue
+			}
+			zoom, ox, oy := remapTile(level, 0, 0)
+			covered := coverage(tileSource, level, size)
+			side := 1 << uint(zoom)
+			r := scaleBBox(bbox, level, maxLevel).Intersect(image.Rect(0, 0, side, side))
+			var missing []image.Point
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					if !image.Pt(x, y).In(covered) {
+						missing = append(missing, image.Pt(x-ox, y-oy))
+					}
+				}
+			}
+
+			// Placeholders are stored like any tile, so they are sealed,
+			// flipped and tracked as the tiles around them are.
+			progress.Expect(level, len(missing))
+			sdir := sizeDir(dir, size)
+			for _, p := range missing {
+				if err := storeTile(jobCtx, data, "", size, p.X, p.Y, level, sdir); err != nil {
+					name := tileName(sdir, level, p.X, p.Y, size)
+					log.Printf("%s: %v", name, err)
+					failures.Add(name, err)
+				}
+			}
+		}
+	}
+}
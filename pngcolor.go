@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/png"
+	"io"
+	"sync"
+)
+
+// PNG color types forced by -png-color.
+var pngColorTypes = map[string]bool{
+	"auto":       true,
+	"gray":       true,
+	"gray-alpha": true,
+	"rgb":        true,
+	"rgba":       true,
+	"palette":    true,
+}
+
+var flagPNGColor = zoomFlag{def: "auto", check: func(t string) error {
+	if !pngColorTypes[t] {
+		return fmt.Errorf("unknown PNG color type %q", t)
+	}
+	return nil
+}}
+
+func init() {
+	flag.Var(&flagPNGColor, "png-color", "PNG color type auto, gray, gray-alpha, rgb, rgba or palette, optionally per zoom, e.g. gray,12=palette")
+}
+
+// Tiles that must be written with a color type the standard encoder would
+// not pick for them.
+type (
+	rgbaTile      struct{ *image.NRGBA }
+	grayAlphaTile struct{ *image.NRGBA }
+)
+
+// pngColor converts the tile img so it is encoded with the PNG color type
+// t. Dropping alpha composites the tile over black.
+func pngColor(img *image.RGBA, t string) image.Image {
+	switch t {
+	case "gray":
+		dst := image.NewGray(img.Rect)
+		draw.Draw(dst, dst.Rect, img, img.Rect.Min, draw.Src)
+		return dst
+	case "rgb":
+		dst := image.NewRGBA(img.Rect)
+		copy(dst.Pix, img.Pix)
+		for i := 3; i < len(dst.Pix); i += 4 {
+			dst.Pix[i] = 0xff
+		}
+		return dst
+	case "rgba", "gray-alpha":
+		dst := image.NewNRGBA(img.Rect)
+		draw.Draw(dst, dst.Rect, img, img.Rect.Min, draw.Src)
+		if t == "rgba" {
+			return rgbaTile{dst}
+		}
+		return grayAlphaTile{dst}
+	case "palette":
+		return paletted(img)
+	}
+	return img
+}
+
+// paletted converts img to a paletted image, exactly if it has at most 256
+// colors and otherwise by mapping to the nearest Plan 9 palette color.
+func paletted(img *image.RGBA) *image.Paletted {
+	var p color.Palette
+	index := make(map[color.RGBA]uint8)
+	exact := true
+	for i := 0; i < len(img.Pix); i += 4 {
+		c := color.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
+		if _, ok := index[c]; ok {
+			continue
+		}
+		if len(p) == 256 {
+			exact = false
+			break
+		}
+		index[c] = uint8(len(p))
+		p = append(p, c)
+	}
+
+	if !exact {
+		dst := image.NewPaletted(img.Rect, palette.Plan9)
+		draw.Draw(dst, dst.Rect, img, img.Rect.Min, draw.Src)
+		return dst
+	}
+	dst := image.NewPaletted(img.Rect, p)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			c := color.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
+			dst.SetColorIndex(x, y, index[c])
+		}
+	}
+	return dst
+}
+
+// encodePNG encodes img at the given compression level, honouring the
+// color type of tiles converted by pngColor.
+func encodePNG(w io.Writer, img image.Image, level png.CompressionLevel) error {
+	switch m := img.(type) {
+	case rgbaTile:
+		return writePNG(w, m.NRGBA, 6, 4, level, func(dst, src []byte) {
+			copy(dst, src)
+		})
+	case grayAlphaTile:
+		return writePNG(w, m.NRGBA, 4, 2, level, func(dst, src []byte) {
+			for i := 0; i < len(src)/4; i++ {
+				r, g, b := uint32(src[4*i]), uint32(src[4*i+1]), uint32(src[4*i+2])
+				dst[2*i] = uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 16)
+				dst[2*i+1] = src[4*i+3]
+			}
+		})
+	}
+	enc := png.Encoder{CompressionLevel: level, BufferPool: pngBuffers{}}
+	return enc.Encode(w, img)
+}
+
+var pngZlibLevels = map[png.CompressionLevel]int{
+	png.DefaultCompression: zlib.DefaultCompression,
+	png.NoCompression:      zlib.NoCompression,
+	png.BestSpeed:          zlib.BestSpeed,
+	png.BestCompression:    zlib.BestCompression,
+}
+
+// writePNG writes an 8-bit PNG of colorType with bpp bytes per pixel. pack
+// converts one row of img's pixels into the PNG sample layout.
+// The scanlines are compressed as they are filtered and written out in
+// IDAT chunks of up to pngChunkSize bytes, so the tile is never held
+// compressed in memory.
+func writePNG(w io.Writer, img *image.NRGBA, colorType byte, bpp int, level png.CompressionLevel, pack func(dst, src []byte)) error {
+	b := img.Rect
+	if _, err := io.WriteString(w, pngSignature); err != nil {
+		return err
+	}
+	if err := writeChunk(w, "IHDR", pngHeader(b.Dx(), b.Dy(), colorType)); err != nil {
+		return err
+	}
+
+	e := getRowEncoder()
+	defer pngRowEncoders.Put(e)
+	e.chunks.Reset(idatWriter{w})
+	if err := e.compress(e.chunks, img, bpp, level, pack); err != nil {
+		return err
+	}
+	if err := e.chunks.Flush(); err != nil {
+		return err
+	}
+	return writeChunk(w, "IEND", nil)
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+func pngHeader(width, height int, colorType byte) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8] = 8
+	ihdr[9] = colorType
+	return ihdr
+}
+
+// pngImageData returns the compressed, filtered scanlines of img, packed
+// into bpp bytes per pixel by pack.
+func pngImageData(img *image.NRGBA, bpp int, level png.CompressionLevel, pack func(dst, src []byte)) ([]byte, error) {
+	e := getRowEncoder()
+	defer pngRowEncoders.Put(e)
+
+	var idat bytes.Buffer
+	if err := e.compress(&idat, img, bpp, level, pack); err != nil {
+		return nil, err
+	}
+	return idat.Bytes(), nil
+}
+
+// pngChunkSize bounds the IDAT chunks written by writePNG.
+const pngChunkSize = 32 << 10
+
+// rowEncoder holds the buffers used to filter and compress the scanlines
+// of one tile. They are pooled, as allocating the compressor for every
+// tile dominates the garbage of large runs.
+type rowEncoder struct {
+	level    png.CompressionLevel
+	z        *zlib.Writer
+	chunks   *bufio.Writer
+	prev     []byte
+	cur      []byte
+	filtered [5][]byte
+}
+
+var pngRowEncoders sync.Pool
+
+func getRowEncoder() *rowEncoder {
+	if e, ok := pngRowEncoders.Get().(*rowEncoder); ok {
+		return e
+	}
+	return &rowEncoder{chunks: bufio.NewWriterSize(nil, pngChunkSize)}
+}
+
+// compress writes the zlib stream of img's filtered scanlines to w.
+func (e *rowEncoder) compress(w io.Writer, img *image.NRGBA, bpp int, level png.CompressionLevel, pack func(dst, src []byte)) error {
+	if e.z == nil || e.level != level {
+		z, err := zlib.NewWriterLevel(w, pngZlibLevels[level])
+		if err != nil {
+			return err
+		}
+		e.z, e.level = z, level
+	} else {
+		e.z.Reset(w)
+	}
+
+	b := img.Rect
+	width := b.Dx()
+	n := width * bpp
+	if cap(e.cur) < n {
+		e.prev, e.cur = make([]byte, n), make([]byte, n)
+		for f := range e.filtered {
+			e.filtered[f] = make([]byte, n+1)
+		}
+	}
+	prev, cur := e.prev[:n], e.cur[:n]
+	for i := range prev {
+		prev[i] = 0
+	}
+	var filtered [5][]byte
+	for f := range filtered {
+		filtered[f] = e.filtered[f][:n+1]
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := img.PixOffset(b.Min.X, y)
+		pack(cur, img.Pix[i:i+4*width])
+		if _, err := e.z.Write(filterRow(filtered, cur, prev, bpp)); err != nil {
+			return err
+		}
+		prev, cur = cur, prev
+	}
+	return e.z.Close()
+}
+
+// idatWriter writes each buffer it is given as one IDAT chunk.
+type idatWriter struct{ w io.Writer }
+
+func (w idatWriter) Write(p []byte) (int, error) {
+	if err := writeChunk(w.w, "IDAT", p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// pngBuffers pools the standard encoder's buffers across tiles.
+type pngBuffers struct{}
+
+var pngEncoderBuffers sync.Pool
+
+func (pngBuffers) Get() *png.EncoderBuffer {
+	b, _ := pngEncoderBuffers.Get().(*png.EncoderBuffer)
+	return b
+}
+
+func (pngBuffers) Put(b *png.EncoderBuffer) {
+	pngEncoderBuffers.Put(b)
+}
+
+// filterRow applies each PNG filter to cur and returns the filtered row,
+// prefixed by its filter type, with the smallest sum of absolute values.
+func filterRow(out [5][]byte, cur, prev []byte, bpp int) []byte {
+	for i := range cur {
+		var a, c byte
+		if i >= bpp {
+			a, c = cur[i-bpp], prev[i-bpp]
+		}
+		x, up := cur[i], prev[i]
+		out[0][i+1] = x
+		out[1][i+1] = x - a
+		out[2][i+1] = x - up
+		out[3][i+1] = x - byte((int(a)+int(up))/2)
+		out[4][i+1] = x - paeth(a, up, c)
+	}
+
+	best, bestSum := 0, -1
+	for f := range out {
+		out[f][0] = byte(f)
+		sum := 0
+		for _, v := range out[f][1:] {
+			if v < 128 {
+				sum += int(v)
+			} else {
+				sum += 256 - int(v)
+			}
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+	return out[best]
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	copy(hdr[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	for _, p := range [][]byte{hdr[:], data, sum[:]} {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"sync"
+)
+
+// Tiles are cropped into and encoded from pooled buffers, which a tile
+// only holds until it is stored. Runs of millions of tiles otherwise
+// spend much of their time collecting per-tile garbage.
+
+var tileBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// getBuffer returns an empty buffer to be returned to tileBuffers.
+func getBuffer() *bytes.Buffer {
+	buf := tileBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// tilePools maps each tile size to a *sync.Pool of tile images.
+var tilePools sync.Map
+
+// getTile returns a tile image of tileSize pixels with undefined contents.
+func getTile(tileSize int) *image.RGBA {
+	p, _ := tilePools.LoadOrStore(tileSize, &sync.Pool{New: func() interface{} {
+		return image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	}})
+	return p.(*sync.Pool).Get().(*image.RGBA)
+}
+
+// putTile returns a tile image obtained from getTile.
+func putTile(img *image.RGBA) {
+	if p, ok := tilePools.Load(img.Rect.Dx()); ok {
+		p.(*sync.Pool).Put(img)
+	}
+}
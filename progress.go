@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var flagQuiet bool
+
+func init() {
+	flag.BoolVar(&flagQuiet, "quiet", false, "do not report progress on stderr")
+}
+
+// progressReporter prints the run's progress to stderr: redrawn in place
+// twice a second on a terminal, or logged every ten seconds otherwise.
+type progressReporter struct {
+	start time.Time
+	term  bool
+	stop  chan struct{}
+	done  chan struct{}
+
+	// mu guards line, the status line currently drawn on the terminal,
+	// which log output is written above.
+	mu   sync.Mutex
+	line string
+	w    io.Writer
+}
+
+var reporter *progressReporter
+
+// startProgress starts reporting progress unless -quiet is set, or
+// writing progress events with -progress json.
+func startProgress() {
+	if flagProgress == "json" {
+		startProgressEvents()
+		return
+	}
+	if flagQuiet || reporter != nil {
+		return
+	}
+	r := &progressReporter{
+		start: time.Now(),
+		term:  isTerminal(os.Stderr),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		w:     os.Stderr,
+	}
+	interval := 10 * time.Second
+	if r.term {
+		interval = 500 * time.Millisecond
+		log.SetOutput(r)
+	}
+	reporter = r
+
+	go func() {
+		defer close(r.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-t.C:
+				r.report()
+			}
+		}
+	}()
+}
+
+// stopProgress stops reporting progress, leaving the final figures on a
+// terminal.
+func stopProgress() {
+	stopProgressEvents()
+	r := reporter
+	if r == nil {
+		return
+	}
+	reporter = nil
+	close(r.stop)
+	<-r.done
+	if r.term {
+		r.report()
+		r.mu.Lock()
+		if r.line != "" {
+			fmt.Fprintln(r.w)
+			r.line = ""
+		}
+		r.mu.Unlock()
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// report prints the current progress.
+func (r *progressReporter) report() {
+	line := progress.status(time.Since(r.start))
+	if line == "" {
+		return
+	}
+	if !r.term {
+		log.Print(line)
+		return
+	}
+	r.mu.Lock()
+	r.line = line
+	fmt.Fprintf(r.w, "\r%s\033[K", line)
+	r.mu.Unlock()
+}
+
+// Write writes log output above the status line.
+func (r *progressReporter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.line != "" {
+		fmt.Fprint(r.w, "\r\033[K")
+	}
+	n, err := r.w.Write(p)
+	if r.line != "" {
+		fmt.Fprint(r.w, r.line)
+	}
+	return n, err
+}
+
+// status describes the progress after elapsed: the tiles stored out of
+// those expected, the levels being worked on and the estimated time left.
+// It is empty until tiles are expected.
+func (p *tileProgress) status(elapsed time.Duration) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.total == 0 {
+		return ""
+	}
+
+	parts := []string{fmt.Sprintf("%d/%d tiles (%.1f%%)", p.done, p.total, 100*float64(p.done)/float64(p.total))}
+	for z, l := range p.levels {
+		if l.done > 0 && l.done < l.total {
+			parts = append(parts, fmt.Sprintf("z%d %d/%d", z, l.done, l.total))
+		}
+	}
+	switch {
+	case p.done >= p.total:
+		parts = append(parts, "took "+elapsed.Round(time.Second).String())
+	case p.done > 0:
+		left := time.Duration(float64(elapsed) * float64(p.total-p.done) / float64(p.done))
+		parts = append(parts, "ETA "+left.Round(time.Second).String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	flagS3Endpoint string
+	flagS3Region   string
+	flagPartSize   byteSize = 64 << 20
+	flagPushLedger string
+
+	flagUploadConcurrency = 8
+	flagBandwidthLimit    byteSize
+)
+
+func init() {
+	flag.StringVar(&flagS3Endpoint, "s3-endpoint", "", "push and -upload: endpoint of an S3-compatible store, e.g. http://localhost:9000 for MinIO (default AWS for -s3-region)")
+	flag.StringVar(&flagS3Region, "s3-region", "", "push and -upload: region of the S3 bucket (default $AWS_REGION or us-east-1)")
+	flag.Var(&flagPartSize, "part-size", "push: upload files larger than this in parts of this size, e.g. 64M (at least 5M)")
+	flag.IntVar(&flagUploadConcurrency, "upload-concurrency", flagUploadConcurrency, "push and -upload: files uploaded at once")
+	flag.Var(&flagBandwidthLimit, "bandwidth-limit", "push and -upload: bytes per second sent to the store across all uploads, e.g. 2M (0 for no limit)")
+	flag.StringVar(&flagPushLedger, "push-ledger", "", "push: file recording finished uploads so an interrupted push resumes (default <output directory>.push)")
+}
+
+// minPartSize is the smallest part S3 accepts other than the last.
+const minPartSize = 5 << 20
+
+// runPush uploads the tileset in the output directory:
+//
+//	tiler push -o tiles s3://bucket/prefix
+//
+// The destination may also be gs://bucket/prefix or
+// az://container/prefix.
+//
+// Every finished file, and every finished part of a large file, is
+// recorded in the push ledger. Pushing again after an interruption
+// skips what the ledger lists and continues multipart uploads where they
+// stopped; files changed since are uploaded again.
+func runPush(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: tiler push [flags] [s3://bucket/prefix | gs://bucket/prefix | az://container/prefix]")
+		os.Exit(2)
+	}
+	if flagPartSize < minPartSize {
+		log.Fatalln("-part-size must be at least 5M")
+	}
+	bucket, err := openBucket(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ledgerPath := flagPushLedger
+	if ledgerPath == "" {
+		ledgerPath = filepath.Clean(flagOutDir) + ".push"
+	}
+	ledger, err := openPushLedger(ledgerPath, args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ledger.Close()
+
+	// A -versioned output directory is pushed as its published version.
+	version, err := currentVersion(flagOutDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if version != "" {
+		flagOutDir = filepath.Join(flagOutDir, version)
+	}
+	skip, err := pushSkips(ledgerPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tiles are given the TTLs the run recorded in its manifest, if there
+	// is one, and those of -cache-ttl otherwise.
+	ttl := cacheTTL
+	if flagManifest != "" {
+		if ttl, err = manifestTTLs(filepath.Join(flagOutDir, flagManifest)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ttls := newUploadTTLs(ttl)
+
+	files := make(chan string)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	pushed, skipped, failed := 0, 0, 0
+	for i := 0; i < flagUploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range files {
+				done, err := pushFile(bucket, ledger, name, ttls.CacheControl(name))
+				mu.Lock()
+				switch {
+				case err != nil:
+					log.Printf("%s: %v", name, err)
+					failed++
+				case done:
+					skipped++
+				default:
+					pushed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err = filepath.Walk(flagOutDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(flagOutDir, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if rel != "." && skipPushDir(rel, info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(p, ".tmp") || skip[rel] {
+			return nil
+		}
+		files <- filepath.ToSlash(rel)
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("pushed %d files to %s, %d already there", pushed, args[0], skipped)
+	if failed > 0 {
+		log.Fatalf("%d files failed to upload, push again to resume", failed)
+	}
+}
+
+// pushSkips returns the files below the output directory, relative to
+// it, that belong to the run rather than the tileset: the quarantine, the
+// audit log, the ledger and the pointer to the current version.
+func pushSkips(ledgerPath string) (map[string]bool, error) {
+	root, err := filepath.Abs(flagOutDir)
+	if err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{currentLink: true}
+	if flagAudit != "" {
+		skip[filepath.Clean(flagAudit)] = true
+	}
+	for _, p := range []string{flagQuarantine, ledgerPath} {
+		if p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		if rel, err := filepath.Rel(root, abs); err == nil && !strings.HasPrefix(rel, "..") {
+			skip[rel] = true
+		}
+	}
+	return skip, nil
+}
+
+// skipPushDir reports whether the directory rel below the output
+// directory, named name, is left out of a push: the shared uniform tiles,
+// which every tile using one is a hardlink to, and the version
+// directories of a -versioned run, pushing the current one only.
+func skipPushDir(rel, name string) bool {
+	if name == uniformDir {
+		return true
+	}
+	if rel != name || len(name) < len(versionLayout) {
+		return false
+	}
+	_, err := time.Parse(versionLayout, name[:len(versionLayout)])
+	return err == nil
+}
+
+// pushFile uploads the tileset file name, to be served with the
+// Cache-Control cc, unless the ledger lists it as uploaded already, which
+// it reports.
+func pushFile(b objectStore, l *pushLedger, name, cc string) (bool, error) {
+	f, err := os.Open(filepath.Join(flagOutDir, filepath.FromSlash(name)))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	stamp := fileStamp{info.Size(), info.ModTime().UnixNano()}
+	if l.Done(name, stamp) {
+		return true, nil
+	}
+
+	key := b.objectKey(name)
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+
+	if stamp.size <= int64(flagPartSize) {
+		data := make([]byte, stamp.size)
+		if _, err := io.ReadFull(f, data); err != nil {
+			return false, err
+		}
+		if err := retry(func() error { return b.Put(key, data, ctype, cc) }); err != nil {
+			return false, err
+		}
+	} else if err := pushParts(b, l, name, key, ctype, cc, f, stamp); err != nil {
+		return false, err
+	}
+	return false, l.Record("file", strconv.FormatInt(stamp.size, 10), strconv.FormatInt(stamp.mtime, 10), name)
+}
+
+// pushParts uploads f as a multipart upload, continuing the one the
+// ledger records for this version of the file if there is one.
+func pushParts(b objectStore, l *pushLedger, name, key, ctype, cc string, f *os.File, stamp fileStamp) error {
+	up, ok := l.Upload(name, stamp)
+	if ok {
+		err := uploadParts(b, l, key, ctype, cc, f, stamp, up)
+		if !isNoSuchUpload(err) {
+			return err
+		}
+		log.Printf("%s: upload %s expired, starting over", name, up.id)
+	}
+
+	var id string
+	err := retry(func() (err error) {
+		id, err = b.CreateUpload(key, ctype, cc)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := l.Record("upload", id, strconv.FormatInt(stamp.size, 10), strconv.FormatInt(stamp.mtime, 10), name); err != nil {
+		return err
+	}
+	return uploadParts(b, l, key, ctype, cc, f, stamp, &pushUpload{id: id, stamp: stamp, parts: make(map[int]string)})
+}
+
+// uploadParts uploads the parts of f missing from up and completes it.
+func uploadParts(b objectStore, l *pushLedger, key, ctype, cc string, f *os.File, stamp fileStamp, up *pushUpload) error {
+	size := int64(flagPartSize)
+	n := int((stamp.size + size - 1) / size)
+	buf := make([]byte, size)
+	etags := make([]string, n)
+	for i := 1; i <= n; i++ {
+		if etag, ok := up.parts[i]; ok {
+			etags[i-1] = etag
+			continue
+		}
+		off := int64(i-1) * size
+		part := buf
+		if off+size > stamp.size {
+			part = buf[:stamp.size-off]
+		}
+		if _, err := f.ReadAt(part, off); err != nil {
+			return err
+		}
+		err := retry(func() (err error) {
+			etags[i-1], err = b.UploadPart(key, up.id, i, part)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := l.Record("part", up.id, strconv.Itoa(i), etags[i-1]); err != nil {
+			return err
+		}
+	}
+	return retry(func() error { return b.CompleteUpload(key, up.id, etags, ctype, cc) })
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	size, mtime int64
+}
+
+// pushUpload is a multipart upload recorded in the ledger.
+type pushUpload struct {
+	id    string
+	stamp fileStamp
+	parts map[int]string
+}
+
+// pushLedger records the progress of pushes to one destination. It is a
+// text file of tab separated fields, starting with a "push <destination>"
+// line, followed by
+//
+//	file <size> <mtime> <name>
+//	upload <id> <size> <mtime> <name>
+//	part <id> <n> <etag>
+//
+// lines appended as files finish, multipart uploads start and their parts
+// finish. Names come last, so they may contain spaces and tabs.
+type pushLedger struct {
+	mu      sync.Mutex
+	f       *os.File
+	files   map[string]fileStamp
+	uploads map[string]*pushUpload
+}
+
+// openPushLedger reads the ledger at path, starting a new one if it
+// records pushes to another destination.
+func openPushLedger(path, dest string) (*pushLedger, error) {
+	l := &pushLedger{
+		files:   make(map[string]fileStamp),
+		uploads: make(map[string]*pushUpload),
+	}
+	header := "push\t" + dest
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !l.read(path, header) {
+		mode |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, mode, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.f = f
+	if mode&os.O_TRUNC != 0 {
+		if _, err := fmt.Fprintln(f, header); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// read loads the ledger at path and reports whether it belongs to the
+// push with this header.
+func (l *pushLedger) read(path, header string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	if !s.Scan() || s.Text() != header {
+		return false
+	}
+	byID := make(map[string]*pushUpload)
+	for s.Scan() {
+		n, ok := ledgerFields[strings.SplitN(s.Text(), "\t", 2)[0]]
+		if !ok {
+			continue
+		}
+		fields := strings.SplitN(s.Text(), "\t", n)
+		switch {
+		case fields[0] == "file" && len(fields) == 4:
+			size, _ := strconv.ParseInt(fields[1], 10, 64)
+			mtime, _ := strconv.ParseInt(fields[2], 10, 64)
+			l.files[fields[3]] = fileStamp{size, mtime}
+		case fields[0] == "upload" && len(fields) == 5:
+			size, _ := strconv.ParseInt(fields[2], 10, 64)
+			mtime, _ := strconv.ParseInt(fields[3], 10, 64)
+			up := &pushUpload{id: fields[1], stamp: fileStamp{size, mtime}, parts: make(map[int]string)}
+			l.uploads[fields[4]] = up
+			byID[up.id] = up
+		case fields[0] == "part" && len(fields) == 4:
+			n, err := strconv.Atoi(fields[2])
+			if up, ok := byID[fields[1]]; ok && err == nil {
+				up.parts[n] = fields[3]
+			}
+		}
+	}
+	return true
+}
+
+// ledgerFields is the number of fields of each kind of ledger line.
+var ledgerFields = map[string]int{"file": 4, "upload": 5, "part": 4}
+
+// Done reports whether the ledger lists this version of name as
+// uploaded.
+func (l *pushLedger) Done(name string, stamp fileStamp) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.files[name]
+	return ok && s == stamp
+}
+
+// Upload returns the multipart upload of this version of name the ledger
+// records, if any.
+func (l *pushLedger) Upload(name string, stamp fileStamp) (*pushUpload, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	up, ok := l.uploads[name]
+	if !ok || up.stamp != stamp {
+		return nil, false
+	}
+	return up, true
+}
+
+// Record appends a line of fields to the ledger.
+func (l *pushLedger) Record(fields ...string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := fmt.Fprintln(l.f, strings.Join(fields, "\t"))
+	return err
+}
+
+func (l *pushLedger) Close() error {
+	return l.f.Close()
+}
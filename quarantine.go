@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/nfnt/resize"
+	"github.com/randomsean/tiler/tiler"
+)
+
+var flagQuarantine string
+
+// retrying is set while tiler retry regenerates quarantined tiles.
+var retrying bool
+
+func init() {
+	flag.StringVar(&flagQuarantine, "quarantine", "quarantine.json", "file listing the tiles a run failed to produce and why, which tiler retry regenerates (empty to disable)")
+}
+
+// Quarantine lists the tiles of a run that failed, with what tiler retry
+// needs to regenerate them.
+type Quarantine struct {
+	Tiles []QuarantinedTile `json:"tiles"`
+}
+
+// QuarantinedTile is a failed tile of level Zoom cut from Input, tiled to
+// Level and named by Pattern below Dir.
+type QuarantinedTile struct {
+	Name    string `json:"name"`
+	Error   string `json:"error"`
+	Input   string `json:"input"`
+	Level   int    `json:"level"`
+	Pattern string `json:"pattern"`
+	Dir     string `json:"dir"`
+	Zoom    int    `json:"zoom"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Size    int    `json:"size"`
+}
+
+// tilingInput is the source being tiled and its deepest level, which
+// failed tiles are quarantined with.
+var tilingInput struct {
+	path  string
+	level int
+}
+
+// noteInput records that the tiles generated next are cut from path,
+// tiled to level.
+func noteInput(path string, level int) {
+	tilingInput.path, tilingInput.level = path, level
+}
+
+// AddTile records tile x, y of zoom, stored at size below dir, as failed,
+// quarantining it if noteInput named the source it is cut from.
+func (l *failureList) AddTile(name string, err error, zoom, x, y, size int, dir string) {
+	if tilingInput.path == "" {
+		l.Add(name, err)
+		return
+	}
+	l.mu.Lock()
+	l.tiles = append(l.tiles, tileFailure{Name: name, Error: err, tile: &QuarantinedTile{
+		Name:    name,
+		Error:   err.Error(),
+		Input:   tilingInput.path,
+		Level:   tilingInput.level,
+		Pattern: flagPattern,
+		Dir:     dir,
+		Zoom:    zoom,
+		X:       x,
+		Y:       y,
+		Size:    size,
+	}})
+	l.mu.Unlock()
+}
+
+// writeQuarantine writes the failed tiles that can be regenerated to
+// -quarantine. When tiler retry regenerated them all it removes the file.
+func writeQuarantine() error {
+	if flagQuarantine == "" {
+		return nil
+	}
+	failures.mu.Lock()
+	var q Quarantine
+	for _, f := range failures.tiles {
+		if f.tile != nil {
+			q.Tiles = append(q.Tiles, *f.tile)
+		}
+	}
+	failures.mu.Unlock()
+
+	if len(q.Tiles) == 0 {
+		if retrying {
+			if err := os.Remove(flagQuarantine); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	sort.Slice(q.Tiles, func(i, j int) bool { return q.Tiles[i].Name < q.Tiles[j].Name })
+	data, err := json.MarshalIndent(&q, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Printf("%d failed tiles quarantined in %s, run tiler retry to regenerate them", len(q.Tiles), flagQuarantine)
+	return tiler.WriteFile(flagQuarantine, append(data, '\n'))
+}
+
+// runRetry regenerates the tiles listed in -quarantine. It takes the
+// flags of the run that failed them.
+func runRetry(args []string) {
+	checkFlags()
+
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: tiler retry [flags]")
+		os.Exit(2)
+	}
+	data, err := ioutil.ReadFile(flagQuarantine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var q Quarantine
+	if err := json.Unmarshal(data, &q); err != nil {
+		log.Fatalf("%s: %v", flagQuarantine, err)
+	}
+
+	byInput := make(map[string][]QuarantinedTile)
+	var inputs []string
+	for _, t := range q.Tiles {
+		if _, ok := byInput[t.Input]; !ok {
+			inputs = append(inputs, t.Input)
+		}
+		byInput[t.Input] = append(byInput[t.Input], t)
+	}
+
+	retrying = true
+	pattern := flagPattern
+	defer func() { flagPattern = pattern }()
+
+	startRun(inputs...)
+	if manifest != nil && !flagAppend {
+		if err := manifest.Merge(filepath.Join(flagOutDir, flagManifest)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, input := range inputs {
+		img, err := loadSource(input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tiles := byInput[input]
+		noteInput(input, tiles[0].Level)
+		if err := setOffset(tiles[0].Level); err != nil {
+			log.Fatal(err)
+		}
+		for _, t := range tiles {
+			progress.Expect(t.Zoom, 1)
+		}
+
+		// Group the tiles by level and size to scale each level once.
+		sort.Slice(tiles, func(i, j int) bool {
+			if tiles[i].Zoom != tiles[j].Zoom {
+				return tiles[i].Zoom < tiles[j].Zoom
+			}
+			return tiles[i].Size < tiles[j].Size
+		})
+		for i := 0; i < len(tiles); {
+			zoom, size := tiles[i].Zoom, tiles[i].Size
+			width, height := levelSize(img.Bounds(), zoom, size)
+			level := resize.Resize(uint(width), uint(height), img, interpFor(zoom))
+			for ; i < len(tiles) && tiles[i].Zoom == zoom && tiles[i].Size == size; i++ {
+				t := tiles[i]
+				flagPattern = t.Pattern
+				if err := saveCrop(jobCtx, level, size, t.X, t.Y, zoom, t.Dir); err != nil {
+					log.Printf("%s: %v", t.Name, err)
+					failures.AddTile(t.Name, err, zoom, t.X, t.Y, size, t.Dir)
+				}
+			}
+		}
+		forgetCached(img)
+	}
+	finishRun(nil)
+}
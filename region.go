@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// regionMargin is the number of level pixels a dirty region is grown by
+// so tiles touched only by the interpolation kernel are regenerated too.
+const regionMargin = 3
+
+// parseRect parses a "x0,y0,x1,y1" pixel rectangle.
+func parseRect(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("invalid region %q: want x0,y0,x1,y1", s)
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return image.Rectangle{}, fmt.Errorf("invalid region %q: %v", s, err)
+		}
+		v[i] = n
+	}
+	return image.Rect(v[0], v[1], v[2], v[3]), nil
+}
+
+// diffRect returns the bounding rectangle of all pixels that differ
+// between a and b. Both images must have the same bounds.
+func diffRect(a, b image.Image) (image.Rectangle, error) {
+	bounds := a.Bounds()
+	if bounds != b.Bounds() {
+		return image.Rectangle{}, errors.New("previous snapshot dimensions do not match source")
+	}
+
+	var r image.Rectangle
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r, nil
+}
+
+// tileRange converts a dirty rectangle in source pixels into the range of
+// tile indices it touches at a level of the given pixel dimensions.
+func tileRange(dirty, src image.Rectangle, width, height, tileSize int) image.Rectangle {
+	sw, sh := src.Dx(), src.Dy()
+
+	x0 := (dirty.Min.X-src.Min.X)*width/sw - regionMargin
+	y0 := (dirty.Min.Y-src.Min.Y)*height/sh - regionMargin
+	x1 := ((dirty.Max.X-src.Min.X)*width+sw-1)/sw + regionMargin
+	y1 := ((dirty.Max.Y-src.Min.Y)*height+sh-1)/sh + regionMargin
+
+	r := image.Rect(x0/tileSize, y0/tileSize, (x1+tileSize-1)/tileSize, (y1+tileSize-1)/tileSize)
+	return r.Intersect(image.Rect(0, 0, (width+tileSize-1)/tileSize, (height+tileSize-1)/tileSize))
+}
+
+// tileWindow returns the pixels of a width×height level that tiles, of
+// tileSize, cover.
+func tileWindow(tiles image.Rectangle, tileSize, width, height int) image.Rectangle {
+	r := image.Rect(tiles.Min.X*tileSize, tiles.Min.Y*tileSize, tiles.Max.X*tileSize, tiles.Max.Y*tileSize)
+	return r.Intersect(image.Rect(0, 0, width, height))
+}
+
+// renderRegion regenerates the tiles of a -region at level from the
+// windows of the level they cover alone, so a small region costs little
+// however deep the level. Each window is drawn by a levelSampler, as the
+// whole level would be, so its tiles match a full run's byte for byte.
+// It renders nothing and reports false where the level is rendered whole
+// instead: when the largest size is not overzoomed, as the next level is
+// scaled from all of it, when -scale-cmd scales levels whole, and when the
+// region covers every size anyway.
+func renderRegion(ctx context.Context, img image.Image, src image.Rectangle, tileSizes []int, level int, dir string) bool {
+	k := downsampleKernel()
+	if flagSuperRes != "" || flagScaleCmd != "" || (k != nil && len(tileSizes) > 1) {
+		return false
+	}
+	if w, h := levelSize(src, level, tileSizes[0]); !overzoomed(src, w, h) {
+		return false
+	}
+
+	type window struct {
+		tileSize int
+		tiles    image.Rectangle
+		full     image.Rectangle
+		need     image.Rectangle
+		s        *levelSampler
+	}
+	interp := interpFor(level)
+	var wins []window
+	partial := false
+	from, bounds := img, img.Bounds()
+	for _, tileSize := range tileSizes {
+		w, h := levelSize(src, level, tileSize)
+		tiles := levelTiles(src, level, tileSize)
+		if tiles.Empty() {
+			continue
+		}
+		win := tileWindow(tiles, tileSize, w, h)
+		full := image.Rect(0, 0, w, h)
+		partial = partial || win != full
+		// Tiles past the far edges are mirrored by -edge from up to a
+		// tile of the level back, so the window holds that much.
+		if win.Max.X == w && win.Min.X > w-tileSize {
+			win.Min.X = w - tileSize
+		}
+		if win.Max.Y == h && win.Min.Y > h-tileSize {
+			win.Min.Y = h - tileSize
+		}
+		win = win.Intersect(full)
+
+		// The samplers are made up front, as the windows are worked out
+		// from the largest size down; an empty image stands for the type
+		// of the size before.
+		s := newLevelSampler(from, bounds, w, h, interp)
+		if !s.same {
+			from, bounds = s.newImage(image.Rectangle{}, nil), full
+		}
+		wins = append(wins, window{tileSize, tiles, full, win, s})
+	}
+	if !partial {
+		return false
+	}
+
+	// Each size is scaled from the one before it, so that one needs the
+	// pixels the next size's window is drawn from too.
+	for i := len(wins) - 2; i >= 0; i-- {
+		wins[i].need = wins[i].need.Union(wins[i+1].s.reach(wins[i+1].need))
+	}
+
+	from = img
+	for _, win := range wins {
+		start := time.Now()
+		var part image.Image
+		if k != nil && img.Bounds() != src {
+			dst := image.NewRGBA(win.need)
+			k.Scale(dst, win.full, img, img.Bounds(), draw.Src, nil)
+			part = dst
+		} else {
+			part = win.s.render(from, win.need)
+		}
+		timings.Since(stageScale, level, start)
+
+		sdir := sizeDir(dir, win.tileSize)
+		cropLevel(ctx, win.tiles, win.tileSize, level, sdir, func(ctx context.Context, x, y int) error {
+			return saveCrop(ctx, part, win.tileSize, x, y, level, sdir)
+		})
+		from = part
+	}
+	return true
+}
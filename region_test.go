@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"math/rand"
+	"testing"
+
+	"github.com/nfnt/resize"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+// testImages returns a w×h image of noise of each type resize.Resize
+// treats apart.
+func testImages(w, h int) []image.Image {
+	rng := rand.New(rand.NewSource(1))
+	r := image.Rect(0, 0, w, h)
+	imgs := []image.Image{
+		image.NewRGBA(r), image.NewNRGBA(r), image.NewRGBA64(r), image.NewNRGBA64(r),
+		image.NewGray(r), image.NewGray16(r), image.NewPaletted(r, palette.Plan9),
+	}
+	for _, img := range imgs {
+		set := img.(interface{ Set(x, y int, c color.Color) })
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				a := uint16(rng.Intn(0x10000))
+				set.Set(x, y, color.NRGBA64{uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), a})
+			}
+		}
+	}
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio422} {
+		img := image.NewYCbCr(r, ratio)
+		rng.Read(img.Y)
+		rng.Read(img.Cb)
+		rng.Read(img.Cr)
+		imgs = append(imgs, img)
+	}
+	return imgs
+}
+
+// sameWindow reports the first pixel of win where got differs from want.
+func sameWindow(got, want image.Image, win image.Rectangle) error {
+	if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", want) {
+		return fmt.Errorf("got a %T, want a %T", got, want)
+	}
+	for y := win.Min.Y; y < win.Max.Y; y++ {
+		for x := win.Min.X; x < win.Max.X; x++ {
+			if g, w := got.At(x, y), want.At(x, y); g != w {
+				return fmt.Errorf("pixel %d,%d is %v, want %v", x, y, g, w)
+			}
+		}
+	}
+	return nil
+}
+
+func TestLevelSamplerMatchesResize(t *testing.T) {
+	const tile = 16
+	for _, src := range testImages(37, 29) {
+		for name, interp := range tiler.Interpolations {
+			for _, size := range []image.Point{{100, 80}, {20, 15}} {
+				want := resize.Resize(uint(size.X), uint(size.Y), src, interp)
+				s := newLevelSampler(src, src.Bounds(), size.X, size.Y, interp)
+				for y := 0; y < size.Y; y += tile {
+					for x := 0; x < size.X; x += tile {
+						win := image.Rect(x, y, x+tile, y+tile).Intersect(want.Bounds())
+						// Draw from only the pixels the window reaches,
+						// but for subsampled chroma, which nfnt/resize
+						// indexes from the corner of the whole image.
+						from := src
+						if y, ok := src.(*image.YCbCr); !ok || y.SubsampleRatio == image.YCbCrSubsampleRatio444 {
+							from = src.(interface {
+								SubImage(image.Rectangle) image.Image
+							}).SubImage(s.reach(win))
+						}
+						part := s.render(from, win)
+						if err := sameWindow(part, want, win); err != nil {
+							t.Fatalf("%T %s to %v, window %v: %v", src, name, size, win, err)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestLevelSamplerChains(t *testing.T) {
+	src := testImages(37, 29)[0]
+	interp := resize.Lanczos3
+	mid := resize.Resize(150, 120, src, interp)
+	want := resize.Resize(90, 72, mid, interp)
+
+	s1 := newLevelSampler(src, src.Bounds(), 150, 120, interp)
+	s2 := newLevelSampler(mid, mid.Bounds(), 90, 72, interp)
+	win := image.Rect(30, 20, 60, 45)
+	part := s1.render(src, s2.reach(win))
+	if err := sameWindow(s2.render(part, win), want, win); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runTiles tiles img to level into memory and returns the tiles written.
+func runTiles(img image.Image, level int, region image.Rectangle) map[string][]byte {
+	mem := newMemWriter()
+	output, dirty = mem, region
+	progress = tileProgress{}
+	defer func() { output, dirty = dirWriter{}, image.Rectangle{} }()
+	tileLevels(img, level, "")
+	return mem.tiles
+}
+
+func TestRegionMatchesFullRun(t *testing.T) {
+	defer func(sizes sizeList) { flagTileSizes = sizes }(flagTileSizes)
+	flagTileSizes = sizeList{32, 16}
+
+	img := testImages(40, 30)[1]
+	full := runTiles(img, 4, image.Rectangle{})
+	for _, region := range []image.Rectangle{image.Rect(3, 4, 9, 7), image.Rect(30, 22, 40, 30), image.Rect(0, 0, 20, 30)} {
+		part := runTiles(img, 4, region)
+		if len(part) == 0 || len(part) >= len(full) {
+			t.Fatalf("region %v wrote %d of %d tiles", region, len(part), len(full))
+		}
+		for name, data := range part {
+			if !bytes.Equal(data, full[name]) {
+				t.Errorf("region %v: tile %s differs from a full run", region, name)
+			}
+		}
+	}
+}
+
+func TestSpillMatchesMemory(t *testing.T) {
+	defer func(spill bool, sizes sizeList) { flagSpill, flagTileSizes = spill, sizes }(flagSpill, flagTileSizes)
+	flagTileSizes = sizeList{32, 16}
+
+	img := testImages(40, 30)[1]
+	flagSpill = false
+	mem := runTiles(img, 3, image.Rectangle{})
+	flagSpill = true
+	spilled := runTiles(img, 3, image.Rectangle{})
+	if len(spilled) != len(mem) {
+		t.Fatalf("-spill wrote %d tiles, want %d", len(spilled), len(mem))
+	}
+	for name, data := range mem {
+		if !bytes.Equal(spilled[name], data) {
+			t.Errorf("tile %s differs with -spill", name)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"image/draw"
+	"log"
+	"math"
+)
+
+var flagRegisterWindow int
+
+func init() {
+	flag.IntVar(&flagRegisterWindow, "register-window", 0, "search this many pixels around each montage offset for the best overlap match (0 disables)")
+}
+
+const (
+	// registerStep subsamples the overlap when scoring a candidate shift.
+	registerStep = 4
+
+	// registerMinOverlap is the fewest sampled pixels a shift must overlap
+	// for its score to be trusted.
+	registerMinOverlap = 64
+)
+
+// registerMontage refines the offset of every montage entry after the
+// first by searching within ±window pixels for the shift that best matches
+// the entries already placed, scored by mean absolute luma difference over
+// the overlap. Entries without enough overlap keep their offset.
+func registerMontage(tiles []montageTile, imgs []image.Image, window int) {
+	grays := make([]*image.Gray, len(imgs))
+	for i, img := range imgs {
+		b := img.Bounds()
+		g := image.NewGray(b.Sub(b.Min))
+		draw.Draw(g, g.Bounds(), img, b.Min, draw.Src)
+		grays[i] = g
+	}
+
+	for i := 1; i < len(tiles); i++ {
+		base := tiles[i].Offset
+		best, bestScore := base, math.Inf(1)
+
+		for dy := -window; dy <= window; dy++ {
+			for dx := -window; dx <= window; dx++ {
+				off := base.Add(image.Pt(dx, dy))
+				score, ok := overlapScore(grays[i], off, grays[:i], tiles[:i])
+				if ok && score < bestScore {
+					best, bestScore = off, score
+				}
+			}
+		}
+
+		if best != base {
+			log.Printf("registered %s at %v (moved %v)", tiles[i].Path, best, best.Sub(base))
+		}
+		tiles[i].Offset = best
+	}
+}
+
+// overlapScore returns the mean absolute difference between img placed at
+// off and the already placed images wherever they overlap.
+func overlapScore(img *image.Gray, off image.Point, placed []*image.Gray, tiles []montageTile) (float64, bool) {
+	r := img.Bounds().Add(off)
+
+	var sum float64
+	var n int
+	for j, p := range placed {
+		pr := p.Bounds().Add(tiles[j].Offset)
+		overlap := r.Intersect(pr)
+		for y := overlap.Min.Y; y < overlap.Max.Y; y += registerStep {
+			for x := overlap.Min.X; x < overlap.Max.X; x += registerStep {
+				a := img.GrayAt(x-off.X, y-off.Y).Y
+				b := p.GrayAt(x-tiles[j].Offset.X, y-tiles[j].Offset.Y).Y
+				sum += math.Abs(float64(a) - float64(b))
+				n++
+			}
+		}
+	}
+
+	if n < registerMinOverlap {
+		return 0, false
+	}
+	return sum / float64(n), true
+}
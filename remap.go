@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var flagOffset string
+
+func init() {
+	flag.StringVar(&flagOffset, "offset", "", "place the top-left tile of the deepest level at tile z/x/y of a global tileset, renumbering every level to match")
+}
+
+// offset is the placement given by -offset, resolved against the deepest
+// level generated.
+var offset struct {
+	set      bool
+	maxLevel int
+	zoom     int
+	x, y     int
+}
+
+// setOffset resolves -offset for a pyramid whose deepest level is level.
+// The image must occupy one whole quadtree node of the global tileset, so
+// x and y must be multiples of 2^level. Without -offset, a GeoTIFF
+// covering one web mercator tile is placed there.
+func setOffset(level int) error {
+	offset.set = false
+	spec := flagOffset
+	if spec == "" && geoNode != nil {
+		n := geoNode
+		spec = fmt.Sprintf("%d/%d/%d", n[0]+level, n[1]<<uint(level), n[2]<<uint(level))
+	}
+	if spec == "" {
+		return nil
+	}
+	var z, x, y int
+	if _, err := fmt.Sscanf(spec, "%d/%d/%d", &z, &x, &y); err != nil {
+		return fmt.Errorf("invalid -offset %q, want z/x/y", flagOffset)
+	}
+	if z < level {
+		return fmt.Errorf("-offset zoom %d is shallower than the %d levels generated", z, level)
+	}
+	side := 1 << uint(level)
+	if x < 0 || y < 0 || x%side != 0 || y%side != 0 {
+		return fmt.Errorf("-offset %d/%d/%d does not align with the pyramid, x and y must be multiples of %d (e.g. %d/%d/%d)",
+			z, x, y, side, z, x/side*side, y/side*side)
+	}
+	if max := 1 << uint(z); x+side > max || y+side > max {
+		return fmt.Errorf("-offset %d/%d/%d places the image outside zoom %d", z, x, y, z)
+	}
+	offset.set, offset.maxLevel, offset.zoom, offset.x, offset.y = true, level, z, x, y
+	return nil
+}
+
+// remapTile returns the global tile coordinate of tile x, y at zoom of
+// the pyramid being generated.
+func remapTile(zoom, x, y int) (int, int, int) {
+	if !offset.set {
+		return zoom, x, y
+	}
+	d := uint(offset.maxLevel - zoom)
+	return offset.zoom - int(d), x + offset.x>>d, y + offset.y>>d
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	flagDownloadConns int
+	flagDownloadDir   string
+	flagSourceCache   bool
+)
+
+func init() {
+	flag.IntVar(&flagDownloadConns, "download-conns", 4, "parallel range requests used to fetch remote sources")
+	flag.StringVar(&flagDownloadDir, "download-dir", "", "directory remote sources are downloaded into (default -tmpdir)")
+	flag.BoolVar(&flagSourceCache, "source-cache", true, "reuse previously downloaded remote sources whose ETag is unchanged")
+}
+
+// downloadChunk is the size of each range request. Interrupted downloads
+// resume at chunk granularity.
+const downloadChunk = 32 << 20
+
+func isRemote(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// downloadPath returns where the remote source at rawurl is stored locally.
+// The file keeps the extension of the URL path so it can be decoded.
+func downloadPath(rawurl string) string {
+	base := "source"
+	if u, err := url.Parse(rawurl); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		base = path.Base(u.Path)
+	}
+	dir := flagDownloadDir
+	if dir == "" {
+		dir = flagTmpDir
+	}
+	sum := sha256.Sum256([]byte(rawurl))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+"-"+base)
+}
+
+// fetchSource downloads rawurl and returns the path of the local copy. When
+// the server supports range requests the body is fetched in parallel
+// chunks, and chunks completed by an earlier interrupted run are reused.
+// A copy cached by an earlier run is revalidated with If-None-Match and
+// reused when the server reports it unchanged.
+func fetchSource(rawurl string) (string, error) {
+	dst := downloadPath(rawurl)
+	etagPath := dst + ".etag"
+
+	req, err := http.NewRequest("HEAD", rawurl, nil)
+	if err != nil {
+		return "", err
+	}
+
+	cached := ""
+	if flagSourceCache {
+		if _, err := os.Stat(dst); err == nil {
+			if b, err := ioutil.ReadFile(etagPath); err == nil {
+				cached = string(b)
+				req.Header.Set("If-None-Match", cached)
+			}
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return dst, nil
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("%s: %s", rawurl, resp.Status)
+	case cached != "" && etag == cached:
+		return dst, nil
+	}
+
+	os.Remove(etagPath)
+
+	if resp.ContentLength <= 0 || resp.Header.Get("Accept-Ranges") != "bytes" || flagDownloadConns <= 1 {
+		err = downloadStream(rawurl, dst)
+	} else {
+		err = downloadRanges(rawurl, dst, resp.ContentLength, etag)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if flagSourceCache && etag != "" {
+		if err := ioutil.WriteFile(etagPath, []byte(etag), 0644); err != nil {
+			return "", err
+		}
+	}
+	return dst, nil
+}
+
+func downloadStream(rawurl, dst string) error {
+	resp, err := http.Get(rawurl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", rawurl, resp.Status)
+	}
+
+	tmp := dst + ".partial"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func downloadRanges(rawurl, dst string, size int64, etag string) error {
+	tmp := dst + ".partial"
+	ledger := dst + ".progress"
+	header := "size " + strconv.FormatInt(size, 10) + " " + etag
+
+	// The ledger only speaks for a partial file still of the full size;
+	// one deleted or cut short since has lost the chunks it lists.
+	done := readLedger(ledger, header)
+	if fi, err := os.Stat(tmp); err != nil || fi.Size() != size {
+		done = nil
+	}
+	if done == nil {
+		os.Remove(tmp)
+	}
+
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if done == nil {
+		mode |= os.O_TRUNC
+	}
+	lf, err := os.OpenFile(ledger, mode, 0644)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	if done == nil {
+		fmt.Fprintln(lf, header)
+	}
+
+	chunks := make(chan int64)
+	errs := make(chan error, flagDownloadConns)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < flagDownloadConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := range chunks {
+				end := off + downloadChunk
+				if end > size {
+					end = size
+				}
+				if err := downloadRange(rawurl, etag, f, off, end); err != nil {
+					errs <- err
+					return
+				}
+				mu.Lock()
+				fmt.Fprintf(lf, "%d\n", off)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var failed error
+loop:
+	for off := int64(0); off < size; off += downloadChunk {
+		if done[off] {
+			continue
+		}
+		select {
+		case chunks <- off:
+		case failed = <-errs:
+			break loop
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	if failed == nil {
+		select {
+		case failed = <-errs:
+		default:
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	lf.Close()
+	os.Remove(ledger)
+	return os.Rename(tmp, dst)
+}
+
+// downloadRange fetches bytes [start, end) of rawurl into f at start. If
+// etag is set the request fails should the source change mid-download.
+func downloadRange(rawurl, etag string, f *os.File, start, end int64) error {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end-1, 10))
+	if etag != "" {
+		req.Header.Set("If-Range", etag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s: range request: %s", rawurl, resp.Status)
+	}
+
+	n, err := io.Copy(io.NewOffsetWriter(f, start), io.LimitReader(resp.Body, end-start))
+	if err != nil {
+		return err
+	}
+	if n != end-start {
+		return fmt.Errorf("%s: short range response at offset %d", rawurl, start)
+	}
+	return nil
+}
+
+// readLedger returns the chunk offsets an earlier run finished downloading.
+// A ledger written for a different source size or ETag is ignored.
+func readLedger(path, header string) map[int64]bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	if !s.Scan() || s.Text() != header {
+		os.Remove(path)
+		return nil
+	}
+
+	done := make(map[int64]bool)
+	for s.Scan() {
+		off, err := strconv.ParseInt(s.Text(), 10, 64)
+		if err == nil {
+			done[off] = true
+		}
+	}
+	return done
+}
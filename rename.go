@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+var flagRenameLink bool
+
+func init() {
+	flag.BoolVar(&flagRenameLink, "link", false, "rename: hardlink the tiles under their new names and keep the old names too")
+}
+
+// runRename converts the tileset in the output directory from one naming
+// pattern to another:
+//
+//	tiler rename -o tiles '{zoom}_{x}_{y}.png' '{zoom}/{x}/{y}.png'
+//
+// Tiles are moved, or hardlinked with -link, along with companion files
+// such as UTFGrids, and renamed in the -manifest. A {size} in the new
+// pattern that the old one lacks is taken from -size. Nothing is touched
+// if two tiles would get the same name or a new name is already taken.
+func runRename(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: tiler rename [flags] from-pattern to-pattern")
+		os.Exit(2)
+	}
+	from, to := filepath.ToSlash(args[0]), filepath.ToSlash(args[1])
+	if path.Ext(from) != path.Ext(to) {
+		log.Fatalf("%s and %s name different file types, but rename keeps the contents of the tiles", from, to)
+	}
+	re, err := renameRegexp(strings.TrimSuffix(from, path.Ext(from)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	toStem := strings.TrimSuffix(to, path.Ext(to))
+	for _, v := range []string{"{zoom}", "{x}", "{y}"} {
+		if !strings.Contains(toStem, v) {
+			log.Fatalf("%s must hold %s", to, v)
+		}
+	}
+
+	var m *Manifest
+	manifestPath := filepath.Join(flagOutDir, flagManifest)
+	if flagManifest != "" {
+		data, err := ioutil.ReadFile(manifestPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m = NewManifest()
+		if err := json.Unmarshal(data, m); err != nil {
+			log.Fatalf("%s: %v", manifestPath, err)
+		}
+		if m.Encryption != nil {
+			log.Fatalln("encrypted tiles are bound to their names and cannot be renamed, tile again instead")
+		}
+	}
+
+	renames, err := planRenames(re, toStem)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(renames) == 0 {
+		log.Printf("no files in %s are named %s", flagOutDir, from)
+		return
+	}
+	verb := "renamed"
+	if flagRenameLink {
+		verb = "linked"
+		err = linkRenames(renames)
+	} else {
+		err = moveRenames(renames)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if m != nil {
+		m.Tiles, m.Empty = renameKeys(m.Tiles, renames), renameKeys(m.Empty, renames)
+		if err := m.Write(manifestPath); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := os.Stat(manifestPath + ".sig"); err == nil {
+			if flagSignKey == "" {
+				log.Printf("%s.sig no longer matches the manifest, rename again with -sign-key to sign it", manifestPath)
+			} else {
+				key, err := loadSignKey(flagSignKey)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if err := signManifest(manifestPath, key); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+	log.Printf("%s %d files from %s to %s", verb, len(renames), from, to)
+}
+
+// renameKeys returns the manifest records names under the new names of
+// the files renamed, keeping the old names too with -link.
+func renameKeys(names, renames map[string]string) map[string]string {
+	out := make(map[string]string, len(names))
+	for old, v := range names {
+		name, ok := renames[old]
+		if !ok || flagRenameLink {
+			out[old] = v
+		}
+		if ok {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+// renameRegexp returns a regexp matching the names of the pattern stem,
+// without its extension, capturing the placeholders and the extension or
+// companion suffix, such as .png or .grid.json, of each file.
+func renameRegexp(stem string) (*regexp.Regexp, error) {
+	s := regexp.QuoteMeta(stem)
+	for _, v := range []string{"zoom", "x", "y", "size"} {
+		switch n := strings.Count(stem, "{"+v+"}"); {
+		case n > 1, n == 0 && v != "size":
+			return nil, fmt.Errorf("pattern %q must hold {%s} once", stem, v)
+		}
+		s = strings.Replace(s, regexp.QuoteMeta("{"+v+"}"), "(?P<"+v+">[0-9]+)", 1)
+	}
+	return regexp.Compile("^" + s + `(?P<suffix>(?:\.[^/]*)?)$`)
+}
+
+// planRenames returns the new name of every file in the output directory
+// matched by re, named after toStem. Names are relative, with slashes.
+func planRenames(re *regexp.Regexp, toStem string) (map[string]string, error) {
+	renames := make(map[string]string)
+	err := filepath.Walk(flagOutDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(flagOutDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		sub := re.FindStringSubmatch(rel)
+		if sub == nil {
+			return nil
+		}
+		v := map[string]int{"size": flagTileSizes[0]}
+		suffix := ""
+		for i, name := range re.SubexpNames() {
+			switch name {
+			case "":
+			case "suffix":
+				suffix = sub[i]
+			default:
+				v[name], _ = strconv.Atoi(sub[i])
+			}
+		}
+		if name := tiler.FileName(toStem, v["zoom"], v["x"], v["y"], v["size"]) + suffix; name != rel {
+			renames[rel] = name
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Moved files free their names for others; linked ones keep them.
+	taken := make(map[string]string)
+	for old, name := range renames {
+		if other, ok := taken[name]; ok {
+			return nil, fmt.Errorf("%s and %s would both be named %s", other, old, name)
+		}
+		taken[name] = old
+		if _, moving := renames[name]; moving && !flagRenameLink {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(flagOutDir, filepath.FromSlash(name))); err == nil {
+			return nil, fmt.Errorf("%s: %s already exists", old, name)
+		}
+	}
+	return renames, nil
+}
+
+// moveRenames moves every file to its new name. Files first move to a
+// temporary name beside their new one, so that tiles can take names other
+// tiles are leaving, then into place. Directories left empty are removed.
+func moveRenames(renames map[string]string) error {
+	const tmp = ".rename"
+	dirs := make(map[string]bool)
+	for old, name := range renames {
+		dst := filepath.Join(flagOutDir, filepath.FromSlash(name))
+		if err := ensureDir(filepath.Dir(dst)); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(flagOutDir, filepath.FromSlash(old)), dst+tmp); err != nil {
+			return err
+		}
+		for d := path.Dir(old); d != "."; d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+	for _, name := range renames {
+		dst := filepath.Join(flagOutDir, filepath.FromSlash(name))
+		if err := os.Rename(dst+tmp, dst); err != nil {
+			return err
+		}
+	}
+
+	// Deepest first, so parents are empty once their children are gone.
+	var empty []string
+	for d := range dirs {
+		empty = append(empty, d)
+	}
+	sort.Slice(empty, func(i, j int) bool {
+		return strings.Count(empty[i], "/") > strings.Count(empty[j], "/")
+	})
+	for _, d := range empty {
+		os.Remove(filepath.Join(flagOutDir, filepath.FromSlash(d)))
+	}
+	return nil
+}
+
+// linkRenames hardlinks every file under its new name, copying it where
+// links are not possible.
+func linkRenames(renames map[string]string) error {
+	for old, name := range renames {
+		src := filepath.Join(flagOutDir, filepath.FromSlash(old))
+		dst := filepath.Join(flagOutDir, filepath.FromSlash(name))
+		if err := ensureDir(filepath.Dir(dst)); err != nil {
+			return err
+		}
+		if err := os.Link(src, dst); err == nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err := tiler.WriteFile(dst, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+var (
+	flagRetries      int
+	flagRetryBackoff time.Duration
+)
+
+func init() {
+	flag.IntVar(&flagRetries, "retries", 3, "retry budget per tile for transient write failures")
+	flag.DurationVar(&flagRetryBackoff, "retry-backoff", 100*time.Millisecond, "initial delay between write retries, doubled after each attempt")
+}
+
+// transientErrnos are write errors worth retrying because they usually
+// clear up on their own.
+var transientErrnos = []syscall.Errno{
+	syscall.EAGAIN,
+	syscall.EBUSY,
+	syscall.EINTR,
+	syscall.ETIMEDOUT,
+}
+
+// isTransient reports whether err is likely to succeed if retried.
+func isTransient(err error) bool {
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+// retry calls fn until it succeeds, fails permanently or the retry budget
+// is spent, backing off exponentially between attempts.
+func retry(fn func() error) error {
+	delay := flagRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		if attempt >= flagRetries {
+			return fmt.Errorf("giving up after %d attempts: %v", attempt+1, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// objectStore is a bucket, or container, that push and -upload store the
+// tileset in. Files larger than -part-size are uploaded in parts that
+// CompleteUpload assembles, and an interrupted upload carries on with the
+// parts not stored yet.
+type objectStore interface {
+	// objectKey returns the key of the tileset file name.
+	objectKey(name string) string
+
+	// Put stores data as the object key.
+	Put(key string, data []byte, contentType, cacheControl string) error
+
+	// CreateUpload starts an upload of key in parts and returns its ID.
+	CreateUpload(key, contentType, cacheControl string) (string, error)
+
+	// UploadPart stores part n, counted from 1, of an upload and returns
+	// the tag CompleteUpload identifies it by.
+	UploadPart(key, id string, n int, data []byte) (string, error)
+
+	// CompleteUpload assembles the parts of an upload, given by their tags
+	// in order, into the object, stored with contentType and cacheControl.
+	CompleteUpload(key, id string, tags []string, contentType, cacheControl string) error
+}
+
+// s3Bucket talks to an S3-compatible object store: AWS S3, Google Cloud
+// Storage through its XML API with HMAC keys, MinIO and the like. Requests
+// are signed with AWS Signature Version 4 using the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and, if set, AWS_SESSION_TOKEN environment
+// variables.
+type s3Bucket struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	prefix   string
+
+	key, secret, token string
+
+	// limit paces request bodies to -bandwidth-limit, or is nil.
+	limit *bandwidth
+}
+
+// openBucket parses a destination of the form s3://bucket/prefix,
+// gs://bucket/prefix or az://container/prefix. S3 destinations use
+// -s3-endpoint and -s3-region, Azure ones -azure-endpoint.
+func openBucket(dest string) (objectStore, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	if flagUploadConcurrency < 1 {
+		return nil, errors.New("-upload-concurrency must be at least 1")
+	}
+	if u.Scheme == "az" {
+		return openAzure(u)
+	}
+	b := &s3Bucket{
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		key:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	endpoint := flagS3Endpoint
+	switch u.Scheme {
+	case "s3":
+		b.region = flagS3Region
+		if b.region == "" {
+			b.region = os.Getenv("AWS_REGION")
+		}
+		if b.region == "" {
+			b.region = "us-east-1"
+		}
+		if endpoint == "" {
+			endpoint = "https://s3." + b.region + ".amazonaws.com"
+		}
+	case "gs":
+		b.region = "auto"
+		endpoint = "https://storage.googleapis.com"
+	default:
+		return nil, fmt.Errorf("%s: want s3://bucket/prefix, gs://bucket/prefix or az://container/prefix", dest)
+	}
+	if b.bucket == "" {
+		return nil, fmt.Errorf("%s: no bucket", dest)
+	}
+	if b.key == "" || b.secret == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if b.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	if flagBandwidthLimit > 0 {
+		b.limit = &bandwidth{rate: float64(flagBandwidthLimit)}
+	}
+	return b, nil
+}
+
+// bandwidth paces the bytes sent to one destination to a rate shared by
+// all its connections. Time left unused is not saved up for bursts.
+type bandwidth struct {
+	rate float64 // bytes per second
+
+	mu   sync.Mutex
+	next time.Time // when the bytes let through so far are sent
+}
+
+// bandwidthChunk is the most a paced body sends at once, so that
+// connections take turns rather than each sending a whole part.
+const bandwidthChunk = 16 << 10
+
+// wait blocks until n more bytes may be sent.
+func (l *bandwidth) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	l.mu.Unlock()
+	time.Sleep(start.Sub(now))
+}
+
+// pacedReader reads a request body at the pace of a bandwidth.
+type pacedReader struct {
+	r     io.Reader
+	limit *bandwidth
+}
+
+func (p *pacedReader) Read(buf []byte) (int, error) {
+	if len(buf) > bandwidthChunk {
+		buf = buf[:bandwidthChunk]
+	}
+	n, err := p.r.Read(buf)
+	if n > 0 {
+		p.limit.wait(n)
+	}
+	return n, err
+}
+
+func (p *pacedReader) Close() error { return nil }
+
+// objectKey returns the key of the tileset file name.
+func (b *s3Bucket) objectKey(name string) string {
+	if b.prefix == "" {
+		return name
+	}
+	return b.prefix + "/" + name
+}
+
+// s3Error is an error response from the object store. Azure's have the
+// same shape.
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return http.StatusText(e.Status)
+	}
+	return e.Code + ": " + e.Message
+}
+
+// Timeout reports server errors and throttling as timeouts, so that retry
+// tries the request again.
+func (e *s3Error) Timeout() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+// do sends a signed request for key and returns the response body.
+func (b *s3Bucket) do(method, key string, query url.Values, header http.Header, body []byte) (http.Header, []byte, error) {
+	u := *b.endpoint
+	u.Path = "/" + b.bucket + "/" + key
+	u.RawPath = "/" + s3Escape(b.bucket) + "/" + s3Escape(key)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if b.limit != nil && len(body) > 0 {
+		// ContentLength stays as set for the whole body.
+		req.Body = &pacedReader{bytes.NewReader(body), b.limit}
+		req.GetBody = nil
+	}
+	b.sign(req, u.RawPath, body, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 || bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		if e.Status/100 == 2 {
+			// CompleteMultipartUpload reports some failures with 200 OK.
+			e.Status = http.StatusInternalServerError
+		}
+		return nil, nil, fmt.Errorf("%s %s: %w", method, key, e)
+	}
+	return resp.Header, data, nil
+}
+
+// sign adds the Signature Version 4 headers to req.
+func (b *s3Bucket) sign(req *http.Request, path string, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	stamp := now.Format("20060102T150405Z")
+	day := stamp[:8]
+
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	req.Header.Set("X-Amz-Date", stamp)
+	if b.token != "" {
+		req.Header.Set("X-Amz-Security-Token", b.token)
+	}
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "content-md5" {
+			names = append(names, lk)
+			values[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, n := range names {
+		headers.WriteString(n + ":" + values[n] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, path, req.URL.RawQuery, headers.String(), signed, payload}, "\n")
+	scope := day + "/" + b.region + "/s3/aws4_request"
+	csum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(csum[:])
+
+	k := hmacSum([]byte("AWS4"+b.secret), day)
+	k = hmacSum(k, b.region)
+	k = hmacSum(k, "s3")
+	k = hmacSum(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSum(k, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.key+"/"+scope+", SignedHeaders="+signed+", Signature="+sig)
+}
+
+func hmacSum(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters and
+// the slashes between path segments.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query returns the canonical form of query: sorted, with every key
+// and value escaped and keys without a value followed by =.
+func s3Query(query url.Values) string {
+	var parts []string
+	for k, vs := range query {
+		for _, v := range vs {
+			parts = append(parts, strings.Replace(s3Escape(k), "/", "%2F", -1)+"="+strings.Replace(s3Escape(v), "/", "%2F", -1))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+// Put stores data as the object key.
+func (b *s3Bucket) Put(key string, data []byte, contentType, cacheControl string) error {
+	_, _, err := b.do("PUT", key, nil, objectHeader(contentType, cacheControl), data)
+	return err
+}
+
+// objectHeader returns the headers an object is stored with: its content
+// type and, if not "", the Cache-Control it is served with.
+func objectHeader(contentType, cacheControl string) http.Header {
+	h := http.Header{"Content-Type": {contentType}}
+	if cacheControl != "" {
+		h.Set("Cache-Control", cacheControl)
+	}
+	return h
+}
+
+// CreateUpload starts a multipart upload of key and returns its ID.
+func (b *s3Bucket) CreateUpload(key, contentType, cacheControl string) (string, error) {
+	_, data, err := b.do("POST", key, url.Values{"uploads": {""}}, objectHeader(contentType, cacheControl), nil)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(data, &res); err != nil || res.UploadID == "" {
+		return "", fmt.Errorf("POST %s: no upload ID in response", key)
+	}
+	return res.UploadID, nil
+}
+
+// UploadPart stores part n, counted from 1, of a multipart upload and
+// returns its ETag.
+func (b *s3Bucket) UploadPart(key, id string, n int, data []byte) (string, error) {
+	h, _, err := b.do("PUT", key, url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {id}}, nil, data)
+	if err != nil {
+		return "", err
+	}
+	return h.Get("ETag"), nil
+}
+
+// CompleteUpload assembles the parts of a multipart upload, given by
+// their ETags in order, into the object. Its headers were given to
+// CreateUpload.
+func (b *s3Bucket) CompleteUpload(key, id string, etags []string, contentType, cacheControl string) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var req struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range etags {
+		req.Parts = append(req.Parts, part{i + 1, etag})
+	}
+	body, err := xml.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	_, _, err = b.do("POST", key, url.Values{"uploadId": {id}}, nil, body)
+	return err
+}
+
+// isNoSuchUpload reports whether err means the multipart upload expired
+// or was aborted: on Azure, that its uncommitted blocks were discarded.
+func isNoSuchUpload(err error) bool {
+	var e *s3Error
+	return errors.As(err, &e) && (e.Code == "NoSuchUpload" || e.Code == "InvalidBlockList")
+}
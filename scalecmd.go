@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var flagScaleCmd string
+
+func init() {
+	flag.StringVar(&flagScaleCmd, "scale-cmd", "", "command scaling each level instead of -interp, such as a GPU scaler on render nodes; {in}, {out}, {width} and {height} are substituted")
+}
+
+// checkScaleCmd validates that the -scale-cmd scaler can be found, before
+// any tile is rendered.
+func checkScaleCmd() error {
+	if flagScaleCmd == "" {
+		return nil
+	}
+	args := strings.Fields(flagScaleCmd)
+	if len(args) == 0 {
+		return errors.New("-scale-cmd is empty")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return fmt.Errorf("-scale-cmd: %v", err)
+	}
+	return nil
+}
+
+// scaleByCmd scales img to w×h with the -scale-cmd scaler. Go has no GPU
+// compute of its own, so the image is handed over as a PNG and the PNG
+// the command writes read back; it must be exactly w×h.
+func scaleByCmd(img image.Image, w, h int) (image.Image, error) {
+	in, err := tempFile("scale-*.png")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(in.Name())
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(in, img); err != nil {
+		in.Close()
+		return nil, err
+	}
+	if err := in.Close(); err != nil {
+		return nil, err
+	}
+
+	out := strings.TrimSuffix(in.Name(), ".png") + "-out.png"
+	defer os.Remove(out)
+
+	args := strings.Fields(flagScaleCmd)
+	for i, a := range args {
+		a = strings.Replace(a, "{in}", in.Name(), -1)
+		a = strings.Replace(a, "{out}", out, -1)
+		a = strings.Replace(a, "{width}", strconv.Itoa(w), -1)
+		a = strings.Replace(a, "{height}", strconv.Itoa(h), -1)
+		args[i] = a
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("scale-cmd: %v: %s", err, strings.TrimSpace(string(msg)))
+	}
+
+	scaled, err := readTile(out)
+	if err != nil {
+		return nil, fmt.Errorf("scale-cmd output: %v", err)
+	}
+	if b := scaled.Bounds(); b.Dx() != w || b.Dy() != h {
+		return nil, fmt.Errorf("scale-cmd output is %dx%d, want %dx%d", b.Dx(), b.Dy(), w, h)
+	}
+	return scaled, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+var (
+	flagTMSOut string
+	flagOrigin string
+	flagScheme string
+)
+
+func init() {
+	flag.StringVar(&flagTMSOut, "tms-out", "", "also lay out tiles with TMS (bottom-up) y numbering in this directory, hardlinked to the XYZ tiles")
+	flag.StringVar(&flagScheme, "scheme", "xyz", "y numbering of the tile names: xyz (0 at the top of the world) or tms (0 at the bottom), as TMS servers expect")
+	flag.StringVar(&flagOrigin, "origin", "top-left", "corner of the image that tile 0, 0 of each level is at: top-left or bottom-left, counting rows up from the bottom of the image whatever -p names them")
+}
+
+// tileSource is the bounds of the source being tiled, which the rows of
+// each level are counted from with -origin bottom-left.
+var tileSource image.Rectangle
+
+// checkOrigin validates -origin.
+func checkOrigin() error {
+	switch flagOrigin {
+	case "top-left":
+	case "bottom-left":
+		if flagDZI != "" || flagIIIF != "" {
+			return errors.New("-origin bottom-left cannot be combined with -dzi or -iiif, whose viewers count from the top-left")
+		}
+	default:
+		return fmt.Errorf("invalid -origin %q: want top-left or bottom-left", flagOrigin)
+	}
+	return nil
+}
+
+// checkScheme validates -scheme.
+func checkScheme() error {
+	switch flagScheme {
+	case "xyz":
+	case "tms":
+		switch {
+		case flagTMSOut != "":
+			return errors.New("-scheme tms already names the tiles the way -tms-out would")
+		case flagDZI != "" || flagIIIF != "":
+			return errors.New("-scheme tms cannot be combined with -dzi or -iiif, which number their own tiles")
+		}
+	default:
+		return fmt.Errorf("invalid -scheme %q: want xyz or tms", flagScheme)
+	}
+	return nil
+}
+
+// schemeRow converts between the XYZ row y of a tile at zoom and its row
+// in the -scheme numbering.
+func schemeRow(zoom, y int) int {
+	if flagScheme != "tms" {
+		return y
+	}
+	return 1<<uint(zoom) - 1 - y
+}
+
+// originRow converts between tile row y of a level, counted from the top,
+// and the row counted from the -origin corner.
+func originRow(zoom, y, size int) int {
+	if flagOrigin != "bottom-left" {
+		return y
+	}
+	_, height := levelSize(tileSource, zoom, size)
+	return (height+size-1)/size - 1 - y
+}
+
+// placeTile returns the coordinate tile x, y at zoom of the pyramid is
+// named by: its row counted from the -origin corner, moved by -offset and
+// numbered by -scheme.
+func placeTile(zoom, x, y, size int) (int, int, int) {
+	zoom, x, y = remapTile(zoom, x, originRow(zoom, y, size))
+	return zoom, x, schemeRow(zoom, y)
+}
+
+// linkTMS makes the tile written at path available under its TMS name in
+// the -tms-out tree. Hardlinks keep both layouts from doubling storage;
+// where the trees live on different devices the tile is copied instead.
+func linkTMS(path, dir string, zoom, x, y, size int, data []byte) error {
+	zoom, x, y = remapTile(zoom, x, originRow(zoom, y, size))
+	side := 1 << uint(zoom)
+	dst := filepath.Join(flagTMSOut, dir, tiler.FileName(flagPattern, zoom, x, side-1-y, size))
+
+	if err := ensureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(path, dst); err == nil {
+		return nil
+	}
+	return tiler.WriteFile(dst, data)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// runServe serves tiles of a source image over HTTP, rendering each one
+// the first time it is requested:
+//
+//	tiler serve -listen :8080 [1-n] [filename]
+//
+// Tiles are requested as /{z}/{x}/{y}.{ext} and cached in the output
+// directory under their -p names, so a later run serves them from disk.
+func runServe(args []string) {
+	checkFlags()
+
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: tiler serve [flags] [1-n] [filename]")
+		os.Exit(2)
+	}
+	level := parseLevel(args[0])
+	if len(flagTileSizes) != 1 {
+		log.Fatalln("serve takes a single tile size")
+	}
+	if err := ensureDir(flagOutDir); err != nil {
+		log.Fatal(err)
+	}
+	if flagEncrypt {
+		var err error
+		if tileCipher, err = loadTileKey(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	img, err := loadSource(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	tileSource = img.Bounds()
+
+	s := &tileServer{
+		img:      img,
+		level:    level,
+		size:     flagTileSizes[0],
+		ext:      tileExts[flagEncoding],
+		inflight: make(map[string]chan struct{}),
+	}
+	log.Printf("serving %s on %s as /{z}/{x}/{y}.%s", args[1], flagListen, s.ext)
+	log.Fatal(http.ListenAndServe(flagListen, s))
+}
+
+// tileServer renders and caches the tiles of img up to level.
+type tileServer struct {
+	img   image.Image
+	level int
+	size  int
+	ext   string
+
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+func (s *tileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	z, x, y, ok := s.parsePath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := s.tile(z, x, y)
+	if err != nil {
+		log.Printf("%d/%d/%d: %v", z, x, y, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	etag := ETag(data)
+	w.Header().Set("ETag", etag)
+	if cc := cacheControl(cacheTTL(z)); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+	http.ServeContent(w, r, "tile."+s.ext, time.Time{}, bytes.NewReader(data))
+}
+
+// parsePath returns the tile requested by a /{z}/{x}/{y}.{ext} path, with
+// its row counted from the top whatever -scheme and -origin.
+func (s *tileServer) parsePath(p string) (z, x, y int, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if len(parts) != 3 || !strings.HasSuffix(parts[2], "."+s.ext) {
+		return 0, 0, 0, false
+	}
+	parts[2] = strings.TrimSuffix(parts[2], "."+s.ext)
+	var n [3]int
+	for i, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 {
+			return 0, 0, 0, false
+		}
+		n[i] = v
+	}
+	z, x, y = n[0], n[1], n[2]
+	if z > s.level {
+		return 0, 0, 0, false
+	}
+	y = originRow(z, schemeRow(z, y), s.size)
+	if !image.Pt(x, y).In(levelTiles(s.img.Bounds(), z, s.size)) {
+		return 0, 0, 0, false
+	}
+	return z, x, y, true
+}
+
+// tile returns the encoded tile z/x/y from the cache, rendering it if it
+// is not there yet. Concurrent requests for a tile render it once.
+func (s *tileServer) tile(z, x, y int) ([]byte, error) {
+	name := tileName("", z, x, y, s.size)
+	path := filepath.Join(flagOutDir, name)
+
+	for {
+		s.mu.Lock()
+		wait, busy := s.inflight[name]
+		if !busy {
+			s.inflight[name] = make(chan struct{})
+		}
+		s.mu.Unlock()
+		if !busy {
+			break
+		}
+		<-wait
+	}
+	defer func() {
+		s.mu.Lock()
+		close(s.inflight[name])
+		delete(s.inflight, name)
+		s.mu.Unlock()
+	}()
+
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if tileCipher != nil {
+			return tileCipher.Open(name, data)
+		}
+		return data, nil
+	}
+
+	dst := s.render(z, x, y)
+	if watermark != nil {
+		dst = stampWatermark(dst)
+	}
+	buf := getBuffer()
+	defer tileBuffers.Put(buf)
+	tile := image.Image(dst)
+	if flagEncoding == "png" {
+		tile = pngColor(dst, flagPNGColor.For(z))
+	}
+	if err := encodeLimited(buf, tile, flagEncoding, budget.Quality()); err != nil {
+		return nil, err
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+
+	if err := output.Mkdir(filepath.Dir(name)); err != nil {
+		return nil, err
+	}
+	if err := output.WriteTile(name, sealTile(name, data)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// render draws tile x, y of level z straight from the source, sampling
+// only the part of it the tile covers.
+func (s *tileServer) render(z, x, y int) *image.RGBA {
+	b := s.img.Bounds()
+	width, height := levelSize(b, z, s.size)
+	sx, sy := float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy())
+
+	// src2dst maps source pixels onto the tile.
+	m := f64.Aff3{
+		sx, 0, -float64(x*s.size) - sx*float64(b.Min.X),
+		0, sy, -float64(y*s.size) - sy*float64(b.Min.Y),
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, s.size, s.size))
+	if edgeFill.color != nil {
+		// Transform only draws over the part of the tile the source covers.
+		draw.Draw(dst, dst.Rect, image.NewUniform(*edgeFill.color), image.Point{}, draw.Src)
+	}
+	interpKernel(z).Transform(dst, m, s.img, b, draw.Src, nil)
+	return dst
+}
+
+// interpKernel returns the x/image sampler closest to the -interp
+// function of zoom, for drawing tiles from part of a source.
+func interpKernel(zoom int) draw.Interpolator {
+	switch flagInterpFunc.For(zoom) {
+	case "NearestNeighbor":
+		return draw.NearestNeighbor
+	case "Bilinear":
+		return draw.BiLinear
+	}
+	return draw.CatmullRom
+}
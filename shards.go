@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+var flagZipShards string
+
+func init() {
+	flag.StringVar(&flagZipShards, "zip-shards", "", "write the tiles into one ZIP archive per zoom range in the output directory, e.g. 0-5,6-8,9-12 for z0-5.zip, z6-8.zip and z9-12.zip, indexed by shards.json")
+}
+
+// shardIndex is the name of the index of the shards in the output
+// directory.
+const shardIndex = "shards.json"
+
+// shardWriter stores tiles in ZIP archives by zoom, so a restore of some
+// levels only needs their archives. Files without a zoom, such as the
+// missing tile, go into other.zip. Archives are only created once they
+// receive a file.
+type shardWriter struct {
+	zoom   *regexp.Regexp
+	shards []*shard
+	other  *shard
+}
+
+// shard is one archive of a shardWriter.
+type shard struct {
+	Archive string `json:"archive"`
+	Zooms   string `json:"zooms,omitempty"`
+	Tiles   int    `json:"tiles"`
+	Bytes   int64  `json:"bytes"`
+
+	first, last int
+	mu          sync.Mutex
+	zip         *zipWriter
+}
+
+// openShards sets up the archives of -zip-shards.
+func openShards(ranges string) (*shardWriter, error) {
+	zoom, err := zoomRegexp(flagPattern)
+	if err != nil {
+		return nil, err
+	}
+	s := &shardWriter{zoom: zoom, other: &shard{Archive: "other.zip"}}
+	for _, r := range strings.Split(ranges, ",") {
+		first, last, err := parseZoomRange(strings.TrimSpace(r))
+		if err != nil {
+			return nil, fmt.Errorf("-zip-shards: %v", err)
+		}
+		for _, sh := range s.shards {
+			if first <= sh.last && last >= sh.first {
+				return nil, fmt.Errorf("-zip-shards: zooms %s overlap %s", r, sh.Zooms)
+			}
+		}
+		zooms := strconv.Itoa(first)
+		if last != first {
+			zooms += "-" + strconv.Itoa(last)
+		}
+		s.shards = append(s.shards, &shard{Archive: "z" + zooms + ".zip", Zooms: zooms, first: first, last: last})
+	}
+	return s, nil
+}
+
+// zoomRegexp returns a regexp capturing the zoom of the tiles and their
+// companion files, such as UTFGrids, named by pattern below any directory.
+func zoomRegexp(pattern string) (*regexp.Regexp, error) {
+	p := filepath.ToSlash(pattern)
+	p = strings.TrimSuffix(p, path.Ext(p))
+	if strings.Count(p, "{zoom}") != 1 {
+		return nil, fmt.Errorf("-zip-shards needs {zoom} once in -p %q", pattern)
+	}
+	s := regexp.QuoteMeta(p)
+	s = strings.Replace(s, regexp.QuoteMeta("{zoom}"), "([0-9]+)", 1)
+	for _, v := range []string{"{x}", "{y}", "{size}"} {
+		s = strings.Replace(s, regexp.QuoteMeta(v), "[0-9]+", -1)
+	}
+	// Batch runs substitute {name} per input.
+	s = regexp.MustCompile(`\\\{[a-z]+\\\}`).ReplaceAllString(s, `[^/]*`)
+	return regexp.Compile(`(?:^|/)` + s + `(?:\.[^/]*)?$`)
+}
+
+// Mkdir does nothing: entry names carry their directories.
+func (*shardWriter) Mkdir(string) error { return nil }
+
+func (s *shardWriter) WriteTile(name string, data []byte) error {
+	sh := s.other
+	if m := s.zoom.FindStringSubmatch(filepath.ToSlash(name)); m != nil {
+		z, _ := strconv.Atoi(m[1])
+		sh = nil
+		for _, c := range s.shards {
+			if c.first <= z && z <= c.last {
+				sh = c
+				break
+			}
+		}
+		if sh == nil {
+			return fmt.Errorf("%s: zoom %d is in no -zip-shards range", name, z)
+		}
+	}
+
+	sh.mu.Lock()
+	if sh.zip == nil {
+		var err error
+		if sh.zip, err = openZip(filepath.Join(flagOutDir, sh.Archive)); err != nil {
+			sh.mu.Unlock()
+			return err
+		}
+	}
+	sh.Tiles++
+	sh.Bytes += int64(len(data))
+	zw := sh.zip
+	sh.mu.Unlock()
+	return zw.WriteTile(name, data)
+}
+
+// Close finishes every archive and writes the index listing them.
+func (s *shardWriter) Close() error {
+	var index struct {
+		Shards []*shard `json:"shards"`
+	}
+	for _, sh := range append(s.shards, s.other) {
+		if sh.zip == nil {
+			continue
+		}
+		if err := sh.zip.Close(); err != nil {
+			return err
+		}
+		index.Shards = append(index.Shards, sh)
+	}
+	data, err := json.MarshalIndent(&index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tiler.WriteFile(filepath.Join(flagOutDir, shardIndex), append(data, '\n'))
+}
+
+// shardOut is the writer for -zip-shards, closed by finishRun.
+var shardOut *shardWriter
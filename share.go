@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+// resourceShare is the part of the daemon's resources a job may use.
+type resourceShare struct {
+	CPUs   int
+	Memory int64 // 0 for no limit
+}
+
+func (s resourceShare) Write(path string) error {
+	return tiler.WriteFile(path, []byte(fmt.Sprintf("%d %d\n", s.CPUs, s.Memory)))
+}
+
+// followShare applies the resource share the daemon assigns this run, and
+// keeps applying it as other jobs start and finish.
+func followShare() {
+	path := os.Getenv("TILER_SHARE_FILE")
+	if path == "" {
+		return
+	}
+
+	var current resourceShare
+	apply := func() {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+		var s resourceShare
+		if _, err := fmt.Sscanf(string(b), "%d %d", &s.CPUs, &s.Memory); err != nil {
+			log.Printf("%s: %v", path, err)
+			return
+		}
+		if s == current {
+			return
+		}
+		runtime.GOMAXPROCS(s.CPUs)
+		if s.Memory > 0 {
+			debug.SetMemoryLimit(s.Memory)
+		}
+		current = s
+	}
+
+	apply()
+	go func() {
+		for range time.Tick(2 * time.Second) {
+			apply()
+		}
+	}()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+var (
+	flagSignKey   string
+	flagVerifyKey string
+)
+
+func init() {
+	flag.StringVar(&flagSignKey, "sign-key", "", "sign the -manifest with the ed25519 private key in this PEM file")
+	flag.StringVar(&flagVerifyKey, "verify-key", "", "verify: check the -manifest signature against the ed25519 public key in this PEM file")
+}
+
+// ManifestSignature is stored next to the manifest, in a file named after
+// it with a .sig suffix. Signature is the ed25519 signature of the
+// manifest file's bytes exactly as written; since the manifest holds the
+// ETag of every tile, a valid signature vouches for the whole tileset.
+type ManifestSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	Signature []byte `json:"signature"`
+}
+
+// signer signs the manifest when -sign-key is set.
+var signer ed25519.PrivateKey
+
+// loadSignKey reads a PKCS #8 ed25519 private key, as written by
+// "openssl genpkey -algorithm ed25519".
+func loadSignKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return priv, nil
+}
+
+// loadVerifyKey reads a PKIX ed25519 public key, as written by
+// "openssl pkey -pubout".
+func loadVerifyKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return pub, nil
+}
+
+func readPEM(path, kind string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != kind {
+		return nil, fmt.Errorf("%s: no PEM %s block", path, kind)
+	}
+	return block.Bytes, nil
+}
+
+// signingKeyID identifies pub without the reader having to compare keys.
+func signingKeyID(pub ed25519.PublicKey) string {
+	id := sha256.Sum256(pub)
+	return hex.EncodeToString(id[:8])
+}
+
+// signManifest writes the signature of the manifest at path to path.sig.
+func signManifest(path string, key ed25519.PrivateKey) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sig, err := json.MarshalIndent(&ManifestSignature{
+		Algorithm: "ed25519",
+		KeyID:     signingKeyID(key.Public().(ed25519.PublicKey)),
+		Signature: ed25519.Sign(key, data),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tiler.WriteFile(path+".sig", append(sig, '\n'))
+}
+
+// checkSignature verifies that the manifest data read from path was signed
+// by the owner of pub.
+func checkSignature(path string, data []byte, pub ed25519.PublicKey) error {
+	raw, err := ioutil.ReadFile(path + ".sig")
+	if err != nil {
+		return err
+	}
+	var sig ManifestSignature
+	if err := json.Unmarshal(raw, &sig); err != nil {
+		return fmt.Errorf("%s.sig: %v", path, err)
+	}
+	if sig.Algorithm != "ed25519" {
+		return fmt.Errorf("%s.sig: unsupported algorithm %q", path, sig.Algorithm)
+	}
+	if id := signingKeyID(pub); sig.KeyID != id {
+		return fmt.Errorf("manifest was signed with key %s, not %s", sig.KeyID, id)
+	}
+	if !ed25519.Verify(pub, data, sig.Signature) {
+		return errors.New("manifest signature does not match")
+	}
+	return nil
+}
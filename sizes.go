@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sizeList is a comma separated list of tile sizes given to -size.
+type sizeList []int
+
+func (l *sizeList) String() string {
+	s := make([]string, len(*l))
+	for i, n := range *l {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *sizeList) Set(v string) error {
+	var sizes sizeList
+	seen := make(map[int]bool)
+	for _, p := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return err
+		}
+		if seen[n] {
+			return fmt.Errorf("tile size %d given twice", n)
+		}
+		seen[n] = true
+		sizes = append(sizes, n)
+	}
+	// Largest first, so smaller sizes can be derived from the larger
+	// resized level rather than from the source again.
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+	*l = sizes
+	return nil
+}
+
+// sizeDir returns the directory tiles of tileSize are written to. When
+// several sizes are generated and the pattern does not distinguish them
+// with {size}, each size gets its own tree.
+func sizeDir(dir string, tileSize int) string {
+	if len(flagTileSizes) > 1 && !strings.Contains(flagPattern, "{size}") {
+		return filepath.Join(dir, strconv.Itoa(tileSize))
+	}
+	return dir
+}
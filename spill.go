@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"os"
+	"sync"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/draw"
+)
+
+var flagSpill bool
+
+func init() {
+	flag.BoolVar(&flagSpill, "spill", false, "keep resized levels in memory-mapped scratch files instead of RAM")
+}
+
+// spillResize scales from to a w×h level held in a memory-mapped scratch
+// file, so the level is never also held in RAM. It scales as the level
+// would be in memory: with interp, rows×rows windows at a time on the
+// worker pool, or with the -downsample kernel down if it is not nil. The
+// returned function unmaps the level once it is done.
+func spillResize(from image.Image, w, h, rows int, interp resize.InterpolationFunction, down *draw.Kernel) (image.Image, func()) {
+	r := image.Rect(0, 0, w, h)
+	if down != nil {
+		pix, release, err := spillPix(4 * w * h)
+		if err != nil {
+			abortRun(err)
+		}
+		dst := &image.RGBA{Pix: pix, Stride: 4 * w, Rect: r}
+		down.Scale(dst, r, from, from.Bounds(), draw.Src, nil)
+		return dst, release
+	}
+
+	s := newLevelSampler(from, from.Bounds(), w, h, interp)
+	if s.same {
+		return from, func() {}
+	}
+	pix, release, err := spillPix(s.pixBytes(r))
+	if err != nil {
+		abortRun(err)
+	}
+	dst := s.newImage(r, pix)
+
+	var wg sync.WaitGroup
+	for y := 0; y < h; y += rows {
+		for x := 0; x < w; x += rows {
+			win := image.Rect(x, y, x+rows, y+rows).Intersect(r)
+			wg.Add(1)
+			workers.Go(func() {
+				defer wg.Done()
+				s.renderInto(dst, from, win)
+			})
+		}
+	}
+	wg.Wait()
+	return dst, release
+}
+
+// spillPix returns size zeroed bytes in a memory-mapped scratch file. The
+// file is removed as soon as it is mapped, so it is reclaimed however the
+// run ends.
+func spillPix(size int) ([]byte, func(), error) {
+	f, err := tempFile("spill-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(int64(size)); err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	pix, err := mmapFile(f, size)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	os.Remove(f.Name())
+	return pix, func() { munmap(pix) }, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var flagCheckStale bool
+
+func init() {
+	flag.BoolVar(&flagCheckStale, "check-stale", false, "report whether the sources recorded in the -manifest of the output directory have changed, instead of tiling")
+}
+
+// Fingerprint identifies the contents of a source file. For montages the
+// checksum also covers every image the layout references.
+type Fingerprint struct {
+	Checksum string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+}
+
+// fingerprint returns the fingerprint of the source at path, which may be
+// a remote URL.
+func fingerprint(path string) (Fingerprint, error) {
+	if isRemote(path) {
+		local, err := fetchSource(path)
+		if err != nil {
+			return Fingerprint{}, err
+		}
+		path = local
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+
+	files, err := sourceFiles(path)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	h := sha256.New()
+	for _, file := range files {
+		if err := hashFile(h, file); err != nil {
+			return Fingerprint{}, err
+		}
+	}
+
+	return Fingerprint{
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime().UTC(),
+	}, nil
+}
+
+// stale reports why the source at path no longer matches want, or "" if
+// it still does. Unchanged size and mtime are trusted without hashing,
+// except for montages whose referenced images may have changed.
+func stale(path string, want Fingerprint) string {
+	if !isRemote(path) && filepath.Ext(path) != ".montage" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err.Error()
+		}
+		if fi.Size() == want.Size && fi.ModTime().Equal(want.ModTime) {
+			return ""
+		}
+	}
+
+	got, err := fingerprint(path)
+	if err != nil {
+		return err.Error()
+	}
+	if got.Checksum != want.Checksum {
+		return "contents changed"
+	}
+	return ""
+}
+
+// checkStale compares every source recorded in the manifest against its
+// current contents and exits with status 1 if any has changed.
+func checkStale() {
+	if flagManifest == "" {
+		fmt.Fprintln(os.Stderr, "-check-stale requires -manifest")
+		os.Exit(2)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(flagOutDir, flagManifest))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		log.Fatal(err)
+	}
+
+	var paths []string
+	for path := range m.Sources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	status := 0
+	for _, path := range paths {
+		src := m.Sources[path]
+		reason := "no fingerprint recorded"
+		if src.Checksum != "" {
+			reason = stale(path, src.Fingerprint)
+		}
+		if reason == "" {
+			fmt.Printf("%s: up to date\n", path)
+			continue
+		}
+		fmt.Printf("%s: stale (%s)\n", path, reason)
+		status = 1
+	}
+	os.Exit(status)
+}
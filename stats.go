@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+var flagSummary bool
+
+func init() {
+	flag.BoolVar(&flagSummary, "summary", false, "print per-zoom tile size statistics when the run finishes")
+}
+
+// runStats counts the tiles written and their encoded size. Only with
+// -summary does it keep the size of every tile, per zoom, as a long run
+// writes millions of them.
+type runStats struct {
+	mu    sync.Mutex
+	count int
+	total int64
+	sizes map[int][]int
+}
+
+var stats = runStats{sizes: make(map[int][]int)}
+
+func (s *runStats) Add(zoom, size int) {
+	s.mu.Lock()
+	s.count++
+	s.total += int64(size)
+	if flagSummary {
+		s.sizes[zoom] = append(s.sizes[zoom], size)
+	}
+	s.mu.Unlock()
+}
+
+// Totals returns the number of tiles recorded and their combined size.
+func (s *runStats) Totals() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count, s.total
+}
+
+// Print writes a table of tile count, total bytes and size percentiles
+// for each zoom level.
+func (s *runStats) Print(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var zooms []int
+	for z := range s.sizes {
+		zooms = append(zooms, z)
+	}
+	sort.Ints(zooms)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "zoom\ttiles\tbytes\tp50\tp90\tp99\tmax\t")
+
+	var count, total int
+	for _, z := range zooms {
+		sizes := s.sizes[z]
+		sort.Ints(sizes)
+
+		sum := 0
+		for _, n := range sizes {
+			sum += n
+		}
+		count += len(sizes)
+		total += sum
+
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n", z, len(sizes), sum,
+			percentile(sizes, 50), percentile(sizes, 90), percentile(sizes, 99), sizes[len(sizes)-1])
+	}
+	fmt.Fprintf(tw, "all\t%d\t%d\t\t\t\t\t\n", count, total)
+	tw.Flush()
+}
+
+// percentile returns the p-th percentile of sorted using the nearest-rank
+// method.
+func percentile(sorted []int, p int) int {
+	i := (p*len(sorted) + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1]
+}
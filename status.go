@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+)
+
+var flagStatusAddr string
+
+func init() {
+	flag.StringVar(&flagStatusAddr, "status-addr", "", "serve the progress of the run as JSON on this local address, e.g. 127.0.0.1:8701, for tooling to poll")
+}
+
+// runStatus is the progress of the run served on -status-addr.
+type runStatus struct {
+	runSummary
+	Done     int           `json:"done"`
+	Expected int           `json:"expected"`
+	Percent  float64       `json:"percent"`
+	ETA      float64       `json:"eta_seconds,omitempty"`
+	Levels   []levelStatus `json:"levels"`
+}
+
+// levelStatus is the progress of one level of a runStatus.
+type levelStatus struct {
+	Zoom  int `json:"zoom"`
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// statusStarted is set once the endpoint is listening, as batch runs
+// start a run for every input.
+var statusStarted bool
+
+// startStatus starts serving the progress on -status-addr, if set.
+func startStatus() {
+	if flagStatusAddr == "" || statusStarted {
+		return
+	}
+	l, err := net.Listen("tcp", flagStatusAddr)
+	if err != nil {
+		log.Fatalf("-status-addr: %v", err)
+	}
+	statusStarted = true
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/status" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, currentStatus())
+	})
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("-status-addr: %v", err)
+		}
+	}()
+	log.Printf("serving progress on http://%s/status", l.Addr())
+}
+
+// currentStatus reports the run so far.
+func currentStatus() runStatus {
+	s := runStatus{runSummary: summarize(nil)}
+	s.Status = "running"
+
+	progress.mu.Lock()
+	s.Expected, s.Done = progress.total, progress.done
+	for z, l := range progress.levels {
+		if l.total > 0 {
+			s.Levels = append(s.Levels, levelStatus{z, l.done, l.total})
+		}
+	}
+	progress.mu.Unlock()
+
+	if s.Expected > 0 {
+		s.Percent = 100 * float64(s.Done) / float64(s.Expected)
+	}
+	if s.Done > 0 && s.Done < s.Expected {
+		s.ETA = s.Duration * float64(s.Expected-s.Done) / float64(s.Done)
+	}
+	return s
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"image"
+	"log"
+	"os"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+var flagStream byteSize
+
+func init() {
+	flag.Var(&flagStream, "stream", "tile striped TIFF sources in bands of rows holding about this much memory, e.g. 2G, instead of decoding them whole (0 disables)")
+}
+
+// A streamed source is never decoded whole. The deepest level is rendered
+// a band of tile rows at a time from the source strips it covers, and
+// every shallower level is halved from the rows of the level below it as
+// they are produced, holding less than two tile rows of each level.
+
+// tileStream renders the levels of a striped TIFF band by band.
+type tileStream struct {
+	f      *os.File
+	layout *stripLayout
+	level  int
+	size   int
+	dir    string
+
+	// pending holds, for each level z, rows of level z+1 not yet halved
+	// into whole tile rows of z.
+	pending []*image.RGBA
+
+	// overview is level 0, kept for the manifest.
+	overview *image.RGBA
+}
+
+// openStream opens path for -stream, or returns nil if it is not a
+// striped TIFF that can be streamed.
+func openStream(path string) (*tileStream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l, ok := readStripLayout(f, fi.Size())
+	if !ok {
+		f.Close()
+		return nil, nil
+	}
+	return &tileStream{f: f, layout: l}, nil
+}
+
+// checkStreamFlags rejects the flags -stream cannot honour, which need
+// the whole source or only regenerate part of a tileset.
+func checkStreamFlags() {
+	switch {
+	case len(flagTileSizes) != 1:
+		log.Fatalln("-stream takes a single tile size")
+	case flagFlatField != "" || flagVignette != 0 || flagBands != "" || flagBandMath != "" ||
+		flagLens != "" || flagAffine != "" || flagRotate != 0 || flagColorKey != "":
+		log.Fatalln("-stream cannot apply source corrections, which need the whole image")
+	case flagRegion != "" || flagDiff != "" || flagAppend:
+		log.Fatalln("-stream cannot be combined with -region, -diff or -append")
+	case flagDownsample != "" && flagDownsample != "box":
+		log.Fatalln("-stream halves each level by averaging blocks of 2x2 pixels, so it only takes -downsample box")
+	case flagDZI != "" || flagIIIF != "" || flagAnimate || flagSuperRes != "" || flagCacheDir != "" || flagKeepAspect:
+		log.Fatalln("-stream only writes square levels, without -superres or -cache-dir")
+	}
+}
+
+// tileLevels writes levels 0 to level of the source.
+func (s *tileStream) tileLevels(level int, dir string) {
+	defer s.f.Close()
+	s.level, s.size, s.dir = level, flagTileSizes[0], dir
+	s.pending = make([]*image.RGBA, level)
+	l := s.layout
+	prepareLevels(image.Rect(0, 0, l.width, l.height), level, dir)
+
+	side := 1 << uint(level)
+	levelPx := side * s.size
+	srcRows := float64(l.height) / float64(levelPx)
+
+	// Each band holds its tile rows of the deepest level and the source
+	// rows under them. The pending rows of the shallower levels and the
+	// strips straddling the band edges come on top.
+	rowBytes := 4 * (levelPx*s.size + int(float64(l.width)*float64(s.size)*srcRows))
+	fixed := 4 * (2*levelPx*s.size + l.width*(2*l.rowsPerStrip+2*margin(srcRows)))
+	rows := (int(flagStream) - fixed) / rowBytes
+	if rows < 1 {
+		log.Printf("-stream: a band of one tile row needs about %d bytes, more than %d", fixed+rowBytes, int64(flagStream))
+		rows = 1
+	}
+	if rows > side {
+		rows = side
+	}
+
+	for ty := 0; ty < side; ty += rows {
+		n := rows
+		if ty+n > side {
+			n = side - ty
+		}
+		band, err := s.renderBand(ty, n)
+		if err != nil {
+			abortRun(err)
+		}
+		s.emit(level, band)
+	}
+}
+
+// margin returns how many source rows beyond a band the sampling kernel
+// reaches when each level row covers scale source rows.
+func margin(scale float64) int {
+	if scale < 1 {
+		scale = 1
+	}
+	return int(2*scale) + 2
+}
+
+// renderBand renders n tile rows of the deepest level from tile row ty,
+// drawing each tile on the worker pool from the source rows it covers.
+func (s *tileStream) renderBand(ty, n int) (*image.RGBA, error) {
+	l := s.layout
+	levelPx := (1 << uint(s.level)) * s.size
+	sx := float64(levelPx) / float64(l.width)
+	sy := float64(levelPx) / float64(l.height)
+
+	m := margin(1 / sy)
+	y0 := int(float64(ty*s.size)/sy) - m
+	y1 := int(float64((ty+n)*s.size)/sy) + 1 + m
+	if y0 < 0 {
+		y0 = 0
+	}
+	if y1 > l.height {
+		y1 = l.height
+	}
+	src, err := l.decodeRows(s.f, y0, y1)
+	if err != nil {
+		return nil, err
+	}
+
+	band := image.NewRGBA(image.Rect(0, ty*s.size, levelPx, (ty+n)*s.size))
+	tiles := image.Rect(0, ty, 1<<uint(s.level), ty+n)
+	sdir := sizeDir(s.dir, s.size)
+	kernel := interpKernel(s.level)
+	cropLevel(jobCtx, tiles, s.size, s.level, sdir, func(ctx context.Context, x, y int) error {
+		r := image.Rect(x*s.size, y*s.size, (x+1)*s.size, (y+1)*s.size)
+		kernel.Transform(band.SubImage(r).(*image.RGBA), f64.Aff3{sx, 0, 0, 0, sy, 0}, src, src.Bounds(), draw.Src, nil)
+		if !zoomWanted(s.level) {
+			return nil
+		}
+		return saveCrop(ctx, band, s.size, x, y, s.level, sdir)
+	})
+	return band, nil
+}
+
+// emit records band, whole tile rows of level z, and passes it on to be
+// halved into level z-1. The tiles of the deepest level are already
+// written by renderBand.
+func (s *tileStream) emit(z int, band *image.RGBA) {
+	if z < s.level && zoomWanted(z) {
+		tiles := image.Rect(0, band.Rect.Min.Y/s.size, band.Rect.Dx()/s.size, band.Rect.Max.Y/s.size)
+		sdir := sizeDir(s.dir, s.size)
+		cropLevel(jobCtx, tiles, s.size, z, sdir, func(ctx context.Context, x, y int) error {
+			return saveCrop(ctx, band, s.size, x, y, z, sdir)
+		})
+	}
+	if z == 0 {
+		s.overview = band
+		return
+	}
+
+	// Halve as many whole tile rows of level z-1 as the rows so far make.
+	rows := appendRows(s.pending[z-1], band)
+	whole := rows.Rect.Dy() / (2 * s.size) * 2 * s.size
+	if whole == 0 {
+		s.pending[z-1] = rows
+		return
+	}
+	done := rows.SubImage(image.Rect(rows.Rect.Min.X, rows.Rect.Min.Y, rows.Rect.Max.X, rows.Rect.Min.Y+whole)).(*image.RGBA)
+	s.pending[z-1] = nil
+	if whole < rows.Rect.Dy() {
+		s.pending[z-1] = appendRows(nil, rows.SubImage(image.Rect(rows.Rect.Min.X, done.Rect.Max.Y, rows.Rect.Max.X, rows.Rect.Max.Y)).(*image.RGBA))
+	}
+	s.emit(z-1, halve(done))
+}
+
+// appendRows returns the rows of a followed by those of b, which must be
+// as wide and start where a ends. a may be nil.
+func appendRows(a, b *image.RGBA) *image.RGBA {
+	r := b.Rect
+	if a != nil {
+		r.Min.Y = a.Rect.Min.Y
+	}
+	m := image.NewRGBA(r)
+	if a != nil {
+		draw.Draw(m, a.Rect, a, a.Rect.Min, draw.Src)
+	}
+	draw.Draw(m, b.Rect, b, b.Rect.Min, draw.Src)
+	return m
+}
+
+// halve averages each 2x2 block of src, whose bounds start at even
+// coordinates, into one pixel. Averaging whole blocks, unlike a wider
+// kernel, reads nothing beyond the rows a band holds.
+func halve(src *image.RGBA) *image.RGBA {
+	r := src.Rect
+	dst := image.NewRGBA(image.Rect(r.Min.X/2, r.Min.Y/2, r.Max.X/2, r.Max.Y/2))
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		top := src.Pix[2*y*src.Stride:]
+		bottom := src.Pix[(2*y+1)*src.Stride:]
+		row := dst.Pix[y*dst.Stride:]
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			for c := 0; c < 4; c++ {
+				i := 8*x + c
+				sum := int(top[i]) + int(top[i+4]) + int(bottom[i]) + int(bottom[i+4])
+				row[4*x+c] = uint8((sum + 2) / 4)
+			}
+		}
+	}
+	return dst
+}
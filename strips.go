@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+
+	"golang.org/x/image/tiff/lzw"
+)
+
+// Striped TIFFs compress every band of rows on its own, so their strips
+// are decoded concurrently on the worker pool. Only the common layouts
+// are handled here; anything else, and single-strip files, go through the
+// image package as before.
+
+// TIFF tags read by decodeStrips.
+const (
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagNewSubfileType  = 254
+	tagPhotometric     = 262
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagPlanarConfig    = 284
+	tagPredictor       = 317
+	tagTileWidth       = 322
+	tagSubIFDs         = 330
+	tagExtraSamples    = 338
+)
+
+// stripLayout describes a striped TIFF that decodeStrips can decode.
+type stripLayout struct {
+	width, height int
+	samples       int
+	rowsPerStrip  int
+	compression   uint32
+	predictor     bool
+	alpha         uint32 // ExtraSamples: 1 premultiplied, 2 straight
+	offsets       []uint32
+	counts        []uint32
+}
+
+// decodeStrips decodes the TIFF r, of size bytes, strip by strip in
+// parallel. It reports false, without reading the image, if r is not a
+// TIFF of more than one strip in a layout it handles.
+func decodeStrips(r io.ReaderAt, size int64) (image.Image, bool, error) {
+	l, ok := readStripLayout(r, size)
+	if !ok {
+		return nil, false, nil
+	}
+	img, err := l.decodeRows(r, 0, l.height)
+	return img, true, err
+}
+
+// decodeRows decodes the strips holding rows y0 to y1 of the image in
+// parallel. The image returned covers those strips, so it may extend
+// beyond y0 and y1.
+func (l *stripLayout) decodeRows(r io.ReaderAt, y0, y1 int) (image.Image, error) {
+	first, last := y0/l.rowsPerStrip, (y1-1)/l.rowsPerStrip
+	top := first * l.rowsPerStrip
+	bottom := (last + 1) * l.rowsPerStrip
+	if bottom > l.height {
+		bottom = l.height
+	}
+
+	stride := l.width * l.samples
+	pix := make([]byte, stride*(bottom-top))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for i := first; i <= last; i++ {
+		i := i
+		wg.Add(1)
+		workers.Go(func() {
+			defer wg.Done()
+			sy0 := i*l.rowsPerStrip - top
+			sy1 := sy0 + l.rowsPerStrip
+			if sy1 > bottom-top {
+				sy1 = bottom - top
+			}
+			if err := l.decodeStrip(r, i, pix[sy0*stride:sy1*stride]); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("strip %d: %v", i, err)
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return l.image(pix, image.Rect(0, top, l.width, bottom)), nil
+}
+
+// readStripLayout reads the first IFD of the TIFF r and reports whether
+// decodeStrips handles its layout: 8-bit gray, RGB or RGBA, chunky and
+// striped, uncompressed or compressed with LZW, Deflate or PackBits.
+func readStripLayout(r io.ReaderAt, size int64) (*stripLayout, bool) {
+	order, first, ok := readTIFFHeader(r)
+	if !ok {
+		return nil, false
+	}
+	tags, _, ok := readIFD(r, size, order, first)
+	if !ok {
+		return nil, false
+	}
+	return newStripLayout(tags, 2)
+}
+
+// readTIFFHeader returns the byte order of the TIFF r and the offset of
+// its first IFD.
+func readTIFFHeader(r io.ReaderAt) (binary.ByteOrder, int64, bool) {
+	var head [8]byte
+	if _, err := r.ReadAt(head[:], 0); err != nil {
+		return nil, 0, false
+	}
+	var order binary.ByteOrder
+	switch string(head[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	return order, int64(order.Uint32(head[4:])), true
+}
+
+// readIFD returns the SHORT and LONG tags of the IFD at off and the offset
+// of the next IFD, which is 0 after the last.
+func readIFD(r io.ReaderAt, size int64, order binary.ByteOrder, off int64) (map[uint16][]uint32, int64, bool) {
+	var n [2]byte
+	if _, err := r.ReadAt(n[:], off); err != nil {
+		return nil, 0, false
+	}
+	entries := make([]byte, 12*int(order.Uint16(n[:]))+4)
+	if _, err := r.ReadAt(entries, off+2); err != nil {
+		return nil, 0, false
+	}
+
+	tags := make(map[uint16][]uint32)
+	for e := entries; len(e) >= 12; e = e[12:] {
+		vs, err := ifdValues(r, size, order, e)
+		if err != nil {
+			return nil, 0, false
+		}
+		tags[order.Uint16(e)] = vs
+	}
+	next := int64(order.Uint32(entries[len(entries)-4:]))
+	return tags, next, true
+}
+
+// newStripLayout returns the layout of an image with the IFD tags, if
+// decodeStrips handles it and it has at least minStrips strips.
+func newStripLayout(tags map[uint16][]uint32, minStrips int) (*stripLayout, bool) {
+	one := func(tag uint16, def uint32) uint32 {
+		if vs, ok := tags[tag]; ok && len(vs) > 0 {
+			return vs[0]
+		}
+		return def
+	}
+
+	l := &stripLayout{
+		width:        int(one(tagImageWidth, 0)),
+		height:       int(one(tagImageLength, 0)),
+		samples:      int(one(tagSamplesPerPixel, 1)),
+		compression:  one(tagCompression, 1),
+		predictor:    one(tagPredictor, 1) == 2,
+		alpha:        one(tagExtraSamples, 0),
+		offsets:      tags[tagStripOffsets],
+		counts:       tags[tagStripByteCounts],
+		rowsPerStrip: int(one(tagRowsPerStrip, 1<<31-1)),
+	}
+	if l.rowsPerStrip > l.height {
+		l.rowsPerStrip = l.height
+	}
+	if l.width <= 0 || l.height <= 0 || l.rowsPerStrip <= 0 {
+		return nil, false
+	}
+	for _, bits := range tags[tagBitsPerSample] {
+		if bits != 8 {
+			return nil, false
+		}
+	}
+	if _, tiled := tags[tagTileWidth]; tiled || one(tagPlanarConfig, 1) != 1 {
+		return nil, false
+	}
+	switch photometric := one(tagPhotometric, 1); {
+	case photometric == 1 && l.samples == 1:
+	case photometric == 2 && l.samples == 3:
+	case photometric == 2 && l.samples == 4 && (l.alpha == 1 || l.alpha == 2):
+	default:
+		return nil, false
+	}
+	switch l.compression {
+	case 1, 5, 8, 32946, 32773:
+	default:
+		return nil, false
+	}
+	strips := (l.height + l.rowsPerStrip - 1) / l.rowsPerStrip
+	if strips < minStrips || len(l.offsets) != strips || len(l.counts) != strips {
+		return nil, false
+	}
+	return l, true
+}
+
+// ifdValues returns the SHORT, LONG or IFD values of the IFD entry e, which
+// are stored in the entry itself if they fit or elsewhere in the file.
+func ifdValues(r io.ReaderAt, size int64, order binary.ByteOrder, e []byte) ([]uint32, error) {
+	width := 0
+	switch order.Uint16(e[2:]) {
+	case 3:
+		width = 2
+	case 4, 13:
+		width = 4
+	default:
+		return nil, nil
+	}
+	count := int64(order.Uint32(e[4:]))
+	data := e[8:12]
+	if n := count * int64(width); n > 4 {
+		off := int64(order.Uint32(e[8:]))
+		if off+n > size {
+			return nil, errors.New("IFD entry beyond end of file")
+		}
+		data = make([]byte, n)
+		if _, err := r.ReadAt(data, off); err != nil {
+			return nil, err
+		}
+	}
+	vs := make([]uint32, count)
+	for i := range vs {
+		if width == 2 {
+			vs[i] = uint32(order.Uint16(data[2*i:]))
+		} else {
+			vs[i] = order.Uint32(data[4*i:])
+		}
+	}
+	return vs, nil
+}
+
+// decodeStrip decompresses strip i into dst, which holds its rows.
+func (l *stripLayout) decodeStrip(r io.ReaderAt, i int, dst []byte) error {
+	src := make([]byte, l.counts[i])
+	if _, err := r.ReadAt(src, int64(l.offsets[i])); err != nil {
+		return err
+	}
+
+	var rd io.Reader
+	switch l.compression {
+	case 1:
+		rd = bytes.NewReader(src)
+	case 5:
+		lr := lzw.NewReader(bytes.NewReader(src), lzw.MSB, 8)
+		defer lr.Close()
+		rd = lr
+	case 8, 32946:
+		zr, err := zlib.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		rd = zr
+	case 32773:
+		unpacked, err := unpackBits(src, len(dst))
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(unpacked)
+	}
+	if _, err := io.ReadFull(rd, dst); err != nil {
+		return err
+	}
+
+	if l.predictor {
+		stride := l.width * l.samples
+		for row := dst; len(row) >= stride; row = row[stride:] {
+			for x := l.samples; x < stride; x++ {
+				row[x] += row[x-l.samples]
+			}
+		}
+	}
+	return nil
+}
+
+// unpackBits decodes PackBits run-length encoding until n bytes are out.
+func unpackBits(src []byte, n int) ([]byte, error) {
+	dst := make([]byte, 0, n)
+	for len(src) > 0 && len(dst) < n {
+		c := int(int8(src[0]))
+		src = src[1:]
+		switch {
+		case c >= 0:
+			if len(src) < c+1 {
+				return nil, errors.New("truncated PackBits literal")
+			}
+			dst = append(dst, src[:c+1]...)
+			src = src[c+1:]
+		case c != -128:
+			if len(src) < 1 {
+				return nil, errors.New("truncated PackBits run")
+			}
+			for j := 0; j < 1-c; j++ {
+				dst = append(dst, src[0])
+			}
+			src = src[1:]
+		}
+	}
+	return dst, nil
+}
+
+// image wraps the decoded samples pix of the rows rect in the image type
+// x/image/tiff returns for the layout.
+func (l *stripLayout) image(pix []byte, rect image.Rectangle) image.Image {
+	switch {
+	case l.samples == 1:
+		return &image.Gray{Pix: pix, Stride: l.width, Rect: rect}
+	case l.samples == 4 && l.alpha == 1:
+		return &image.RGBA{Pix: pix, Stride: 4 * l.width, Rect: rect}
+	case l.samples == 4:
+		return &image.NRGBA{Pix: pix, Stride: 4 * l.width, Rect: rect}
+	}
+	m := image.NewRGBA(rect)
+	for i, j := 0, 0; i < len(pix); i, j = i+3, j+4 {
+		m.Pix[j], m.Pix[j+1], m.Pix[j+2], m.Pix[j+3] = pix[i], pix[i+1], pix[i+2], 0xff
+	}
+	return m
+}
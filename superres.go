@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+var flagSuperRes string
+
+func init() {
+	flag.StringVar(&flagSuperRes, "superres", "", "command upscaling overzoomed tiles instead of interpolation; {in}, {out} and {scale} are substituted")
+}
+
+// overzoomed reports whether a level of width×height pixels is larger than
+// the source in either dimension.
+func overzoomed(src image.Rectangle, width, height int) bool {
+	return width > src.Dx() || height > src.Dy()
+}
+
+// superResTile renders tile x, y of an overzoomed level by handing the
+// source pixels it covers to the -superres command and scaling the
+// command's output to the exact tile size. Where the tile reaches past
+// the source, the patch is padded with its edge pixels rather than
+// stretched, and the part of the tile past the level left transparent.
+func superResTile(ctx context.Context, img image.Image, tileSize, level, x, y int) (*image.RGBA, error) {
+	b := img.Bounds()
+	width, height := levelSize(b, level, tileSize)
+	sx, sy := float64(b.Dx())/float64(width), float64(b.Dy())/float64(height)
+
+	area := image.Rect(
+		b.Min.X+int(math.Floor(float64(x*tileSize)*sx)),
+		b.Min.Y+int(math.Floor(float64(y*tileSize)*sy)),
+		b.Min.X+int(math.Ceil(float64((x+1)*tileSize)*sx)),
+		b.Min.Y+int(math.Ceil(float64((y+1)*tileSize)*sy)),
+	)
+	if area.Intersect(b).Empty() {
+		return nil, fmt.Errorf("tile %d/%d/%d covers no source pixels", level, x, y)
+	}
+
+	patch := image.NewRGBA(image.Rect(0, 0, area.Dx(), area.Dy()))
+	extendPatch(patch, img, area)
+
+	in, err := tempFile("sr-*.png")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(in.Name())
+	if err := png.Encode(in, patch); err != nil {
+		in.Close()
+		return nil, err
+	}
+	if err := in.Close(); err != nil {
+		return nil, err
+	}
+
+	out := strings.TrimSuffix(in.Name(), ".png") + "-out.png"
+	defer os.Remove(out)
+
+	scale := int(math.Ceil(float64(tileSize) / float64(area.Dx())))
+	if err := runSuperRes(ctx, in.Name(), out, scale); err != nil {
+		return nil, err
+	}
+
+	up, err := readTile(out)
+	if err != nil {
+		return nil, fmt.Errorf("superres output: %v", err)
+	}
+	if up.Bounds().Dx() != tileSize || up.Bounds().Dy() != tileSize {
+		up = resize.Resize(uint(tileSize), uint(tileSize), up, resize.Bicubic)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	r := image.Rect(0, 0, width-x*tileSize, height-y*tileSize).Intersect(dst.Rect)
+	draw.Draw(dst, r, up, up.Bounds().Min, draw.Src)
+	return dst, nil
+}
+
+// extendPatch copies the pixels of img within area into patch, repeating
+// the edge pixels of img where area reaches past it.
+func extendPatch(patch *image.RGBA, img image.Image, area image.Rectangle) {
+	b := img.Bounds()
+	in := area.Intersect(b)
+	draw.Draw(patch, in.Sub(area.Min), img, in.Min, draw.Src)
+	if in == area {
+		return
+	}
+	clamp := func(v, min, max int) int {
+		if v < min {
+			return min
+		}
+		if v >= max {
+			return max - 1
+		}
+		return v
+	}
+	for py := area.Min.Y; py < area.Max.Y; py++ {
+		for px := area.Min.X; px < area.Max.X; px++ {
+			if (image.Point{px, py}).In(in) {
+				continue
+			}
+			patch.Set(px-area.Min.X, py-area.Min.Y, img.At(clamp(px, in.Min.X, in.Max.X), clamp(py, in.Min.Y, in.Max.Y)))
+		}
+	}
+}
+
+// runSuperRes runs the -superres command template for one patch, killing
+// it once ctx is done.
+func runSuperRes(ctx context.Context, in, out string, scale int) error {
+	args := strings.Fields(flagSuperRes)
+	for i, a := range args {
+		a = strings.Replace(a, "{in}", in, -1)
+		a = strings.Replace(a, "{out}", out, -1)
+		a = strings.Replace(a, "{scale}", strconv.Itoa(scale), -1)
+		args[i] = a
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("superres: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("-spill is not supported on this platform")
+}
+
+func munmap(b []byte) {}
+
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
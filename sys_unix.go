@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+)
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func munmap(b []byte) {
+	if err := syscall.Munmap(b); err != nil {
+		log.Println(err)
+	}
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	flagVars        templateVars
+	flagTemplateDir string
+)
+
+func init() {
+	flag.Var(&flagVars, "var", "job: set a template variable, as name=value (repeatable)")
+	flag.StringVar(&flagTemplateDir, "template-dir", "", "daemon: directory of job templates, named <template>.job, that POST /jobs can submit by name")
+}
+
+// templateVars collects the -var name=value flags.
+type templateVars map[string]string
+
+func (v *templateVars) String() string {
+	var s []string
+	for name, value := range *v {
+		s = append(s, name+"="+value)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (v *templateVars) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid variable %q: want name=value", s)
+	}
+	if *v == nil {
+		*v = make(templateVars)
+	}
+	(*v)[s[:i]] = s[i+1:]
+	return nil
+}
+
+// runJob runs the job template named by args[0]:
+//
+//	tiler job -var input=scene.tif -var level=6 aerial.job
+func runJob(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: tiler job [flags] [template]")
+		os.Exit(2)
+	}
+	jobArgs, err := loadTemplate(args[0], flagVars)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmd := exec.Command(self, jobArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			os.Exit(exit.ExitCode())
+		}
+		log.Fatal(err)
+	}
+}
+
+// loadTemplate reads the job template at path and expands it with vars.
+func loadTemplate(path string, vars map[string]string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	args, err := expandTemplate(string(data), vars)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return args, nil
+}
+
+// expandTemplate turns a job template into the arguments of a tiler
+// command line. A template holds the arguments separated by white space,
+// with lines starting with # ignored, and may refer to variables as
+// ${name}, or ${name:-default} for an optional one with a literal
+// default. Variables are looked up in vars, then in the environment. Each
+// argument is expanded on its own, so a value containing spaces stays one
+// argument.
+func expandTemplate(text string, vars map[string]string) ([]string, error) {
+	var args []string
+	missing := make(map[string]bool)
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			args = append(args, os.Expand(field, func(ref string) string {
+				name, def := ref, ""
+				optional := false
+				if i := strings.Index(ref, ":-"); i >= 0 {
+					name, def, optional = ref[:i], ref[i+2:], true
+				}
+				if v, ok := vars[name]; ok {
+					return v
+				}
+				if v, ok := os.LookupEnv(name); ok {
+					return v
+				}
+				if !optional {
+					missing[name] = true
+				}
+				return def
+			}))
+		}
+	}
+
+	if len(missing) > 0 {
+		var names []string
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unset variables: %s", strings.Join(names, ", "))
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty template")
+	}
+	return args, nil
+}
+
+// templatePath returns the file of the template the daemon knows by name.
+func templatePath(name string) (string, error) {
+	if flagTemplateDir == "" {
+		return "", errors.New("daemon has no -template-dir")
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid template name %q", name)
+	}
+	return filepath.Join(flagTemplateDir, name+".job"), nil
+}
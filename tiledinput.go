@@ -0,0 +1,402 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/randomsean/tiler/tiler"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+var (
+	flagInPattern string
+	flagInZoom    int
+	flagInTMS     bool
+)
+
+func init() {
+	flag.StringVar(&flagInPattern, "in-pattern", "{zoom}/{x}/{y}.png", "naming pattern of the tiles of a tileset directory given as input")
+	flag.IntVar(&flagInZoom, "in-zoom", -1, "zoom of a tileset directory input to read, which must hold the most detail needed (default the deepest found)")
+	flag.BoolVar(&flagInTMS, "in-tms", false, "the tileset directory input counts tile rows from the bottom, as TMS does")
+}
+
+// tiledInputCache is the number of decoded input tiles kept for reuse by
+// neighbouring output tiles.
+const tiledInputCache = 256
+
+// tiledInput is a tileset directory read as one virtual raster: the
+// tiles of one zoom side by side. It is never assembled whole; each
+// output tile is drawn from the few input tiles under it.
+type tiledInput struct {
+	dir  string
+	zoom int
+	size int
+
+	// have holds, for every zoom up to the input zoom, the tiles that
+	// are or have descendants among the input tiles.
+	have []map[image.Point]bool
+
+	mu    sync.Mutex
+	lru   *list.List
+	cache map[image.Point]*list.Element
+}
+
+type cachedInputTile struct {
+	p   image.Point
+	img image.Image
+}
+
+// openTiledInput indexes the tiles in dir named after -in-pattern.
+func openTiledInput(dir string) (*tiledInput, error) {
+	re, err := inPatternRegexp(flagInPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	byZoom := make(map[int][]image.Point)
+	first := make(map[int]string)
+	deepest := -1
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		m := re.FindStringSubmatch(filepath.ToSlash(rel))
+		if m == nil {
+			return nil
+		}
+		var z, x, y int
+		for i, name := range re.SubexpNames() {
+			v, _ := strconv.Atoi(m[i])
+			switch name {
+			case "zoom":
+				z = v
+			case "x":
+				x = v
+			case "y":
+				y = v
+			}
+		}
+		if z > 30 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+			return nil
+		}
+		if flagInTMS {
+			y = 1<<uint(z) - 1 - y
+		}
+		byZoom[z] = append(byZoom[z], image.Pt(x, y))
+		if _, ok := first[z]; !ok {
+			first[z] = p
+		}
+		if z > deepest {
+			deepest = z
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	zoom := flagInZoom
+	if zoom < 0 {
+		zoom = deepest
+	}
+	if len(byZoom[zoom]) == 0 {
+		return nil, fmt.Errorf("%s: no tiles named %s at zoom %d", dir, flagInPattern, zoom)
+	}
+
+	f, err := os.Open(first[zoom])
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", first[zoom], err)
+	}
+	if cfg.Width != cfg.Height {
+		return nil, fmt.Errorf("%s: tiles are %dx%d, not square", dir, cfg.Width, cfg.Height)
+	}
+
+	t := &tiledInput{
+		dir:   dir,
+		zoom:  zoom,
+		size:  cfg.Width,
+		have:  make([]map[image.Point]bool, zoom+1),
+		lru:   list.New(),
+		cache: make(map[image.Point]*list.Element),
+	}
+	for z := range t.have {
+		t.have[z] = make(map[image.Point]bool)
+	}
+	for _, p := range byZoom[zoom] {
+		for z := zoom; z >= 0; z-- {
+			q := image.Pt(p.X>>uint(zoom-z), p.Y>>uint(zoom-z))
+			if t.have[z][q] {
+				break
+			}
+			t.have[z][q] = true
+		}
+	}
+	return t, nil
+}
+
+// inPatternRegexp turns a tile naming pattern into a regexp capturing
+// the zoom, x and y of matching names.
+func inPatternRegexp(p string) (*regexp.Regexp, error) {
+	for _, v := range []string{"{zoom}", "{x}", "{y}"} {
+		if strings.Count(p, v) != 1 {
+			return nil, fmt.Errorf("-in-pattern %q must hold %s once", p, v)
+		}
+	}
+	s := regexp.QuoteMeta(p)
+	for _, v := range []string{"zoom", "x", "y"} {
+		s = strings.Replace(s, regexp.QuoteMeta("{"+v+"}"), "(?P<"+v+">[0-9]+)", 1)
+	}
+	return regexp.Compile("^" + s + "$")
+}
+
+// scale returns how many input pixels span one pixel of output level z
+// with tiles of size.
+func (t *tiledInput) scale(z, size int) float64 {
+	return math.Ldexp(float64(t.size)/float64(size), t.zoom-z)
+}
+
+// inputTiles returns the range of input tiles under output tile x, y of
+// level z, widened by margin input pixels on every side.
+func (t *tiledInput) inputTiles(z, x, y, size int, margin float64) image.Rectangle {
+	f := t.scale(z, size)
+	side := 1 << uint(t.zoom)
+	span := func(i int) (int, int) {
+		lo := int(math.Floor((float64(i*size)*f - margin) / float64(t.size)))
+		hi := int(math.Ceil((float64((i+1)*size)*f + margin) / float64(t.size)))
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > side {
+			hi = side
+		}
+		return lo, hi
+	}
+	x0, x1 := span(x)
+	y0, y1 := span(y)
+	return image.Rect(x0, y0, x1, y1)
+}
+
+// covers reports whether output tile x, y of level z may hold any input
+// pixels. It errs toward true.
+func (t *tiledInput) covers(z, x, y, size int) bool {
+	r := t.inputTiles(z, x, y, size, 0)
+	if r.Empty() {
+		return false
+	}
+	k := 0
+	for k < t.zoom && ((r.Max.X-1)>>uint(k)-r.Min.X>>uint(k) > 1 || (r.Max.Y-1)>>uint(k)-r.Min.Y>>uint(k) > 1) {
+		k++
+	}
+	for ty := r.Min.Y >> uint(k); ty <= (r.Max.Y-1)>>uint(k); ty++ {
+		for tx := r.Min.X >> uint(k); tx <= (r.Max.X-1)>>uint(k); tx++ {
+			if t.have[t.zoom-k][image.Pt(tx, ty)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tile returns input tile p, or nil if there is none.
+func (t *tiledInput) tile(p image.Point) (image.Image, error) {
+	if !t.have[t.zoom][p] {
+		return nil, nil
+	}
+	t.mu.Lock()
+	if e, ok := t.cache[p]; ok {
+		t.lru.MoveToFront(e)
+		t.mu.Unlock()
+		return e.Value.(*cachedInputTile).img, nil
+	}
+	t.mu.Unlock()
+
+	y := p.Y
+	if flagInTMS {
+		y = 1<<uint(t.zoom) - 1 - y
+	}
+	name := tiler.FileName(flagInPattern, t.zoom, p.X, y, t.size)
+	img, err := decodeFile(filepath.Join(t.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.cache[p]; !ok {
+		t.cache[p] = t.lru.PushFront(&cachedInputTile{p, img})
+		if t.lru.Len() > tiledInputCache {
+			old := t.lru.Remove(t.lru.Back()).(*cachedInputTile)
+			delete(t.cache, old.p)
+		}
+	}
+	return img, nil
+}
+
+// renderLeaf draws output tile x, y of level z from the input tiles
+// under it, or returns nil if there are none.
+func (t *tiledInput) renderLeaf(z, x, y, size int) (*image.RGBA, error) {
+	// The margin leaves room for the interpolation kernel.
+	r := t.inputTiles(z, x, y, size, 2)
+	mosaic := image.NewRGBA(image.Rect(0, 0, r.Dx()*t.size, r.Dy()*t.size))
+	found := false
+	for ty := r.Min.Y; ty < r.Max.Y; ty++ {
+		for tx := r.Min.X; tx < r.Max.X; tx++ {
+			img, err := t.tile(image.Pt(tx, ty))
+			if err != nil {
+				return nil, err
+			}
+			if img == nil {
+				continue
+			}
+			found = true
+			at := image.Pt((tx-r.Min.X)*t.size, (ty-r.Min.Y)*t.size)
+			draw.Draw(mosaic, image.Rectangle{at, at.Add(image.Pt(t.size, t.size))}, img, img.Bounds().Min, draw.Src)
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	// m maps mosaic pixels onto the output tile.
+	k := 1 / t.scale(z, size)
+	m := f64.Aff3{
+		k, 0, float64(r.Min.X*t.size)*k - float64(x*size),
+		0, k, float64(r.Min.Y*t.size)*k - float64(y*size),
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	interpKernel(z).Transform(dst, m, mosaic, mosaic.Bounds(), draw.Src, nil)
+	return dst, nil
+}
+
+// tileTiledInput generates levels 0 to level from the tileset input t.
+// The deepest level is drawn from the input tiles and every level above
+// it from the four tiles below, depth first, so only a few tiles per
+// level are held at a time. Tiles with no input under them are skipped.
+func tileTiledInput(t *tiledInput, level int) {
+	if len(flagTileSizes) != 1 {
+		log.Fatalln("a tileset input takes a single tile size")
+	}
+	size := flagTileSizes[0]
+	if f := t.scale(level, size); f > 4 {
+		log.Fatalf("level %d is too coarse for input zoom %d, tile to level %d or deeper", level, t.zoom, level+int(math.Ceil(math.Log2(f/4))))
+	}
+	if err := checkZoomRange(level); err != nil {
+		log.Fatal(err)
+	}
+	if err := output.Mkdir(sizeDir("", size)); err != nil {
+		log.Fatal(err)
+	}
+
+	counts := make([]int, level+1)
+	t.count(0, 0, 0, level, size, counts)
+	for z, n := range counts {
+		if !zoomWanted(z) {
+			continue
+		}
+		budget.Expect(n)
+		progress.Expect(z, n)
+	}
+	t.renderTree(0, 0, 0, level, size)
+}
+
+// count adds the tiles renderTree will consider at and below z/x/y to
+// counts, indexed by zoom.
+func (t *tiledInput) count(z, x, y, level, size int, counts []int) {
+	if !t.covers(z, x, y, size) {
+		return
+	}
+	counts[z]++
+	if z == level {
+		return
+	}
+	for i := 0; i < 4; i++ {
+		t.count(z+1, 2*x+i%2, 2*y+i/2, level, size, counts)
+	}
+}
+
+// renderTree renders, saves and returns tile z/x/y and everything below
+// it down to level, or nil if there is no input under it.
+func (t *tiledInput) renderTree(z, x, y, level, size int) *image.RGBA {
+	if !t.covers(z, x, y, size) {
+		return nil
+	}
+	name := tileName(sizeDir("", size), z, x, y, size)
+
+	var dst *image.RGBA
+	if z == level {
+		var err error
+		if dst, err = t.renderLeaf(z, x, y, size); err != nil {
+			log.Printf("%s: %v", name, err)
+			failures.Add(name, err)
+			return nil
+		}
+	} else {
+		var children [4]*image.RGBA
+		var wg sync.WaitGroup
+		for i := range children {
+			cx, cy := 2*x+i%2, 2*y+i/2
+			if z < 3 {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					children[i] = t.renderTree(z+1, cx, cy, level, size)
+				}(i)
+			} else {
+				children[i] = t.renderTree(z+1, cx, cy, level, size)
+			}
+		}
+		wg.Wait()
+		dst = mergeChildren(children, size, z)
+	}
+	if dst == nil || !zoomWanted(z) {
+		return dst
+	}
+
+	if err := saveTile(jobCtx, dst, size, x, y, z, sizeDir("", size)); err != nil {
+		log.Printf("%s: %v", name, err)
+		failures.Add(name, err)
+	}
+	return dst
+}
+
+// mergeChildren downsamples the four tiles below a tile of level z, in
+// the order top left, top right, bottom left, bottom right, into it. It
+// returns nil if none of them exists.
+func mergeChildren(children [4]*image.RGBA, size, z int) *image.RGBA {
+	quad := image.NewRGBA(image.Rect(0, 0, 2*size, 2*size))
+	found := false
+	for i, c := range children {
+		if c == nil {
+			continue
+		}
+		found = true
+		at := image.Pt(i%2*size, i/2*size)
+		draw.Draw(quad, image.Rectangle{at, at.Add(image.Pt(size, size))}, c, c.Bounds().Min, draw.Src)
+	}
+	if !found {
+		return nil
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	levelKernel(z).Scale(dst, dst.Bounds(), quad, quad.Bounds(), draw.Src, nil)
+	return dst
+}
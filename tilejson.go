@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"math"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var flagTileJSON string
+
+func init() {
+	flag.StringVar(&flagTileJSON, "tilejson", "", "write tilejson.json for MapLibre, Mapbox GL and other map clients, with the tiles served below this URL, e.g. https://tiles.example.com/map")
+}
+
+// tileJSONFile is the name of the TileJSON of a tileset.
+const tileJSONFile = "tilejson.json"
+
+// tileJSON is a TileJSON 3.0.0 document. Format is the encoding of the
+// tiles, as in MBTiles metadata.
+type tileJSON struct {
+	TileJSON    string    `json:"tilejson"`
+	Tiles       []string  `json:"tiles"`
+	Name        string    `json:"name,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Attribution string    `json:"attribution,omitempty"`
+	Scheme      string    `json:"scheme"`
+	MinZoom     int       `json:"minzoom"`
+	MaxZoom     int       `json:"maxzoom"`
+	Bounds      []float64 `json:"bounds,omitempty"`
+	Format      string    `json:"format"`
+}
+
+// writeTileJSON writes tilejson.json into dir for levels 0 to level, once
+// prepareLevels has resolved where they are placed.
+func writeTileJSON(level int, dir string) {
+	size := flagTileSizes[0]
+	pattern := filepath.ToSlash(urlTemplate(flagPattern, size))
+	url := strings.TrimRight(flagTileJSON, "/") + "/" + path.Join(filepath.ToSlash(sizeDir(dir, size)), pattern)
+
+	minZoom, _, _ := remapTile(0, 0, 0)
+	maxZoom, _, _ := remapTile(level, 0, 0)
+	tj := tileJSON{
+		TileJSON:    "3.0.0",
+		Tiles:       []string{url},
+		Name:        layer.Name,
+		Description: layer.Description,
+		Attribution: layer.Attribution,
+		Scheme:      flagScheme,
+		MinZoom:     minZoom,
+		MaxZoom:     maxZoom,
+		Bounds:      roundDegrees(lonLatBounds()),
+		Format:      tileExts[flagEncoding],
+	}
+
+	data, err := json.MarshalIndent(&tj, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	name := filepath.Join(dir, tileJSONFile)
+	data = sealTile(name, append(data, '\n'))
+	if err := retry(func() error { return output.WriteTile(name, data) }); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// urlTemplate returns pattern as a TileJSON URL template: {zoom} becomes
+// {z} and {size} the tile size.
+func urlTemplate(pattern string, size int) string {
+	return strings.NewReplacer("{zoom}", "{z}", "{size}", strconv.Itoa(size)).Replace(pattern)
+}
+
+// lonLatBounds returns the extent of the tiles in longitude and latitude,
+// west, south, east, north, from -bounds or the GeoTIFF source in WGS 84
+// or web mercator, or from where -offset places them. It is nil, which
+// TileJSON takes as the whole world, if the extent is unknown.
+func lonLatBounds() []float64 {
+	if b := geoBounds; b != nil {
+		switch {
+		case flagCRS == "EPSG:4326" || strings.EqualFold(flagCRS, "WGS84"):
+			return []float64{b[0], b[1], b[2], b[3]}
+		case strings.HasPrefix(flagCRS, "EPSG:"):
+			if code, err := strconv.Atoi(strings.TrimPrefix(flagCRS, "EPSG:")); err == nil && webMercatorEPSG[code] {
+				w, s := mercatorLonLat(b[0], b[1])
+				e, n := mercatorLonLat(b[2], b[3])
+				return []float64{w, s, e, n}
+			}
+		}
+	}
+	if offset.set {
+		d := uint(offset.maxLevel)
+		z, x, y := offset.zoom-int(d), offset.x>>d, offset.y>>d
+		w, n := tileLonLat(z, x, y)
+		e, s := tileLonLat(z, x+1, y+1)
+		return []float64{w, s, e, n}
+	}
+	return nil
+}
+
+// roundDegrees rounds the degrees vs to 1e-7, about a centimetre, dropping
+// the floating point noise of the projection.
+func roundDegrees(vs []float64) []float64 {
+	for i, v := range vs {
+		vs[i] = math.Round(v*1e7) / 1e7
+	}
+	return vs
+}
+
+// mercatorLonLat returns the longitude and latitude of the web mercator
+// point x, y.
+func mercatorLonLat(x, y float64) (float64, float64) {
+	r := mercatorWorld / (2 * math.Pi)
+	return x / r * 180 / math.Pi, (2*math.Atan(math.Exp(y/r)) - math.Pi/2) * 180 / math.Pi
+}
+
+// tileLonLat returns the longitude and latitude of the top-left corner of
+// the web mercator tile x, y of zoom.
+func tileLonLat(zoom, x, y int) (float64, float64) {
+	n := float64(int(1) << uint(zoom))
+	return float64(x)/n*360 - 180, math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+)
+
+var flagMaxTileBytes byteSize
+
+func init() {
+	flag.Var(&flagMaxTileBytes, "max-tile-bytes", "re-encode tiles larger than this at lower quality, e.g. 16K (0 disables)")
+}
+
+// encodeLimited encodes img like encodeTile, then keeps re-encoding it
+// with cheaper settings until it fits within -max-tile-bytes. JPEG and
+// lossy WebP tiles step down in quality; PNG tiles are retried at best
+// compression.
+func encodeLimited(buf *bytes.Buffer, img image.Image, encoding string, quality int) error {
+	if err := encodeTile(buf, img, encoding, quality); err != nil {
+		return err
+	}
+
+	limit := int(flagMaxTileBytes)
+	if limit <= 0 || buf.Len() <= limit {
+		return nil
+	}
+
+	switch {
+	case encoding == "jpeg" || encoding == "webp" && flagWebPMode == "lossy":
+		for quality > 1 && buf.Len() > limit {
+			quality -= 10
+			if quality < 1 {
+				quality = 1
+			}
+			buf.Reset()
+			if err := encodeTile(buf, img, encoding, quality); err != nil {
+				return err
+			}
+		}
+	case encoding == "png":
+		buf.Reset()
+		if err := encodePNG(buf, img, png.BestCompression); err != nil {
+			return err
+		}
+	}
+
+	if buf.Len() > limit {
+		return fmt.Errorf("tile is %d bytes, exceeding -max-tile-bytes %d", buf.Len(), limit)
+	}
+	return nil
+}
+
+// lossyEncoding reports whether -e encodes tiles at a quality that can be
+// lowered to save space.
+func lossyEncoding() bool {
+	return flagEncoding == "jpeg" || flagEncoding == "webp" && flagWebPMode == "lossy"
+}
@@ -0,0 +1,337 @@
+// Package tiler cuts images into pyramids of square tiles for web map
+// viewers. Level z of a pyramid is the image scaled to 2^z tiles across
+// and down, and tiles are named by a pattern of their zoom and position.
+package tiler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nfnt/resize"
+)
+
+// DefaultPattern names tiles when Tiler.Pattern is empty.
+const DefaultPattern = "{zoom}_{x}_{y}.png"
+
+// Interpolations maps the interpolation names accepted by Tiler to the
+// functions they select.
+var Interpolations = map[string]resize.InterpolationFunction{
+	"NearestNeighbor":   resize.NearestNeighbor,
+	"Bilinear":          resize.Bilinear,
+	"Bicubic":           resize.Bicubic,
+	"MitchellNetravali": resize.MitchellNetravali,
+	"Lanczos2":          resize.Lanczos2,
+	"Lanczos3":          resize.Lanczos3,
+}
+
+// Output stores encoded tiles under names relative to the tileset root.
+type Output interface {
+	// Mkdir makes sure tiles can be stored below dir.
+	Mkdir(dir string) error
+	WriteTile(name string, data []byte) error
+}
+
+// Dir is an Output storing tiles as files below the named directory.
+type Dir string
+
+func (d Dir) Mkdir(dir string) error {
+	return os.MkdirAll(filepath.Join(string(d), dir), 0755)
+}
+
+// WriteTile stores data at name, creating the directories a pattern such
+// as {zoom}/{x}/{y}.png puts it in the first time a tile lands in them.
+func (d Dir) WriteTile(name string, data []byte) error {
+	path := filepath.Join(string(d), name)
+	err := WriteFile(path, data)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = WriteFile(path, data)
+		}
+	}
+	return err
+}
+
+// WriteFile replaces the file at path with data. The data is written to a
+// temporary file and renamed into place, so readers never see a partial
+// tile and files hardlinked to the old tile are left untouched.
+func WriteFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Tiler cuts images into tile pyramids written to Output. Other fields
+// left at their zero value take the defaults noted.
+type Tiler struct {
+	TileSize      int    // tile width and height in pixels, 256
+	Encoding      string // "png" or "jpeg", "png"
+	Quality       int    // JPEG quality, jpeg.DefaultQuality
+	Interpolation string // a key of Interpolations, "Bicubic"
+	Pattern       string // tile name pattern, DefaultPattern
+	Output        Output
+	MinZoom       int // shallowest level written, 0
+
+	// Source, if not nil, returns the image level zoom is scaled from,
+	// given the deeper level Tile would scale it from, or nil where Tile
+	// would scale the image itself. It returns nil to skip the level, and
+	// the level after is then scaled from the image again.
+	Source func(zoom int, deeper image.Image) image.Image
+
+	// Level, if not nil, writes level zoom from img in place of TileLevel,
+	// applying the options above as it sees fit. Encoding is then only
+	// checked by it.
+	Level func(img image.Image, zoom int) (*Level, error)
+}
+
+// Level is a level of a pyramid, scaled whole, that Tile scales the next
+// level up from.
+type Level struct {
+	Image image.Image
+
+	// Release, if not nil, frees Image once nothing more is scaled from
+	// it.
+	Release func()
+}
+
+func (l *Level) release() {
+	if l != nil && l.Release != nil {
+		l.Release()
+	}
+}
+
+// Tile writes zoom levels MinZoom through levels of img, deepest first.
+// Once a level holds no more pixels than img, each shallower level is
+// scaled from the one below it rather than from img again.
+func (t *Tiler) Tile(img image.Image, levels int) error {
+	if levels < 0 {
+		return errors.New("tiler: levels must not be negative")
+	}
+	if err := t.check(); err != nil {
+		return err
+	}
+	if err := t.Output.Mkdir(""); err != nil {
+		return err
+	}
+
+	tileLevel := t.Level
+	if tileLevel == nil {
+		tileLevel = t.TileLevel
+	}
+	b := img.Bounds()
+	var deeper *Level
+	defer func() { deeper.release() }()
+	for z := levels; z >= t.MinZoom; z-- {
+		from := img
+		if deeper != nil {
+			from = deeper.Image
+		}
+		if t.Source != nil {
+			var d image.Image
+			if deeper != nil {
+				d = deeper.Image
+			}
+			if from = t.Source(z, d); from == nil {
+				deeper.release()
+				deeper = nil
+				continue
+			}
+		}
+
+		l, err := tileLevel(from, z)
+		deeper.release()
+		deeper = nil
+		if err != nil {
+			l.release()
+			return err
+		}
+		if l != nil && l.Image.Bounds().Dx() <= b.Dx() && l.Image.Bounds().Dy() <= b.Dy() {
+			deeper = l
+		} else {
+			l.release()
+		}
+	}
+	return nil
+}
+
+// TileLevel writes every tile of zoom level from img, the image or a
+// deeper level of it, and returns the level scaled.
+func (t *Tiler) TileLevel(img image.Image, level int) (*Level, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+
+	tileSize := t.tileSize()
+	side := 1 << uint(level)
+	size := uint(side * tileSize)
+	resized := resize.Resize(size, size, img, Interpolations[t.interpolation()])
+
+	var errs firstError
+	var wg sync.WaitGroup
+	for y := 0; y < side; y++ {
+		wg.Add(1)
+		go func(y int) {
+			defer wg.Done()
+			for x := 0; x < side; x++ {
+				if err := t.writeTile(Crop(resized, tileSize, x, y), level, x, y); err != nil {
+					errs.Set(err)
+					return
+				}
+			}
+		}(y)
+	}
+	wg.Wait()
+	if errs.err != nil {
+		return nil, errs.err
+	}
+	return &Level{Image: resized}, nil
+}
+
+func (t *Tiler) writeTile(tile image.Image, level, x, y int) error {
+	var buf bytes.Buffer
+	if err := Encode(&buf, tile, t.encoding(), t.quality()); err != nil {
+		return err
+	}
+	name := FileName(t.pattern(), level, x, y, t.tileSize())
+	if dir := filepath.Dir(name); dir != "." {
+		if err := t.Output.Mkdir(dir); err != nil {
+			return err
+		}
+	}
+	return t.Output.WriteTile(name, buf.Bytes())
+}
+
+func (t *Tiler) check() error {
+	if t.Output == nil {
+		return errors.New("tiler: no Output")
+	}
+	if t.TileSize < 0 {
+		return errors.New("tiler: tile size must be positive")
+	}
+	if t.MinZoom < 0 {
+		return errors.New("tiler: MinZoom must not be negative")
+	}
+	if t.Level != nil {
+		return nil
+	}
+	if _, ok := Interpolations[t.interpolation()]; !ok {
+		return fmt.Errorf("tiler: unknown interpolation %q", t.Interpolation)
+	}
+	switch t.encoding() {
+	case "png", "jpeg":
+		return nil
+	}
+	return fmt.Errorf("tiler: unsupported encoding %q", t.Encoding)
+}
+
+func (t *Tiler) tileSize() int {
+	if t.TileSize == 0 {
+		return 256
+	}
+	return t.TileSize
+}
+
+func (t *Tiler) encoding() string {
+	if t.Encoding == "" {
+		return "png"
+	}
+	return t.Encoding
+}
+
+func (t *Tiler) quality() int {
+	if t.Quality == 0 {
+		return jpeg.DefaultQuality
+	}
+	return t.Quality
+}
+
+func (t *Tiler) interpolation() string {
+	if t.Interpolation == "" {
+		return "Bicubic"
+	}
+	return t.Interpolation
+}
+
+func (t *Tiler) pattern() string {
+	if t.Pattern == "" {
+		return DefaultPattern
+	}
+	return t.Pattern
+}
+
+// Crop returns tile x, y of an image already scaled to its level.
+func Crop(img image.Image, tileSize, x, y int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	CropInto(dst, img, x, y)
+	return dst
+}
+
+// CropInto is Crop storing the tile in dst, whose width is the tile size,
+// so callers can reuse tile buffers.
+func CropInto(dst *image.RGBA, img image.Image, x, y int) {
+	tileSize := dst.Rect.Dx()
+	area := image.Rect(x*tileSize, y*tileSize, tileSize+x*tileSize, tileSize+y*tileSize)
+
+	if !area.In(img.Bounds()) {
+		draw.Draw(dst, dst.Rect, image.Transparent, image.Point{}, draw.Src)
+	}
+	draw.Draw(dst, dst.Rect, img, area.Min, draw.Src)
+}
+
+// Encode writes img in encoding, "png" or "jpeg" at quality.
+func Encode(w io.Writer, img image.Image, encoding string, quality int) error {
+	switch encoding {
+	case "png":
+		return png.Encode(w, img)
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	default:
+		return errors.New("encoding not supported")
+	}
+}
+
+// FileName expands the placeholders {zoom}, {x}, {y} and {size} in pattern.
+func FileName(p string, zoom, x, y, size int) string {
+	p = strings.Replace(p, "{zoom}", strconv.Itoa(zoom), -1)
+	p = strings.Replace(p, "{x}", strconv.Itoa(x), -1)
+	p = strings.Replace(p, "{y}", strconv.Itoa(y), -1)
+	p = strings.Replace(p, "{size}", strconv.Itoa(size), -1)
+	return p
+}
+
+// firstError keeps the first non-nil error reported by concurrent workers.
+type firstError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *firstError) Set(err error) {
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.mu.Unlock()
+}
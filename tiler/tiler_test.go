@@ -0,0 +1,91 @@
+package tiler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"sync"
+	"testing"
+)
+
+// memOutput is an Output keeping tiles in memory.
+type memOutput struct {
+	mu    sync.Mutex
+	tiles map[string][]byte
+}
+
+func (*memOutput) Mkdir(string) error { return nil }
+
+func (m *memOutput) WriteTile(name string, data []byte) error {
+	m.mu.Lock()
+	m.tiles[name] = data
+	m.mu.Unlock()
+	return nil
+}
+
+func TestTile(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 50, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 50; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 5), uint8(y * 6), 0, 0xff})
+		}
+	}
+
+	out := &memOutput{tiles: make(map[string][]byte)}
+	tl := &Tiler{TileSize: 16, MinZoom: 1, Output: out}
+	if err := tl.Tile(img, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.tiles) != 4+16 {
+		t.Fatalf("wrote %d tiles, want 20", len(out.tiles))
+	}
+	for z := 1; z <= 2; z++ {
+		for y := 0; y < 1<<uint(z); y++ {
+			for x := 0; x < 1<<uint(z); x++ {
+				name := fmt.Sprintf("%d_%d_%d.png", z, x, y)
+				tile, err := png.Decode(bytes.NewReader(out.tiles[name]))
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if b := tile.Bounds(); b.Dx() != 16 || b.Dy() != 16 {
+					t.Errorf("%s is %v, want 16×16", name, b)
+				}
+			}
+		}
+	}
+}
+
+func TestTileHooks(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+	var zooms []int
+	var chained []bool
+	tl := &Tiler{
+		TileSize: 16,
+		Output:   &memOutput{tiles: make(map[string][]byte)},
+		Source: func(zoom int, deeper image.Image) image.Image {
+			chained = append(chained, deeper != nil)
+			if zoom == 1 {
+				return nil
+			}
+			if deeper != nil {
+				return deeper
+			}
+			return img
+		},
+		Level: func(src image.Image, zoom int) (*Level, error) {
+			zooms = append(zooms, zoom)
+			side := 16 << uint(zoom)
+			return &Level{Image: image.NewGray(image.Rect(0, 0, side, side))}, nil
+		},
+	}
+	if err := tl.Tile(img, 3); err != nil {
+		t.Fatal(err)
+	}
+	// Level 3, 128 pixels across, is larger than img and so not chained;
+	// level 2 is, and level 1 is skipped, so level 0 is not.
+	if fmt.Sprint(zooms) != "[3 2 0]" || fmt.Sprint(chained) != "[false false true false]" {
+		t.Errorf("rendered %v, chained %v", zooms, chained)
+	}
+}
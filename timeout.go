@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	flagTileTimeout time.Duration
+	flagJobTimeout  time.Duration
+)
+
+func init() {
+	flag.DurationVar(&flagTileTimeout, "tile-timeout", 0, "abandon a tile that takes longer than this (0 disables)")
+	flag.DurationVar(&flagJobTimeout, "timeout", 0, "abort the whole run after this long (0 disables)")
+}
+
+var errTileTimeout = errors.New("timed out")
+
+// tileFailure records a tile that could not be produced.
+type tileFailure struct {
+	Name  string
+	Error error
+
+	// tile is set for tiles of a level that tiler retry can regenerate.
+	tile *QuarantinedTile
+}
+
+// failureList collects tile failures from concurrent workers.
+type failureList struct {
+	mu    sync.Mutex
+	tiles []tileFailure
+}
+
+var failures failureList
+
+func (l *failureList) Add(name string, err error) {
+	l.mu.Lock()
+	l.tiles = append(l.tiles, tileFailure{Name: name, Error: err})
+	l.mu.Unlock()
+}
+
+func (l *failureList) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.tiles)
+}
+
+// withTimeout runs fn with a context cancelled after d, and returns its
+// error, or errTileTimeout if it failed once d elapsed. fn gives up by
+// checking the context, so a tile that runs late neither outlives its
+// worker nor writes anything once it has been recorded as failed.
+func withTimeout(ctx context.Context, d time.Duration, fn func(context.Context) error) error {
+	if d <= 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	err := fn(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errTileTimeout
+	}
+	return err
+}
+
+// startJobTimer aborts the process once the job timeout elapses.
+func startJobTimer() {
+	if flagJobTimeout <= 0 {
+		return
+	}
+	time.AfterFunc(flagJobTimeout, func() {
+		abortRun(fmt.Errorf("job exceeded timeout of %v after %d failed tiles", flagJobTimeout, failures.Len()))
+	})
+}
+
+// reportFailures logs every failed tile and returns an error if there were
+// any.
+func reportFailures() error {
+	failures.mu.Lock()
+	defer failures.mu.Unlock()
+
+	if len(failures.tiles) == 0 {
+		return nil
+	}
+	for _, f := range failures.tiles {
+		log.Printf("failed: %s: %v", f.Name, f.Error)
+	}
+	return fmt.Errorf("%d tiles failed", len(failures.tiles))
+}
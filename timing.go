@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+var flagTimings string
+
+func init() {
+	flag.StringVar(&flagTimings, "timings", "", "write a JSON report of the time spent in each pipeline stage to this file")
+}
+
+// Pipeline stages recorded by stageTimes.
+const (
+	stageDecode = "decode"
+	stageScale  = "scale"
+	stageCrop   = "crop"
+	stageEncode = "encode"
+	stageWrite  = "write"
+)
+
+// stageTimes accumulates the time spent in each pipeline stage, per zoom.
+// Tiles are processed concurrently, so the per-level figures are the sum
+// of the time every worker spent in a stage rather than elapsed time.
+type stageTimes struct {
+	mu     sync.Mutex
+	decode time.Duration
+	levels map[int]map[string]time.Duration
+}
+
+var timings = stageTimes{levels: make(map[int]map[string]time.Duration)}
+
+// Since records the time elapsed since start against stage at zoom.
+// Decoding is not tied to a zoom, so zoom is ignored for stageDecode.
+func (t *stageTimes) Since(stage string, zoom int, start time.Time) {
+	d := time.Since(start)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if stage == stageDecode {
+		t.decode += d
+		return
+	}
+	l := t.levels[zoom]
+	if l == nil {
+		l = make(map[string]time.Duration)
+		t.levels[zoom] = l
+	}
+	l[stage] += d
+}
+
+type levelTimings struct {
+	Zoom   int     `json:"zoom"`
+	Scale  float64 `json:"scale_seconds"`
+	Crop   float64 `json:"crop_seconds"`
+	Encode float64 `json:"encode_seconds"`
+	Write  float64 `json:"write_seconds"`
+}
+
+type timingReport struct {
+	Decode  float64        `json:"decode_seconds"`
+	Elapsed float64        `json:"elapsed_seconds"`
+	Levels  []levelTimings `json:"levels"`
+}
+
+// Write saves the recorded timings to path as indented JSON.
+func (t *stageTimes) Write(path string) error {
+	t.mu.Lock()
+	report := timingReport{
+		Decode:  t.decode.Seconds(),
+		Elapsed: time.Since(current.started).Seconds(),
+		Levels:  []levelTimings{},
+	}
+	for zoom, l := range t.levels {
+		report.Levels = append(report.Levels, levelTimings{
+			Zoom:   zoom,
+			Scale:  l[stageScale].Seconds(),
+			Crop:   l[stageCrop].Seconds(),
+			Encode: l[stageEncode].Seconds(),
+			Write:  l[stageWrite].Seconds(),
+		})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(report.Levels, func(i, j int) bool {
+		return report.Levels[i].Zoom < report.Levels[j].Zoom
+	})
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var flagTmpDir string
+
+func init() {
+	flag.StringVar(&flagTmpDir, "tmpdir", os.TempDir(), "directory for temporary and intermediate files")
+}
+
+const (
+	scratchPrefix = "tiler-run-"
+	scratchOwner  = "owner"
+)
+
+// scratch is the per-run directory under -tmpdir that holds temporary
+// files. It is removed when the run ends or is interrupted; directories
+// left behind by runs that crashed are removed by the next run.
+var scratch struct {
+	once sync.Once
+	dir  string
+	err  error
+}
+
+// tempFile creates a new temporary file in the run's scratch directory.
+func tempFile(pattern string) (*os.File, error) {
+	dir, err := scratchDir()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, pattern)
+}
+
+// scratchDir returns the run's scratch directory, creating it on first use.
+func scratchDir() (string, error) {
+	scratch.once.Do(func() {
+		removeStaleScratch()
+
+		dir, err := ioutil.TempDir(flagTmpDir, scratchPrefix)
+		if err != nil {
+			scratch.err = err
+			return
+		}
+		owner := []byte(strconv.Itoa(os.Getpid()))
+		if err := ioutil.WriteFile(filepath.Join(dir, scratchOwner), owner, 0644); err != nil {
+			os.RemoveAll(dir)
+			scratch.err = err
+			return
+		}
+		scratch.dir = dir
+
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-c
+			cleanScratch()
+			os.Exit(1)
+		}()
+	})
+	return scratch.dir, scratch.err
+}
+
+// cleanScratch removes the run's scratch directory, if it was created.
+func cleanScratch() {
+	if scratch.dir == "" {
+		return
+	}
+	if err := os.RemoveAll(scratch.dir); err != nil {
+		log.Println(err)
+	}
+}
+
+// removeStaleScratch removes scratch directories under -tmpdir whose
+// owning process is no longer running.
+func removeStaleScratch() {
+	dirs, _ := filepath.Glob(filepath.Join(flagTmpDir, scratchPrefix+"*"))
+	for _, dir := range dirs {
+		b, err := ioutil.ReadFile(filepath.Join(dir, scratchOwner))
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil || processAlive(pid) {
+			continue
+		}
+		log.Println("removing stale scratch directory", dir)
+		os.RemoveAll(dir)
+	}
+}
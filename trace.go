@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var flagTrace bool
+
+func init() {
+	flag.BoolVar(&flagTrace, "trace", false, "export OpenTelemetry spans for the job, each level and each tile over OTLP/HTTP, configured by the OTEL_EXPORTER_OTLP_* environment variables")
+}
+
+// tracer does nothing until startTrace installs an exporting provider.
+var tracer = otel.Tracer("github.com/randomsean/tiler")
+
+var (
+	traceProvider *sdktrace.TracerProvider
+	jobCtx        = context.Background()
+	jobSpan       = trace.SpanFromContext(jobCtx)
+)
+
+// startTrace sets up OTLP export if -trace is set and opens the span
+// covering the whole run.
+func startTrace(inputs []string) {
+	if flagTrace {
+		exporter, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		res, err := resource.New(context.Background(),
+			resource.WithAttributes(attribute.String("service.name", "tiler")),
+			resource.WithFromEnv(),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+		traceProvider = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(res),
+		)
+		otel.SetTracerProvider(traceProvider)
+	}
+
+	jobCtx, jobSpan = tracer.Start(context.Background(), "job", trace.WithAttributes(
+		attribute.StringSlice("tiler.inputs", inputs),
+		attribute.String("tiler.output", flagOutDir),
+	))
+}
+
+// endTrace closes the job span, marking it failed if err is not nil, and
+// flushes any spans not yet exported.
+func endTrace(err error) {
+	if err != nil {
+		jobSpan.RecordError(err)
+		jobSpan.SetStatus(codes.Error, err.Error())
+	}
+	tiles, bytes := stats.Totals()
+	jobSpan.SetAttributes(
+		attribute.Int("tiler.tiles", tiles),
+		attribute.Int64("tiler.bytes", bytes),
+		attribute.Int("tiler.failed", failures.Len()),
+	)
+	jobSpan.End()
+
+	if traceProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := traceProvider.Shutdown(ctx); err != nil {
+		log.Println("trace:", err)
+	}
+}
+
+// endSpan closes span, marking it failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	flagRotate float64
+	flagAffine string
+)
+
+func init() {
+	flag.Float64Var(&flagRotate, "rotate-deg", 0, "rotate the source clockwise by this many degrees before tiling, expanding the canvas to fit")
+	flag.StringVar(&flagAffine, "affine", "", "apply the 2x3 affine matrix a,b,c,d,e,f (x' = ax+by+c, y' = dx+ey+f) to the source before tiling")
+}
+
+// loadSource decodes the source at path and applies the corrections
+// requested by flags.
+func loadSource(path string) (image.Image, error) {
+	defer timings.Since(stageDecode, 0, time.Now())
+
+	if flagCacheDir != "" {
+		return loadCached(path)
+	}
+	img, err := decodeFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return preprocess(img)
+}
+
+// preprocess applies the source corrections requested by flags, in order.
+func preprocess(img image.Image) (image.Image, error) {
+	if flagColorKey != "" {
+		key, tol, err := parseColorKey(flagColorKey)
+		if err != nil {
+			return nil, err
+		}
+		img = keyColor(img, key, tol)
+	}
+	if flagFlatField != "" {
+		flat, err := decodeFile(flagFlatField)
+		if err != nil {
+			return nil, err
+		}
+		img = correctFlatField(img, flat)
+	}
+	if flagVignette != 0 {
+		img = correctVignette(img, flagVignette)
+	}
+	if flagBands != "" || flagBandMath != "" {
+		var err error
+		if img, err = selectBands(img); err != nil {
+			return nil, err
+		}
+	}
+	if flagLens != "" {
+		p, err := parseLens(flagLens)
+		if err != nil {
+			return nil, err
+		}
+		img = undistort(img, p)
+	}
+	if flagAffine != "" {
+		m, err := parseAffine(flagAffine)
+		if err != nil {
+			return nil, err
+		}
+		if img, err = affine(img, m); err != nil {
+			return nil, err
+		}
+	}
+	if flagRotate != 0 {
+		img = rotate(img, flagRotate)
+	}
+	return img, nil
+}
+
+// parseAffine parses the six comma separated coefficients of -affine.
+func parseAffine(s string) ([6]float64, error) {
+	var m [6]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != len(m) {
+		return m, fmt.Errorf("invalid affine matrix %q: want a,b,c,d,e,f", s)
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return m, fmt.Errorf("invalid affine matrix %q: %v", s, err)
+		}
+		m[i] = v
+	}
+	return m, nil
+}
+
+// affine maps img through m, where a source pixel at (x, y) lands at
+// (m0*x + m1*y + m2, m3*x + m4*y + m5). The canvas spans the origin and
+// every transformed corner, so translations add margin rather than
+// cropping.
+func affine(img image.Image, m [6]float64) (*image.RGBA, error) {
+	det := m[0]*m[4] - m[1]*m[3]
+	if det == 0 {
+		return nil, errors.New("affine matrix is not invertible")
+	}
+
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+
+	minX, minY, maxX, maxY := 0.0, 0.0, 0.0, 0.0
+	for _, p := range [][2]float64{{0, 0}, {w, 0}, {0, h}, {w, h}} {
+		x := m[0]*p[0] + m[1]*p[1] + m[2]
+		y := m[3]*p[0] + m[4]*p[1] + m[5]
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	dst := image.Rect(0, 0, int(math.Ceil(maxX-minX)), int(math.Ceil(maxY-minY)))
+
+	return warp(img, dst, func(x, y float64) (float64, float64) {
+		x, y = x+minX-m[2], y+minY-m[5]
+		return (m[4]*x - m[1]*y) / det, (m[0]*y - m[3]*x) / det
+	}), nil
+}
+
+// rotate returns img rotated clockwise by deg degrees about its center, on a
+// canvas large enough to hold every rotated pixel. Uncovered pixels are
+// transparent.
+func rotate(img image.Image, deg float64) *image.RGBA {
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+
+	sin, cos := math.Sincos(deg * math.Pi / 180)
+	nw := math.Abs(w*cos) + math.Abs(h*sin)
+	nh := math.Abs(w*sin) + math.Abs(h*cos)
+	dst := image.Rect(0, 0, int(math.Ceil(nw-1e-9)), int(math.Ceil(nh-1e-9)))
+
+	cx, cy := w/2, h/2
+	ncx, ncy := float64(dst.Dx())/2, float64(dst.Dy())/2
+
+	return warp(img, dst, func(x, y float64) (float64, float64) {
+		dx, dy := x-ncx, y-ncy
+		return cx + dx*cos + dy*sin, cy - dx*sin + dy*cos
+	})
+}
+
+// warp renders dst by mapping the center of every destination pixel back
+// into img through inv, which works in coordinates relative to the
+// top-left corner of img, and sampling there bilinearly.
+func warp(img image.Image, dst image.Rectangle, inv func(x, y float64) (float64, float64)) *image.RGBA {
+	src := toRGBA(img)
+	out := image.NewRGBA(dst)
+
+	for y := dst.Min.Y; y < dst.Max.Y; y++ {
+		for x := dst.Min.X; x < dst.Max.X; x++ {
+			sx, sy := inv(float64(x)+0.5, float64(y)+0.5)
+			out.SetRGBA(x, y, bilinear(src, sx-0.5, sy-0.5))
+		}
+	}
+	return out
+}
+
+// bilinear samples img at the fractional pixel position x, y. Positions
+// outside the image blend towards transparent.
+func bilinear(img *image.RGBA, x, y float64) color.RGBA {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+
+	b := img.Bounds()
+	at := func(px, py int) [4]float64 {
+		if px < 0 || py < 0 || px >= b.Dx() || py >= b.Dy() {
+			return [4]float64{}
+		}
+		i := img.PixOffset(b.Min.X+px, b.Min.Y+py)
+		p := img.Pix[i : i+4 : i+4]
+		return [4]float64{float64(p[0]), float64(p[1]), float64(p[2]), float64(p[3])}
+	}
+
+	c00, c10 := at(ix, iy), at(ix+1, iy)
+	c01, c11 := at(ix, iy+1), at(ix+1, iy+1)
+
+	var v [4]uint8
+	for i := range v {
+		top := c00[i]*(1-fx) + c10[i]*fx
+		bottom := c01[i]*(1-fx) + c11[i]*fx
+		v[i] = uint8(math.Round(top*(1-fy) + bottom*fy))
+	}
+	return color.RGBA{v[0], v[1], v[2], v[3]}
+}
+
+// toRGBA returns img as an *image.RGBA anchored at the origin, converting
+// it only if necessary.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(b.Sub(b.Min))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var flagCacheTTL = zoomFlag{check: func(v string) error {
+	if _, err := time.ParseDuration(v); err != nil {
+		return fmt.Errorf("invalid cache TTL %q", v)
+	}
+	return nil
+}}
+
+func init() {
+	flag.Var(&flagCacheTTL, "cache-ttl", "cache TTL recorded in the manifest and sent as Cache-Control by serve, -upload and push, optionally per zoom, e.g. 1h,0-5=720h")
+}
+
+// cacheTTL returns how long tiles of zoom may be cached, or 0 if no TTL
+// was declared.
+func cacheTTL(zoom int) time.Duration {
+	v := flagCacheTTL.For(zoom)
+	if v == "" {
+		return 0
+	}
+	d, _ := time.ParseDuration(v)
+	return d
+}
+
+// cacheControl returns the Cache-Control header for tiles cached for ttl,
+// or "" if they have none.
+func cacheControl(ttl time.Duration) string {
+	if ttl <= 0 {
+		return ""
+	}
+	return "public, max-age=" + strconv.Itoa(int(ttl.Seconds()))
+}
+
+// uploadTTLs gives the Cache-Control of files uploaded to an object store
+// by name: tiles named by -p get the TTL of their zoom, other files none.
+type uploadTTLs struct {
+	zoom *regexp.Regexp
+	ttl  func(zoom int) time.Duration
+}
+
+// newUploadTTLs returns the uploadTTLs of tiles cached for ttl(zoom).
+// Without {zoom} in -p no tile can be told apart, so none gets a TTL.
+func newUploadTTLs(ttl func(zoom int) time.Duration) uploadTTLs {
+	re, _ := zoomRegexp(flagPattern)
+	return uploadTTLs{re, ttl}
+}
+
+func (u uploadTTLs) CacheControl(name string) string {
+	if u.zoom == nil {
+		return ""
+	}
+	m := u.zoom.FindStringSubmatch(name)
+	if m == nil {
+		return ""
+	}
+	z, _ := strconv.Atoi(m[1])
+	return cacheControl(u.ttl(z))
+}
+
+// manifestTTLs returns the TTLs the manifest at path records per zoom.
+func manifestTTLs(path string) (func(zoom int) time.Duration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		TTL map[int]int64 `json:"cache_ttl_seconds"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return func(zoom int) time.Duration { return time.Duration(m.TTL[zoom]) * time.Second }, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+var flagUniform bool
+
+func init() {
+	flag.BoolVar(&flagUniform, "uniform", false, "encode single-color tiles minimally and hardlink repeats to one shared file")
+}
+
+// uniformDir holds the shared copy of each distinct single-color tile,
+// relative to the output directory.
+const uniformDir = ".uniform"
+
+// uniformColor reports whether every pixel of img has the same color.
+func uniformColor(img *image.RGBA) (color.RGBA, bool) {
+	b := img.Bounds()
+	first := img.PixOffset(b.Min.X, b.Min.Y)
+	c := color.RGBA{img.Pix[first], img.Pix[first+1], img.Pix[first+2], img.Pix[first+3]}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			if row[i] != c.R || row[i+1] != c.G || row[i+2] != c.B || row[i+3] != c.A {
+				return color.RGBA{}, false
+			}
+		}
+	}
+	return c, true
+}
+
+// encodeUniform encodes a tileSize square of c. PNG tiles use a one-entry
+// palette, which compresses to a few hundred bytes at any size.
+func encodeUniform(buf *bytes.Buffer, c color.RGBA, tileSize int, encoding string, quality int) error {
+	rect := image.Rect(0, 0, tileSize, tileSize)
+	if encoding == "png" {
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		return enc.Encode(buf, image.NewPaletted(rect, color.Palette{c}))
+	}
+	tile := image.NewRGBA(rect)
+	draw.Draw(tile, rect, image.NewUniform(c), image.Point{}, draw.Src)
+	return encodeTile(buf, tile, encoding, quality)
+}
+
+// uniformTiles tracks the shared files that identical single-color tiles
+// are hardlinked to.
+type uniformTiles struct {
+	mu     sync.Mutex
+	shared map[string]bool
+}
+
+var uniforms = uniformTiles{shared: make(map[string]bool)}
+
+// Link stores data at path as a hardlink to the shared tile for key,
+// creating the shared tile first if needed. If linking is not possible the
+// tile is written as a regular file.
+func (u *uniformTiles) Link(path, key string, data []byte) error {
+	shared := filepath.Join(flagOutDir, uniformDir, key)
+
+	u.mu.Lock()
+	if !u.shared[key] {
+		if err := ensureDir(filepath.Dir(shared)); err != nil {
+			u.mu.Unlock()
+			return err
+		}
+		if err := tiler.WriteFile(shared, data); err != nil {
+			u.mu.Unlock()
+			return err
+		}
+		u.shared[key] = true
+	}
+	u.mu.Unlock()
+
+	if err := ensureDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(shared, path); err == nil {
+		return nil
+	}
+	return tiler.WriteFile(path, data)
+}
+
+// uniformKey names the shared file for a tile of color c.
+func uniformKey(c color.RGBA, tileSize int) string {
+	return fmt.Sprintf("%02x%02x%02x%02x_%d.%s", c.R, c.G, c.B, c.A, tileSize, flagEncoding)
+}
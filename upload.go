@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"mime"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	flagUpload       string
+	flagUploadBuffer byteSize = 256 << 20
+)
+
+func init() {
+	flag.StringVar(&flagUpload, "upload", "", "write the tiles straight to this s3://bucket/prefix, gs://bucket/prefix or az://container/prefix instead of the output directory, which still receives the manifest and other run files")
+	flag.Var(&flagUploadBuffer, "upload-buffer", "-upload: encoded tiles held waiting for upload, e.g. 256M; rendering pauses while the buffer is full")
+}
+
+// remoteWriter uploads tiles to an object store as they are written.
+// Uploads run on -upload-concurrency connections behind a buffer bounded
+// in bytes: once it is full WriteTile blocks, holding up the worker that
+// rendered the tile and so the rest of the pipeline, until uploads catch
+// up. A throttling store, or -bandwidth-limit, slows the run down rather
+// than filling memory.
+type remoteWriter struct {
+	bucket objectStore
+	ttls   uploadTTLs
+	queue  chan remoteTile
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	space    *sync.Cond
+	buffered int64
+}
+
+// remoteTile is a tile waiting for upload.
+type remoteTile struct {
+	name string
+	data []byte
+}
+
+// openRemote starts uploading to dest.
+func openRemote(dest string) (*remoteWriter, error) {
+	b, err := openBucket(dest)
+	if err != nil {
+		return nil, err
+	}
+	w := &remoteWriter{bucket: b, ttls: newUploadTTLs(cacheTTL), queue: make(chan remoteTile, flagUploadConcurrency)}
+	w.space = sync.NewCond(&w.mu)
+	for i := 0; i < flagUploadConcurrency; i++ {
+		w.wg.Add(1)
+		go w.upload()
+	}
+	return w, nil
+}
+
+// Mkdir does nothing: object keys carry their directories.
+func (*remoteWriter) Mkdir(string) error { return nil }
+
+// WriteTile queues the tile for upload, waiting for room in the buffer. A
+// tile larger than the whole buffer waits for it to empty.
+func (w *remoteWriter) WriteTile(name string, data []byte) error {
+	n := int64(len(data))
+	w.mu.Lock()
+	for w.buffered > 0 && w.buffered+n > int64(flagUploadBuffer) {
+		w.space.Wait()
+	}
+	w.buffered += n
+	w.mu.Unlock()
+
+	// data is a pooled buffer the caller reuses once this returns.
+	w.queue <- remoteTile{filepath.ToSlash(name), append([]byte(nil), data...)}
+	return nil
+}
+
+// upload sends queued tiles until Close. Failures are recorded as tile
+// failures, as the tile was already counted as written.
+func (w *remoteWriter) upload() {
+	defer w.wg.Done()
+	for t := range w.queue {
+		ctype := mime.TypeByExtension(path.Ext(t.name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		key, cc := w.bucket.objectKey(t.name), w.ttls.CacheControl(t.name)
+		if err := retry(func() error { return w.bucket.Put(key, t.data, ctype, cc) }); err != nil {
+			log.Printf("%s: upload: %v", t.name, err)
+			failures.Add(t.name, err)
+		}
+
+		w.mu.Lock()
+		w.buffered -= int64(len(t.data))
+		w.space.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// Close waits for every queued tile to be uploaded.
+func (w *remoteWriter) Close() error {
+	close(w.queue)
+	w.wg.Wait()
+	return nil
+}
+
+// remoteOut is the writer for -upload, closed by finishRun.
+var remoteOut *remoteWriter
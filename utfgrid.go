@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	flagUTFGrid     string
+	flagUTFGridData string
+	flagUTFGridRes  int
+)
+
+func init() {
+	flag.StringVar(&flagUTFGrid, "utfgrid", "", "write UTFGrid tiles from this ID mask, whose distinct colors identify features covering the source")
+	flag.StringVar(&flagUTFGridData, "utfgrid-data", "", "JSON file mapping ID mask colors (e.g. \"#ff0000\") to feature data; other colors are ignored")
+	flag.IntVar(&flagUTFGridRes, "utfgrid-res", 4, "tile pixels per UTFGrid cell")
+}
+
+// idMask is the raster given to -utfgrid. It is stretched over the same
+// extent as the source, and sampled by nearest neighbour so IDs are never
+// blended.
+type idMask struct {
+	img  image.Image
+	data map[string]json.RawMessage
+}
+
+var gridMask *idMask
+
+// utfGrid is one UTFGrid 1.3 tile.
+type utfGrid struct {
+	Grid []string                   `json:"grid"`
+	Keys []string                   `json:"keys"`
+	Data map[string]json.RawMessage `json:"data,omitempty"`
+}
+
+func loadIDMask() (*idMask, error) {
+	if flagUTFGridRes <= 0 {
+		return nil, fmt.Errorf("-utfgrid-res must be a positive integer")
+	}
+	img, err := decodeFile(flagUTFGrid)
+	if err != nil {
+		return nil, err
+	}
+	m := &idMask{img: img}
+
+	if flagUTFGridData != "" {
+		b, err := ioutil.ReadFile(flagUTFGridData)
+		if err != nil {
+			return nil, err
+		}
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %v", flagUTFGridData, err)
+		}
+		m.data = make(map[string]json.RawMessage)
+		for k, v := range raw {
+			c, err := parseColor(k)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", flagUTFGridData, err)
+			}
+			m.data[maskKey(c)] = v
+		}
+	}
+	return m, nil
+}
+
+// maskKey returns the UTFGrid key of the feature with mask color c, or ""
+// if c marks no feature.
+func maskKey(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if n.A == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%02x%02x%02x", n.R, n.G, n.B)
+}
+
+// Grid builds the UTFGrid of tile x, y at level.
+func (m *idMask) Grid(tileSize, x, y, level int) utfGrid {
+	res := flagUTFGridRes
+	cells := (tileSize + res - 1) / res
+	extent := float64(int(1)<<uint(level)) * float64(tileSize)
+	b := m.img.Bounds()
+
+	g := utfGrid{Keys: []string{""}}
+	ids := map[string]int{"": 0}
+	for gy := 0; gy < cells; gy++ {
+		var row strings.Builder
+		for gx := 0; gx < cells; gx++ {
+			// Sample the centre of the cell.
+			px := float64(x*tileSize+gx*res) + float64(res)/2
+			py := float64(y*tileSize+gy*res) + float64(res)/2
+			mx := b.Min.X + int(px/extent*float64(b.Dx()))
+			my := b.Min.Y + int(py/extent*float64(b.Dy()))
+
+			key := maskKey(m.img.At(mx, my))
+			if m.data != nil {
+				if _, ok := m.data[key]; !ok {
+					key = ""
+				}
+			}
+			id, ok := ids[key]
+			if !ok {
+				id = len(g.Keys)
+				ids[key] = id
+				g.Keys = append(g.Keys, key)
+				if m.data != nil {
+					if g.Data == nil {
+						g.Data = make(map[string]json.RawMessage)
+					}
+					g.Data[key] = m.data[key]
+				}
+			}
+			row.WriteRune(gridRune(id))
+		}
+		g.Grid = append(g.Grid, row.String())
+	}
+	return g
+}
+
+// gridRune encodes a key index as specified by UTFGrid, skipping the
+// characters that would need escaping in JSON.
+func gridRune(id int) rune {
+	r := rune(id + 32)
+	if r >= 34 {
+		r++
+	}
+	if r >= 92 {
+		r++
+	}
+	return r
+}
+
+// writeGrid writes the UTFGrid of a tile next to the image tile name.
+func writeGrid(name string, tileSize, x, y, level int) error {
+	data, err := json.Marshal(gridMask.Grid(tileSize, x, y, level))
+	if err != nil {
+		return err
+	}
+	grid := strings.TrimSuffix(name, filepath.Ext(name)) + ".grid.json"
+	data = sealTile(grid, data)
+	return retry(func() error { return output.WriteTile(grid, data) })
+}
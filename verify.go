@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	flagDeep         bool
+	flagVerifySample float64
+)
+
+func init() {
+	flag.BoolVar(&flagDeep, "deep", false, "verify: decode every tile and check its dimensions")
+	flag.Float64Var(&flagVerifySample, "verify-sample", 1, "verify: fraction of tiles to check, chosen at random (1 checks all)")
+}
+
+// runVerify checks the tiles in the output directory before they are
+// published. Tiles listed in the -manifest must exist and match their
+// recorded ETag, and with -verify-key the manifest's signature must be
+// valid, proving the tiles are the ones the signer published. With -deep
+// every tile is also decoded and its dimensions checked, which catches
+// truncated and corrupt encodes.
+func runVerify(args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: tiler verify [flags]")
+		os.Exit(2)
+	}
+	if flagVerifySample <= 0 || flagVerifySample > 1 {
+		log.Fatalln("-verify-sample must be in (0, 1]")
+	}
+
+	var etags map[string]string
+	var m Manifest
+	if flagVerifyKey != "" && flagManifest == "" {
+		log.Fatalln("-verify-key needs -manifest")
+	}
+	if flagManifest != "" {
+		path := filepath.Join(flagOutDir, flagManifest)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if flagVerifyKey != "" {
+			pub, err := loadVerifyKey(flagVerifyKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := checkSignature(path, data, pub); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("manifest signature valid")
+		}
+		if err := json.Unmarshal(data, &m); err != nil {
+			log.Fatal(err)
+		}
+		etags = make(map[string]string, len(m.Tiles)+len(m.Missing))
+		for name, etag := range m.Tiles {
+			etags[name] = etag
+		}
+		for name, etag := range m.Missing {
+			etags[name] = etag
+		}
+		flagEncrypt = flagEncrypt || m.Encryption != nil
+	} else if !flagDeep {
+		log.Fatalln("verify needs -manifest, -deep or both")
+	}
+
+	var key *tileSealer
+	if flagEncrypt && flagDeep {
+		var err error
+		if key, err = loadTileKey(); err != nil {
+			log.Fatal(err)
+		}
+		if m.Encryption != nil && m.Encryption.KeyID != key.keyID {
+			log.Fatalf("tiles were encrypted with key %s, not %s", m.Encryption.KeyID, key.keyID)
+		}
+	}
+
+	names, err := verifyNames(etags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var dims map[string]image.Point
+	if flagDeep {
+		if dims, err = shortTileDims(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	checked, bad := 0, 0
+	for _, name := range names {
+		if flagVerifySample < 1 && rand.Float64() >= flagVerifySample {
+			continue
+		}
+		checked++
+		if err := verifyTile(name, etags[name], key, dims); err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			bad++
+		}
+	}
+
+	fmt.Printf("%d of %d tiles checked, %d bad\n", checked, len(names), bad)
+	if bad > 0 {
+		os.Exit(1)
+	}
+}
+
+// verifyNames returns the tiles to verify: those in etags if a manifest
+// was read, otherwise every tile image found in the output directory.
+func verifyNames(etags map[string]string) ([]string, error) {
+	var names []string
+	if etags != nil {
+		for name := range etags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+
+	err := filepath.Walk(flagOutDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == uniformDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".png", ".jpg", ".jpeg", ".webp", ".avif":
+			rel, err := filepath.Rel(flagOutDir, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return names, err
+}
+
+// verifyTile checks the tile stored at the relative path name against
+// etag, if not empty, and with -deep decrypts it with key, if not nil, and
+// decodes it. Its dimensions must be those dims records for it, or else a
+// tile size.
+func verifyTile(name, etag string, key *tileSealer, dims map[string]image.Point) error {
+	data, err := ioutil.ReadFile(filepath.Join(flagOutDir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	if etag != "" && ETag(data) != etag {
+		return fmt.Errorf("ETag mismatch")
+	}
+	if !flagDeep {
+		return nil
+	}
+	if key != nil {
+		if data, err = key.Open(name, data); err != nil {
+			return fmt.Errorf("decrypt: %v", err)
+		}
+	}
+	if strings.HasSuffix(name, ".avif") {
+		// There is no AVIF decoder to check the contents with.
+		return nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("decode: %v", err)
+	}
+	b := img.Bounds()
+	if want, ok := dims[name]; ok {
+		if b.Size() != want {
+			return fmt.Errorf("unexpected dimensions %dx%d, want %dx%d", b.Dx(), b.Dy(), want.X, want.Y)
+		}
+		return nil
+	}
+	for _, size := range flagTileSizes {
+		if b.Dx() == size && b.Dy() == size {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected dimensions %dx%d", b.Dx(), b.Dy())
+}
+
+// shortTileDims returns the dimensions of the Deep Zoom and IIIF tiles in
+// the output directory, by their relative path, from the descriptors the
+// pyramids were written with. Their edge tiles are cut short, and Deep Zoom
+// tiles overlap their neighbours.
+func shortTileDims() (map[string]image.Point, error) {
+	dims := make(map[string]image.Point)
+	descs, err := filepath.Glob(filepath.Join(flagOutDir, "*.dzi"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range descs {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var desc dziImage
+		if err := xml.Unmarshal(data, &desc); err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		w, h, size := desc.Size.Width, desc.Size.Height, desc.TileSize
+		if size <= 0 {
+			return nil, fmt.Errorf("%s: invalid TileSize %d", p, size)
+		}
+		files := strings.TrimSuffix(filepath.Base(p), ".dzi") + "_files"
+		top := dziLevels(w, h)
+		for z := 0; z <= top; z++ {
+			lw, lh := dziLevelSize(w, h, top-z)
+			b := image.Rect(0, 0, lw, lh)
+			for y := 0; y*size < lh; y++ {
+				for x := 0; x*size < lw; x++ {
+					dims[dziTileName(files, z, x, y, desc.Format)] = shortTileRect(x, y, size, desc.Overlap, b).Size()
+				}
+			}
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(flagOutDir, "info.json"))
+	if os.IsNotExist(err) {
+		return dims, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var info iiifInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("info.json: %v", err)
+	}
+	if len(info.Tiles) == 0 || info.Tiles[0].Width <= 0 {
+		return dims, nil
+	}
+	w, h, size := info.Width, info.Height, info.Tiles[0].Width
+	ext := "jpg"
+	for _, p := range info.Profile {
+		if f, ok := p.(map[string]interface{}); ok {
+			if formats, ok := f["formats"].([]interface{}); ok && len(formats) > 0 {
+				ext, _ = formats[0].(string)
+			}
+		}
+	}
+	top := iiifTop(w, h, size)
+	for z := 0; z <= top; z++ {
+		s := 1 << uint(top-z)
+		lw, lh := dziLevelSize(w, h, top-z)
+		b := image.Rect(0, 0, lw, lh)
+		for y := 0; y*size < lh; y++ {
+			for x := 0; x*size < lw; x++ {
+				dims[iiifTileName(b, w, h, size, s, x, y, ext)] = shortTileRect(x, y, size, 0, b).Size()
+			}
+		}
+	}
+	return dims, nil
+}
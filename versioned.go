@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/randomsean/tiler/tiler"
+)
+
+var flagVersioned bool
+
+func init() {
+	flag.BoolVar(&flagVersioned, "versioned", false, "write each run into a new timestamped directory below the output directory and point current at it once the run succeeds; earlier versions are kept for tiler rollback")
+}
+
+// versionLayout is the format of version directory names, which sort in
+// the order the runs started.
+const versionLayout = "20060102T150405Z"
+
+// currentLink is the name of the pointer to the published version.
+const currentLink = "current"
+
+// versionRoot is the output directory given by -o of a -versioned run,
+// whose version directory flagOutDir is switched to.
+var versionRoot string
+
+// startVersion switches the output directory of a -versioned run to a new
+// version directory. tiler retry carries on with the latest version
+// instead, which a failed run leaves unpublished.
+func startVersion() error {
+	versionRoot = flagOutDir
+	if err := ensureDir(versionRoot); err != nil {
+		return err
+	}
+	if retrying {
+		versions, err := listVersions(versionRoot)
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			return fmt.Errorf("%s: no versions to retry", versionRoot)
+		}
+		flagOutDir = filepath.Join(versionRoot, versions[len(versions)-1])
+		return nil
+	}
+
+	stamp := time.Now().UTC().Format(versionLayout)
+	name := stamp
+	for i := 2; ; i++ {
+		err := os.Mkdir(filepath.Join(versionRoot, name), 0755)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		name = fmt.Sprintf("%s-%d", stamp, i)
+	}
+	flagOutDir = filepath.Join(versionRoot, name)
+	log.Printf("writing version %s", name)
+	return nil
+}
+
+// publishVersion points current at the version the run wrote.
+func publishVersion() error {
+	version := filepath.Base(flagOutDir)
+	if err := setCurrent(versionRoot, version); err != nil {
+		return err
+	}
+	log.Printf("published version %s", version)
+	return nil
+}
+
+// setCurrent atomically points current below root at version. Where
+// symbolic links are unavailable current is a file holding the name.
+func setCurrent(root, version string) error {
+	link := filepath.Join(root, currentLink)
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(version, tmp); err != nil {
+		return tiler.WriteFile(link, []byte(version+"\n"))
+	}
+	return os.Rename(tmp, link)
+}
+
+// currentVersion returns the version current below root points at, or ""
+// if none was published.
+func currentVersion(root string) (string, error) {
+	link := filepath.Join(root, currentLink)
+	if version, err := os.Readlink(link); err == nil {
+		return filepath.Base(version), nil
+	}
+	data, err := ioutil.ReadFile(link)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// listVersions returns the version directories below root, oldest first.
+func listVersions(root string) ([]string, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || len(name) < len(versionLayout) {
+			continue
+		}
+		if _, err := time.Parse(versionLayout, name[:len(versionLayout)]); err == nil {
+			versions = append(versions, name)
+		}
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// runRollback points current at an earlier version of a -versioned
+// output directory:
+//
+//	tiler rollback [flags] [version]
+//
+// Without a version it rolls back to the one before the current one.
+func runRollback(args []string) {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: tiler rollback [flags] [version]")
+		os.Exit(2)
+	}
+	root := flagOutDir
+	versions, err := listVersions(root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	current, err := currentVersion(root)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var target string
+	if len(args) == 1 {
+		target = args[0]
+		i := sort.SearchStrings(versions, target)
+		if i == len(versions) || versions[i] != target {
+			log.Fatalf("%s: no version %s", root, target)
+		}
+	} else {
+		i := sort.SearchStrings(versions, current)
+		if current == "" || i == len(versions) || versions[i] != current {
+			log.Fatalf("%s: no current version to roll back from", root)
+		}
+		if i == 0 {
+			log.Fatalf("%s: %s is the oldest version", root, current)
+		}
+		target = versions[i-1]
+	}
+
+	if err := setCurrent(root, target); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("current is now %s (was %s)", target, current)
+}
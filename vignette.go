@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+var (
+	flagVignette  float64
+	flagFlatField string
+)
+
+func init() {
+	flag.Float64Var(&flagVignette, "vignette", 0, "brighten pixels by 1+s*r² towards the corners to undo vignetting (r is 1 at the corners)")
+	flag.StringVar(&flagFlatField, "flat-field", "", "correct vignetting by dividing the source by this flat-field reference image")
+}
+
+// correctVignette brightens img towards its corners with the parametric
+// gain 1 + strength*r², where r is the distance from the center relative
+// to the half diagonal.
+func correctVignette(img image.Image, strength float64) *image.RGBA {
+	out := cloneRGBA(img)
+	b := out.Bounds()
+	cx, cy := float64(b.Dx())/2, float64(b.Dy())/2
+	norm := cx*cx + cy*cy
+
+	for y := 0; y < b.Dy(); y++ {
+		dy := float64(y) + 0.5 - cy
+		for x := 0; x < b.Dx(); x++ {
+			dx := float64(x) + 0.5 - cx
+			g := 1 + strength*(dx*dx+dy*dy)/norm
+			applyGain(out, x, y, [3]float64{g, g, g})
+		}
+	}
+	return out
+}
+
+// correctFlatField divides img by the flat-field reference, normalized by
+// the reference's mean per channel, so regions the optics darken in the
+// reference are brightened by the same factor.
+func correctFlatField(img, flat image.Image) *image.RGBA {
+	out := cloneRGBA(img)
+	b := out.Bounds()
+
+	ref := toRGBA(flat)
+	if ref.Bounds().Size() != b.Size() {
+		ref = toRGBA(resize.Resize(uint(b.Dx()), uint(b.Dy()), flat, resize.Bilinear))
+	}
+
+	var mean [3]float64
+	for i := 0; i < len(ref.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			mean[c] += float64(ref.Pix[i+c])
+		}
+	}
+	n := float64(len(ref.Pix) / 4)
+	for c := range mean {
+		mean[c] /= n
+	}
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			i := ref.PixOffset(x, y)
+			var g [3]float64
+			for c := 0; c < 3; c++ {
+				g[c] = mean[c] / math.Max(float64(ref.Pix[i+c]), 1)
+			}
+			applyGain(out, x, y, g)
+		}
+	}
+	return out
+}
+
+// applyGain scales the color channels of one pixel, keeping them within
+// the premultiplied alpha.
+func applyGain(img *image.RGBA, x, y int, gain [3]float64) {
+	i := img.PixOffset(x, y)
+	a := float64(img.Pix[i+3])
+	for c := 0; c < 3; c++ {
+		img.Pix[i+c] = uint8(math.Min(math.Round(float64(img.Pix[i+c])*gain[c]), a))
+	}
+}
+
+// cloneRGBA returns a modifiable copy of img anchored at the origin.
+func cloneRGBA(img image.Image) *image.RGBA {
+	src := toRGBA(img)
+	if src != img {
+		return src
+	}
+	out := image.NewRGBA(src.Rect)
+	copy(out.Pix, src.Pix)
+	return out
+}
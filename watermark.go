@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	flagWatermark        string
+	flagWatermarkText    string
+	flagWatermarkPos     string
+	flagWatermarkOpacity float64
+	flagWatermarkMargin  int
+)
+
+func init() {
+	flag.StringVar(&flagWatermark, "watermark", "", "composite this image onto every tile, scaled down for tiles it does not fit")
+	flag.StringVar(&flagWatermarkText, "watermark-text", "", "stamp this text, such as attribution or licensing, onto every tile")
+	flag.StringVar(&flagWatermarkPos, "watermark-pos", "bottom-right", "where the watermark goes on each tile: top-left, top, top-right, left, center, right, bottom-left, bottom or bottom-right")
+	flag.Float64Var(&flagWatermarkOpacity, "watermark-opacity", 0.5, "opacity of the watermark, from 0 to 1")
+	flag.IntVar(&flagWatermarkMargin, "watermark-margin", 8, "pixels between the watermark and the edges of the tile")
+}
+
+// watermarkAnchors maps -watermark-pos to where the watermark sits in the
+// space the margins leave, from 0 (left or top) to 1 (right or bottom).
+var watermarkAnchors = map[string][2]float64{
+	"top-left":     {0, 0},
+	"top":          {0.5, 0},
+	"top-right":    {1, 0},
+	"left":         {0, 0.5},
+	"center":       {0.5, 0.5},
+	"right":        {1, 0.5},
+	"bottom-left":  {0, 1},
+	"bottom":       {0.5, 1},
+	"bottom-right": {1, 1},
+}
+
+// watermark is the image drawn onto every tile, or nil.
+var watermark *image.RGBA
+
+// watermarkFits caches watermark scaled down to fit tiles of each size,
+// keyed by image.Point.
+var watermarkFits sync.Map
+
+// loadWatermark validates the -watermark flags and loads the watermark.
+func loadWatermark() error {
+	if flagWatermark == "" && flagWatermarkText == "" {
+		return nil
+	}
+	switch {
+	case flagWatermark != "" && flagWatermarkText != "":
+		return errors.New("-watermark and -watermark-text cannot be combined")
+	case flagWatermarkOpacity < 0 || flagWatermarkOpacity > 1:
+		return errors.New("-watermark-opacity must be between 0 and 1")
+	case flagWatermarkMargin < 0:
+		return errors.New("-watermark-margin cannot be negative")
+	}
+	if _, ok := watermarkAnchors[flagWatermarkPos]; !ok {
+		return fmt.Errorf("unknown -watermark-pos %q", flagWatermarkPos)
+	}
+
+	if flagWatermarkText != "" {
+		watermark = renderText(flagWatermarkText)
+		return nil
+	}
+	img, err := decodeFile(flagWatermark)
+	if err != nil {
+		return fmt.Errorf("-watermark: %v", err)
+	}
+	watermark = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(watermark, watermark.Rect, img, img.Bounds().Min, draw.Src)
+	return nil
+}
+
+// renderText draws s in white with a dark shadow, legible over light and
+// dark tiles alike, on a transparent image just large enough to hold it.
+func renderText(s string) *image.RGBA {
+	face := basicfont.Face7x13
+	w := font.MeasureString(face, s).Ceil()
+	m := image.NewRGBA(image.Rect(0, 0, w+1, face.Height+1))
+	d := font.Drawer{Dst: m, Face: face}
+	for _, pass := range []struct {
+		c   color.Color
+		off int
+	}{{color.RGBA{0, 0, 0, 0xc0}, 1}, {color.White, 0}} {
+		d.Src = image.NewUniform(pass.c)
+		d.Dot = fixed.P(pass.off, face.Ascent+pass.off)
+		d.DrawString(s)
+	}
+	return m
+}
+
+// fitWatermark returns the watermark scaled down, keeping its aspect
+// ratio, to fit within the margins of a tile of size, or nil if the
+// margins leave it no room.
+func fitWatermark(size image.Point) *image.RGBA {
+	room := size.Sub(image.Pt(2*flagWatermarkMargin, 2*flagWatermarkMargin))
+	if room.X <= 0 || room.Y <= 0 {
+		return nil
+	}
+	if m, ok := watermarkFits.Load(room); ok {
+		return m.(*image.RGBA)
+	}
+
+	m := watermark
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	if w > room.X || h > room.Y {
+		scale := float64(room.X) / float64(w)
+		if s := float64(room.Y) / float64(h); s < scale {
+			scale = s
+		}
+		fw, fh := int(float64(w)*scale), int(float64(h)*scale)
+		if fw < 1 || fh < 1 {
+			return nil
+		}
+		m = image.NewRGBA(image.Rect(0, 0, fw, fh))
+		draw.CatmullRom.Scale(m, m.Rect, watermark, watermark.Rect, draw.Src, nil)
+	}
+	watermarkFits.Store(room, m)
+	return m
+}
+
+// stampWatermark returns a copy of dst with the watermark drawn onto it,
+// leaving dst, which may share its pixels with the level, untouched.
+func stampWatermark(dst *image.RGBA) *image.RGBA {
+	mark := fitWatermark(dst.Rect.Size())
+	if mark == nil {
+		return dst
+	}
+	out := image.NewRGBA(dst.Rect)
+	draw.Draw(out, out.Rect, dst, dst.Rect.Min, draw.Src)
+
+	a := watermarkAnchors[flagWatermarkPos]
+	free := dst.Rect.Size().Sub(mark.Rect.Size()).Sub(image.Pt(2*flagWatermarkMargin, 2*flagWatermarkMargin))
+	at := dst.Rect.Min.Add(image.Pt(
+		flagWatermarkMargin+int(a[0]*float64(free.X)),
+		flagWatermarkMargin+int(a[1]*float64(free.Y)),
+	))
+	opacity := image.NewUniform(color.Alpha{uint8(flagWatermarkOpacity*255 + 0.5)})
+	draw.DrawMask(out, image.Rectangle{at, at.Add(mark.Rect.Size())}, mark, image.Point{}, opacity, image.Point{}, draw.Over)
+	return out
+}
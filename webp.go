@@ -0,0 +1,682 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"sort"
+)
+
+var (
+	flagWebPMode    string
+	flagWebPQuality int
+)
+
+func init() {
+	flag.StringVar(&flagWebPMode, "webp", "lossless", "WebP mode for -e webp: lossless, or lossy to trade fidelity for size by -webp-quality")
+	flag.IntVar(&flagWebPQuality, "webp-quality", 80, "lossy WebP quality from 1 to 100; lower values drop more low bits of every color")
+}
+
+// encodeWebP writes img as a WebP image in the lossless VP8L format. The
+// pixels are subtract-green and predictor transformed, then coded with
+// LZ77 backward references and one set of prefix codes. Lossy mode first
+// rounds colors to fewer significant bits, as WebP's near-lossless mode
+// does, so they predict and repeat better.
+//
+// There is no encoder for WebP's VP8 lossy format in Go, so lossy here
+// never produces DCT-coded images.
+func encodeWebP(w io.Writer, img image.Image, mode string, quality int) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return fmt.Errorf("webp: cannot encode a %dx%d image", width, height)
+	}
+	switch mode {
+	case "lossless":
+		quality = 100
+	case "lossy":
+		if quality < 1 || quality > 100 {
+			return fmt.Errorf("webp: quality %d is not between 1 and 100", quality)
+		}
+	default:
+		return fmt.Errorf("webp: unknown mode %q", mode)
+	}
+
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok || nrgba.Rect.Min != (image.Point{}) || nrgba.Stride != 4*width {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(nrgba, nrgba.Rect, img, b.Min, draw.Src)
+	}
+	pix := append([]byte(nil), nrgba.Pix...)
+
+	alpha := false
+	for i := 3; i < len(pix); i += 4 {
+		if pix[i] != 0xff {
+			alpha = true
+			break
+		}
+	}
+	if bits := uint((100 - quality + 19) / 20); bits > 0 {
+		dropBits(pix, bits)
+	}
+
+	var bw vp8lWriter
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+
+	// Transforms are undone in reverse, so the predictor is applied to
+	// the subtract-green output.
+	bw.write(1, 1)
+	bw.write(2, 2)
+	subtractGreen(pix)
+
+	bw.write(1, 1)
+	bw.write(0, 2)
+	bw.write(vp8lPredictorBits-2, 3)
+	modes, mw, mh := choosePredictors(pix, width, height)
+	writeEntropyImage(&bw, modes, mw, mh, false)
+	bw.write(0, 1)
+	writeEntropyImage(&bw, predictResiduals(pix, width, height, modes, mw), width, height, true)
+
+	data := bw.flush()
+	size := len(data)
+	riff := make([]byte, 20, 20+size+1)
+	copy(riff, "RIFF")
+	copy(riff[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(riff[16:], uint32(size))
+	riff = append(riff, data...)
+	if size%2 == 1 {
+		riff = append(riff, 0)
+	}
+	binary.LittleEndian.PutUint32(riff[4:], uint32(len(riff)-8))
+	_, err := w.Write(riff)
+	return err
+}
+
+// dropBits rounds the color channels of pix to multiples of 1<<bits.
+func dropBits(pix []byte, bits uint) {
+	for i := range pix {
+		if i%4 == 3 {
+			continue
+		}
+		v := (int(pix[i]) + 1<<(bits-1)) >> bits << bits
+		if v > 0xff {
+			v = 0xff
+		}
+		pix[i] = byte(v)
+	}
+}
+
+func subtractGreen(pix []byte) {
+	for i := 0; i < len(pix); i += 4 {
+		pix[i] -= pix[i+1]
+		pix[i+2] -= pix[i+1]
+	}
+}
+
+// vp8lPredictorBits sets the predictor transform's block size to 16.
+const vp8lPredictorBits = 4
+
+// choosePredictors picks for every block the predictor mode with the
+// smallest residuals, returning the modes as the green channel of an
+// mw by mh image.
+func choosePredictors(pix []byte, width, height int) ([]byte, int, int) {
+	size := 1 << vp8lPredictorBits
+	mw, mh := (width+size-1)/size, (height+size-1)/size
+	modes := make([]byte, 4*mw*mh)
+
+	var pred [4]byte
+	for by := 0; by < mh; by++ {
+		for bx := 0; bx < mw; bx++ {
+			best, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				cost := 0
+				for y := by * size; y < (by+1)*size && y < height; y++ {
+					for x := bx * size; x < (bx+1)*size && x < width; x++ {
+						p := 4 * (y*width + x)
+						predict(&pred, pix, p, width, x, y, mode)
+						for c := 0; c < 4; c++ {
+							cost += abs(int(int8(pix[p+c] - pred[c])))
+						}
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			q := 4 * (by*mw + bx)
+			modes[q+1], modes[q+3] = byte(best), 0xff
+		}
+	}
+	return modes, mw, mh
+}
+
+// predictResiduals returns the difference between every pixel and its
+// prediction by the mode of its block.
+func predictResiduals(pix []byte, width, height int, modes []byte, mw int) []byte {
+	res := make([]byte, len(pix))
+	var pred [4]byte
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := 4 * (y*width + x)
+			mode := int(modes[4*((y>>vp8lPredictorBits)*mw+x>>vp8lPredictorBits)+1])
+			predict(&pred, pix, p, width, x, y, mode)
+			for c := 0; c < 4; c++ {
+				res[p+c] = pix[p+c] - pred[c]
+			}
+		}
+	}
+	return res
+}
+
+// predict stores the prediction of the pixel at offset p, column x and
+// row y of pix with mode. The first row and column have fixed predictors.
+func predict(pred *[4]byte, pix []byte, p, width, x, y, mode int) {
+	switch {
+	case x == 0 && y == 0:
+		mode = 0
+	case y == 0:
+		mode = 1
+	case x == 0:
+		mode = 2
+	}
+	l, t := p-4, p-4*width
+	tl, tr := t-4, t+4
+	for c := 0; c < 4; c++ {
+		var v byte
+		switch mode {
+		case 0:
+			if c == 3 {
+				v = 0xff
+			}
+		case 1:
+			v = pix[l+c]
+		case 2:
+			v = pix[t+c]
+		case 3:
+			v = pix[tr+c]
+		case 4:
+			v = pix[tl+c]
+		case 5:
+			v = avg2(avg2(pix[l+c], pix[tr+c]), pix[t+c])
+		case 6:
+			v = avg2(pix[l+c], pix[tl+c])
+		case 7:
+			v = avg2(pix[l+c], pix[t+c])
+		case 8:
+			v = avg2(pix[tl+c], pix[t+c])
+		case 9:
+			v = avg2(pix[t+c], pix[tr+c])
+		case 10:
+			v = avg2(avg2(pix[l+c], pix[tl+c]), avg2(pix[t+c], pix[tr+c]))
+		case 11:
+			v = selectPredictor(pix, l, t, tl, c)
+		case 12:
+			v = clampByte(int(pix[l+c]) + int(pix[t+c]) - int(pix[tl+c]))
+		case 13:
+			a := int(avg2(pix[l+c], pix[t+c]))
+			v = clampByte(a + (a-int(pix[tl+c]))/2)
+		}
+		pred[c] = v
+	}
+}
+
+func avg2(a, b byte) byte {
+	return byte((int(a) + int(b)) / 2)
+}
+
+func clampByte(v int) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 0xff {
+		return 0xff
+	}
+	return byte(v)
+}
+
+// selectPredictor returns channel c of whichever of the left and top
+// pixels is closer to their gradient estimate.
+func selectPredictor(pix []byte, l, t, tl, c int) byte {
+	dl, dt := 0, 0
+	for i := 0; i < 4; i++ {
+		dl += abs(int(pix[tl+i]) - int(pix[t+i]))
+		dt += abs(int(pix[tl+i]) - int(pix[l+i]))
+	}
+	if dl < dt {
+		return pix[l+c]
+	}
+	return pix[t+c]
+}
+
+// VP8L symbol alphabets.
+const (
+	vp8lLiterals     = 256
+	vp8lLengthCodes  = 24
+	vp8lDistCodes    = 40
+	vp8lMaxLength    = 4096
+	vp8lMaxDistance  = 1<<20 - 121
+	vp8lHashChain    = 32
+	vp8lMinMatch     = 3
+	vp8lCodeLenCodes = 19
+)
+
+// vp8lToken is a literal pixel, or a backward reference when length is
+// not zero.
+type vp8lToken struct {
+	pixel    uint32
+	length   int
+	distCode int
+}
+
+// writeEntropyImage codes the width by height pixels in pix without a
+// color cache, and for the main image with a single prefix code group.
+func writeEntropyImage(w *vp8lWriter, pix []byte, width, height int, main bool) {
+	w.write(0, 1)
+	if main {
+		w.write(0, 1)
+	}
+
+	tokens := lz77(pix, width)
+	var counts [5][]uint32
+	counts[0] = make([]uint32, vp8lLiterals+vp8lLengthCodes)
+	for i := 1; i < 4; i++ {
+		counts[i] = make([]uint32, vp8lLiterals)
+	}
+	counts[4] = make([]uint32, vp8lDistCodes)
+	for _, t := range tokens {
+		if t.length == 0 {
+			counts[0][t.pixel>>8&0xff]++
+			counts[1][t.pixel&0xff]++
+			counts[2][t.pixel>>16&0xff]++
+			counts[3][t.pixel>>24]++
+			continue
+		}
+		code, _, _ := lz77Prefix(t.length)
+		counts[0][vp8lLiterals+code]++
+		code, _, _ = lz77Prefix(t.distCode)
+		counts[4][code]++
+	}
+
+	var codes [5]prefixCode
+	for i := range codes {
+		codes[i] = writePrefixCode(w, counts[i])
+	}
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].put(w, int(t.pixel>>8&0xff))
+			codes[1].put(w, int(t.pixel&0xff))
+			codes[2].put(w, int(t.pixel>>16&0xff))
+			codes[3].put(w, int(t.pixel>>24))
+			continue
+		}
+		code, n, extra := lz77Prefix(t.length)
+		codes[0].put(w, vp8lLiterals+code)
+		w.write(extra, n)
+		code, n, extra = lz77Prefix(t.distCode)
+		codes[4].put(w, code)
+		w.write(extra, n)
+	}
+}
+
+// lz77 greedily replaces runs of pixels seen before with backward
+// references, and returns the pixels as tokens. Pixels are packed with red
+// in the low byte, as in pix.
+func lz77(pix []byte, width int) []vp8lToken {
+	n := len(pix) / 4
+	px := make([]uint32, n)
+	for i := range px {
+		px[i] = binary.LittleEndian.Uint32(pix[4*i:])
+	}
+
+	const hashBits = 16
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+	hash := func(i int) uint32 {
+		return (px[i]*0x1e35a7bd ^ px[i+1]*0x9e3779b1) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+1 < n {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+	matchLen := func(i, j int) int {
+		l := 0
+		for i+l < n && l < vp8lMaxLength && px[i+l] == px[j+l] {
+			l++
+		}
+		return l
+	}
+
+	var tokens []vp8lToken
+	for i := 0; i < n; {
+		bestLen, bestDist := 0, 0
+		for _, d := range [...]int{1, width} {
+			if d <= i {
+				if l := matchLen(i, i-d); l > bestLen {
+					bestLen, bestDist = l, d
+				}
+			}
+		}
+		if i+1 < n {
+			for j, k := head[hash(i)], 0; j >= 0 && k < vp8lHashChain && i-int(j) <= vp8lMaxDistance; j, k = prev[j], k+1 {
+				if l := matchLen(i, int(j)); l > bestLen {
+					bestLen, bestDist = l, i-int(j)
+				}
+			}
+		}
+
+		if bestLen < vp8lMinMatch {
+			tokens = append(tokens, vp8lToken{pixel: px[i]})
+			insert(i)
+			i++
+			continue
+		}
+		tokens = append(tokens, vp8lToken{length: bestLen, distCode: distanceCode(bestDist, width)})
+		for end := i + bestLen; i < end; i++ {
+			insert(i)
+		}
+	}
+	return tokens
+}
+
+// distanceCode returns the VP8L distance code of a backward reference:
+// the short codes for the pixels left and above, otherwise the distance
+// offset past the 120 short codes.
+func distanceCode(dist, width int) int {
+	switch dist {
+	case width:
+		return 1
+	case 1:
+		return 2
+	}
+	return dist + 120
+}
+
+// lz77Prefix splits a length or distance code v, from 1, into a prefix
+// symbol and n extra bits.
+func lz77Prefix(v int) (code int, n uint, extra uint32) {
+	d := v - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	h := 0
+	for d>>uint(h+1) != 0 {
+		h++
+	}
+	second := d >> uint(h-1) & 1
+	n = uint(h - 1)
+	return 2*h + second, n, uint32(d) & (1<<n - 1)
+}
+
+// prefixCode holds the bit-reversed canonical code and length of every
+// symbol, ready for the LSB-first bit stream.
+type prefixCode struct {
+	codes   []uint32
+	lengths []uint8
+}
+
+func (c *prefixCode) put(w *vp8lWriter, symbol int) {
+	w.write(c.codes[symbol], uint(c.lengths[symbol]))
+}
+
+// writePrefixCode writes a prefix code for symbols occurring counts times
+// and returns it.
+func writePrefixCode(w *vp8lWriter, counts []uint32) prefixCode {
+	var used []int
+	for s, n := range counts {
+		if n > 0 {
+			used = append(used, s)
+		}
+	}
+	code := prefixCode{codes: make([]uint32, len(counts)), lengths: make([]uint8, len(counts))}
+
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		w.write(1, 1)
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		w.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(used[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.write(uint32(used[1]), 8)
+			code.codes[used[1]] = 1
+			code.lengths[used[0]], code.lengths[used[1]] = 1, 1
+		}
+		return code
+	}
+
+	lengths := huffmanLengths(counts, 15)
+	tokens, extras := codeLengthTokens(lengths)
+	clCounts := make([]uint32, vp8lCodeLenCodes)
+	for _, t := range tokens {
+		clCounts[t]++
+	}
+	clLengths := huffmanLengths(clCounts, 7)
+	clCode := canonicalCode(clLengths)
+
+	n := 4
+	for i, s := range codeLengthCodeOrder {
+		if clLengths[s] != 0 && i+1 > n {
+			n = i + 1
+		}
+	}
+	w.write(0, 1)
+	w.write(uint32(n-4), 4)
+	for _, s := range codeLengthCodeOrder[:n] {
+		w.write(uint32(clLengths[s]), 3)
+	}
+	w.write(0, 1)
+	for i, t := range tokens {
+		clCode.put(w, int(t))
+		switch t {
+		case 16:
+			w.write(extras[i], 2)
+		case 17:
+			w.write(extras[i], 3)
+		case 18:
+			w.write(extras[i], 7)
+		}
+	}
+	return canonicalCode(lengths)
+}
+
+var codeLengthCodeOrder = [vp8lCodeLenCodes]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// codeLengthTokens run-length codes lengths: 16 repeats the previous
+// length 3-6 times, 17 and 18 write 3-10 and 11-138 zeros.
+func codeLengthTokens(lengths []uint8) (tokens []uint8, extras []uint32) {
+	emit := func(t uint8, extra int) {
+		tokens = append(tokens, t)
+		extras = append(extras, uint32(extra))
+	}
+	for i := 0; i < len(lengths); {
+		v := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == v {
+			run++
+		}
+		i += run
+		if v == 0 {
+			for run > 0 {
+				switch {
+				case run >= 11:
+					r := run
+					if r > 138 {
+						r = 138
+					}
+					emit(18, r-11)
+					run -= r
+				case run >= 3:
+					emit(17, run-3)
+					run = 0
+				default:
+					emit(0, 0)
+					run--
+				}
+			}
+			continue
+		}
+		emit(v, 0)
+		run--
+		for run >= 3 {
+			r := run
+			if r > 6 {
+				r = 6
+			}
+			emit(16, r-3)
+			run -= r
+		}
+		for ; run > 0; run-- {
+			emit(v, 0)
+		}
+	}
+	return tokens, extras
+}
+
+// canonicalCode assigns codes to lengths in canonical order. A code with
+// a single symbol needs no bits.
+func canonicalCode(lengths []uint8) prefixCode {
+	c := prefixCode{codes: make([]uint32, len(lengths)), lengths: make([]uint8, len(lengths))}
+	var count [16]uint32
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+			used++
+		}
+	}
+	if used == 1 {
+		return c
+	}
+	var next [16]uint32
+	code := uint32(0)
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	next[0] = 0
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		v := next[l]
+		next[l]++
+		var r uint32
+		for i := uint8(0); i < l; i++ {
+			r = r<<1 | v>>i&1
+		}
+		c.codes[s], c.lengths[s] = r, l
+	}
+	return c
+}
+
+// huffmanLengths returns Huffman code lengths of at most limit bits for
+// symbols occurring counts times. When the optimal code is too deep, rare
+// symbols are counted as more frequent until it fits.
+func huffmanLengths(counts []uint32, limit int) []uint8 {
+	type node struct {
+		weight      uint32
+		symbol      int
+		left, right int
+	}
+	lengths := make([]uint8, len(counts))
+	for floor := uint32(1); ; floor *= 2 {
+		var nodes []node
+		for s, n := range counts {
+			if n > 0 {
+				if n < floor {
+					n = floor
+				}
+				nodes = append(nodes, node{weight: n, symbol: s})
+			}
+		}
+		if len(nodes) == 1 {
+			lengths[nodes[0].symbol] = 1
+			return lengths
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+		// Merged nodes are created in order of weight, so the lightest
+		// node is always at the front of the leaves or of the merged.
+		leaves, merged := len(nodes), len(nodes)
+		next := 0
+		lightest := func() int {
+			if next < leaves && (merged == len(nodes) || nodes[next].weight <= nodes[merged].weight) {
+				next++
+				return next - 1
+			}
+			merged++
+			return merged - 1
+		}
+		for i := 1; i < leaves; i++ {
+			a := lightest()
+			b := lightest()
+			nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, symbol: -1, left: a, right: b})
+		}
+
+		deepest := 0
+		depth := make([]int, len(nodes))
+		for i := len(nodes) - 1; i >= 0; i-- {
+			if nodes[i].symbol >= 0 {
+				lengths[nodes[i].symbol] = uint8(depth[i])
+				if depth[i] > deepest {
+					deepest = depth[i]
+				}
+				continue
+			}
+			depth[nodes[i].left] = depth[i] + 1
+			depth[nodes[i].right] = depth[i] + 1
+		}
+		if deepest <= limit {
+			return lengths
+		}
+	}
+}
+
+// vp8lWriter packs bits LSB first, as VP8L streams are read.
+type vp8lWriter struct {
+	buf  []byte
+	acc  uint64
+	bits uint
+}
+
+func (w *vp8lWriter) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.bits
+	w.bits += n
+	for w.bits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.bits -= 8
+	}
+}
+
+func (w *vp8lWriter) flush() []byte {
+	if w.bits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.bits = 0, 0
+	}
+	return w.buf
+}
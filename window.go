@@ -0,0 +1,467 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+// levelSampler scales an image to a level as resize.Resize does, but a
+// window of the level at a time. nfnt/resize only scales whole images, so
+// its two passes are reproduced here with their weights, precision and
+// rounding: a window comes out byte for byte as the same pixels of the
+// whole level, and windows drawn side by side leave no seams.
+type levelSampler struct {
+	from image.Rectangle // bounds of the image scaled
+	kind levelKind
+	ch   int  // channels per pixel
+	deep bool // 16-bit precision
+	same bool // the level is the image itself, as resize.Resize returns it
+	x, y axisWeights
+}
+
+// levelKind is the type of image resize.Resize produces.
+type levelKind int
+
+const (
+	kindRGBA levelKind = iota
+	kindNRGBA
+	kindRGBA64
+	kindNRGBA64
+	kindGray
+	kindGray16
+	kindYCbCr
+)
+
+// bytesPerPixel is the size of the pixels of each levelKind.
+var bytesPerPixel = [...]int{kindRGBA: 4, kindNRGBA: 4, kindRGBA64: 8, kindNRGBA64: 8, kindGray: 1, kindGray16: 2, kindYCbCr: 3}
+
+// newLevelSampler returns a sampler scaling an image of bounds from, of
+// the type of img, to a width×height level with interp.
+func newLevelSampler(img image.Image, from image.Rectangle, width, height int, interp resize.InterpolationFunction) *levelSampler {
+	near := interp == resize.NearestNeighbor
+	s := &levelSampler{from: from, ch: 4}
+	switch img.(type) {
+	case *image.RGBA:
+		s.kind = kindRGBA
+	case *image.NRGBA:
+		// Filtering premultiplies the alpha; nearest neighbour keeps it.
+		s.kind = kindRGBA
+		if near {
+			s.kind = kindNRGBA
+		}
+	case *image.RGBA64:
+		s.kind, s.deep = kindRGBA64, true
+	case *image.NRGBA64:
+		s.kind, s.deep = kindRGBA64, true
+		if near {
+			s.kind = kindNRGBA64
+		}
+	case *image.Gray:
+		s.kind, s.ch = kindGray, 1
+	case *image.Gray16:
+		s.kind, s.ch, s.deep = kindGray16, 1, true
+	case *image.YCbCr:
+		s.kind, s.ch = kindYCbCr, 3
+	default:
+		s.kind, s.deep = kindRGBA64, true
+	}
+	s.same = width == from.Dx() && height == from.Dy()
+	s.x = newAxisWeights(width, from.Dx(), interp, s.deep)
+	s.y = newAxisWeights(height, from.Dy(), interp, s.deep)
+	return s
+}
+
+// newImage returns a level image of bounds r, held in pix, or in a new
+// buffer if pix is nil. pix must hold pixBytes(r) bytes.
+func (s *levelSampler) newImage(r image.Rectangle, pix []byte) image.Image {
+	if pix == nil {
+		pix = make([]byte, s.pixBytes(r))
+	}
+	w, h := r.Dx(), r.Dy()
+	switch s.kind {
+	case kindRGBA:
+		return &image.RGBA{Pix: pix, Stride: 4 * w, Rect: r}
+	case kindNRGBA:
+		return &image.NRGBA{Pix: pix, Stride: 4 * w, Rect: r}
+	case kindRGBA64:
+		return &image.RGBA64{Pix: pix, Stride: 8 * w, Rect: r}
+	case kindNRGBA64:
+		return &image.NRGBA64{Pix: pix, Stride: 8 * w, Rect: r}
+	case kindGray:
+		return &image.Gray{Pix: pix, Stride: w, Rect: r}
+	case kindGray16:
+		return &image.Gray16{Pix: pix, Stride: 2 * w, Rect: r}
+	}
+	n := w * h
+	return &image.YCbCr{
+		Y: pix[:n], Cb: pix[n : 2*n], Cr: pix[2*n : 3*n],
+		YStride: w, CStride: w, SubsampleRatio: image.YCbCrSubsampleRatio444, Rect: r,
+	}
+}
+
+// pixBytes returns the size of the pixels of a level image of bounds r.
+func (s *levelSampler) pixBytes(r image.Rectangle) int {
+	return bytesPerPixel[s.kind] * r.Dx() * r.Dy()
+}
+
+// reach returns the pixels of the image scaled that the window win of the
+// level is drawn from, relative to its bounds.
+func (s *levelSampler) reach(win image.Rectangle) image.Rectangle {
+	x0, x1 := s.x.reach(win.Min.X, win.Max.X)
+	y0, y1 := s.y.reach(win.Min.Y, win.Max.Y)
+	return image.Rect(x0, y0, x1, y1)
+}
+
+// render returns the window win of the level scaled from img, which needs
+// to hold only the pixels of the image scaled that the window reaches.
+func (s *levelSampler) render(img image.Image, win image.Rectangle) image.Image {
+	if s.same {
+		return img
+	}
+	dst := s.newImage(win, nil)
+	s.renderInto(dst, img, win)
+	return dst
+}
+
+// renderInto draws the window win of the level scaled from img into dst,
+// a level image from newImage holding it.
+func (s *levelSampler) renderInto(dst, img image.Image, win image.Rectangle) {
+	r := s.reach(win)
+	n, ch := win.Dx(), s.ch
+
+	// The horizontal pass, over the rows of img the window reaches.
+	tmp := make([]int32, r.Dy()*n*ch)
+	row := make([]int32, r.Dx()*ch)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		s.readRow(row, img, y, r.Min.X, r.Max.X)
+		t := tmp[(y-r.Min.Y)*n*ch:]
+		for x := win.Min.X; x < win.Max.X; x++ {
+			s.x.sample(t[(x-win.Min.X)*ch:], row, x, r.Min.X, ch, ch, s.deep)
+		}
+	}
+
+	// The vertical pass, down the columns of the horizontal one.
+	out := make([]int32, n*ch)
+	for y := win.Min.Y; y < win.Max.Y; y++ {
+		for x := 0; x < n; x++ {
+			s.y.sample(out[x*ch:], tmp[x*ch:], y, r.Min.Y, n*ch, ch, s.deep)
+		}
+		writeRow(dst, win.Min.X, y, out)
+	}
+}
+
+// readRow stores in buf the channels of pixels x0 to x1 of row y of the
+// image scaled, read from img as nfnt/resize reads them.
+func (s *levelSampler) readRow(buf []int32, img image.Image, y, x0, x1 int) {
+	b := img.Bounds()
+	ox, oy := s.from.Min.X-b.Min.X, s.from.Min.Y-b.Min.Y+y
+	switch img := img.(type) {
+	case *image.RGBA:
+		pix := img.Pix[oy*img.Stride:]
+		for x := x0; x < x1; x++ {
+			i, o := 4*(ox+x), 4*(x-x0)
+			buf[o], buf[o+1], buf[o+2], buf[o+3] = int32(pix[i]), int32(pix[i+1]), int32(pix[i+2]), int32(pix[i+3])
+		}
+	case *image.NRGBA:
+		pix := img.Pix[oy*img.Stride:]
+		for x := x0; x < x1; x++ {
+			i, o := 4*(ox+x), 4*(x-x0)
+			r, g, b, a := int32(pix[i]), int32(pix[i+1]), int32(pix[i+2]), int32(pix[i+3])
+			if s.kind != kindNRGBA {
+				r, g, b = r*a/0xff, g*a/0xff, b*a/0xff
+			}
+			buf[o], buf[o+1], buf[o+2], buf[o+3] = r, g, b, a
+		}
+	case *image.RGBA64:
+		pix := img.Pix[oy*img.Stride:]
+		for x := x0; x < x1; x++ {
+			i, o := 8*(ox+x), 4*(x-x0)
+			for c := 0; c < 4; c++ {
+				buf[o+c] = int32(pix[i+2*c])<<8 | int32(pix[i+2*c+1])
+			}
+		}
+	case *image.NRGBA64:
+		pix := img.Pix[oy*img.Stride:]
+		for x := x0; x < x1; x++ {
+			i, o := 8*(ox+x), 4*(x-x0)
+			a := int64(pix[i+6])<<8 | int64(pix[i+7])
+			for c := 0; c < 3; c++ {
+				v := int64(pix[i+2*c])<<8 | int64(pix[i+2*c+1])
+				if s.kind != kindNRGBA64 {
+					v = v * a / 0xffff
+				}
+				buf[o+c] = int32(v)
+			}
+			buf[o+3] = int32(a)
+		}
+	case *image.Gray:
+		pix := img.Pix[oy*img.Stride:]
+		for x := x0; x < x1; x++ {
+			buf[x-x0] = int32(pix[ox+x])
+		}
+	case *image.Gray16:
+		pix := img.Pix[oy*img.Stride:]
+		for x := x0; x < x1; x++ {
+			i := 2 * (ox + x)
+			buf[x-x0] = int32(pix[i])<<8 | int32(pix[i+1])
+		}
+	case *image.YCbCr:
+		// Chroma is indexed as nfnt/resize does, from the top-left corner
+		// of the image rather than by image.YCbCr.COffset.
+		cy, shift := oy*img.CStride, uint(0)
+		switch img.SubsampleRatio {
+		case image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio410:
+			cy, shift = oy/2*img.CStride, 1
+		case image.YCbCrSubsampleRatio440:
+			cy = oy / 2 * img.CStride
+		case image.YCbCrSubsampleRatio422:
+			shift = 1
+		case image.YCbCrSubsampleRatio411:
+			shift = 2
+		}
+		if img.SubsampleRatio == image.YCbCrSubsampleRatio410 {
+			shift = 2
+		}
+		yy := oy * img.YStride
+		for x := x0; x < x1; x++ {
+			i, o := ox+x, 3*(x-x0)
+			ci := cy + i>>shift
+			buf[o], buf[o+1], buf[o+2] = int32(img.Y[yy+i]), int32(img.Cb[ci]), int32(img.Cr[ci])
+		}
+	default:
+		for x := x0; x < x1; x++ {
+			r, g, b, a := img.At(s.from.Min.X+x, s.from.Min.Y+y).RGBA()
+			o := 4 * (x - x0)
+			buf[o], buf[o+1], buf[o+2], buf[o+3] = int32(r), int32(g), int32(b), int32(a)
+		}
+	}
+}
+
+// writeRow stores the channels in out as the pixels of row y of dst from
+// x0 on.
+func writeRow(dst image.Image, x0, y int, out []int32) {
+	switch dst := dst.(type) {
+	case *image.RGBA:
+		pix := dst.Pix[dst.PixOffset(x0, y):]
+		for i, v := range out {
+			pix[i] = uint8(v)
+		}
+	case *image.NRGBA:
+		pix := dst.Pix[dst.PixOffset(x0, y):]
+		for i, v := range out {
+			pix[i] = uint8(v)
+		}
+	case *image.RGBA64:
+		pix := dst.Pix[dst.PixOffset(x0, y):]
+		for i, v := range out {
+			pix[2*i], pix[2*i+1] = uint8(v>>8), uint8(v)
+		}
+	case *image.NRGBA64:
+		pix := dst.Pix[dst.PixOffset(x0, y):]
+		for i, v := range out {
+			pix[2*i], pix[2*i+1] = uint8(v>>8), uint8(v)
+		}
+	case *image.Gray:
+		pix := dst.Pix[dst.PixOffset(x0, y):]
+		for i, v := range out {
+			pix[i] = uint8(v)
+		}
+	case *image.Gray16:
+		pix := dst.Pix[dst.PixOffset(x0, y):]
+		for i, v := range out {
+			pix[2*i], pix[2*i+1] = uint8(v>>8), uint8(v)
+		}
+	case *image.YCbCr:
+		yi, ci := dst.YOffset(x0, y), dst.COffset(x0, y)
+		for i := 0; i < len(out)/3; i++ {
+			dst.Y[yi+i], dst.Cb[ci+i], dst.Cr[ci+i] = uint8(out[3*i]), uint8(out[3*i+1]), uint8(out[3*i+2])
+		}
+	}
+}
+
+// axisWeights are the weights nfnt/resize draws the pixels along one axis
+// of a level with: pixel i is drawn from the n pixels of the image scaled
+// from start[i] on, clamped to the image, weighted by coeffs, or averaged
+// where near is set for NearestNeighbor.
+type axisWeights struct {
+	n      int
+	last   int
+	start  []int
+	coeffs []int32
+	near   []bool
+}
+
+func newAxisWeights(dst, src int, interp resize.InterpolationFunction, deep bool) axisWeights {
+	taps, kernel := nfntKernel(interp)
+	scale := float64(src) / float64(dst)
+	n := taps * int(math.Max(math.Ceil(scale), 1))
+	factor := math.Min(1./scale, 1)
+
+	w := axisWeights{n: n, last: src - 1, start: make([]int, dst)}
+	if interp == resize.NearestNeighbor {
+		w.near = make([]bool, dst*n)
+	} else {
+		w.coeffs = make([]int32, dst*n)
+	}
+	for i := 0; i < dst; i++ {
+		interpX := scale*(float64(i)+0.5) - 0.5
+		w.start[i] = int(interpX) - n/2 + 1
+		interpX -= float64(w.start[i])
+		for j := 0; j < n; j++ {
+			in := (interpX - float64(j)) * factor
+			switch {
+			case w.near != nil:
+				w.near[i*n+j] = in >= -0.5 && in < 0.5
+			case deep:
+				w.coeffs[i*n+j] = int32(kernel(in) * 65536)
+			default:
+				w.coeffs[i*n+j] = int32(int16(kernel(in) * 256))
+			}
+		}
+	}
+	return w
+}
+
+// clamp returns the pixel i of the image scaled stands for: taps past
+// either end repeat the edge pixel.
+func (w *axisWeights) clamp(i int) int {
+	switch {
+	case i < 0:
+		return 0
+	case i >= w.last:
+		return w.last
+	}
+	return i
+}
+
+// reach returns the pixels of the image scaled that pixels lo to hi of
+// the level are drawn from.
+func (w *axisWeights) reach(lo, hi int) (int, int) {
+	return w.clamp(w.start[lo]), w.clamp(w.start[hi-1]+w.n-1) + 1
+}
+
+// sample stores in p the ch channels of pixel i of the level, drawn from
+// the pixels of the image scaled whose channels are at in[(j-lo)*stride:]
+// for pixel j, rounded as nfnt/resize rounds them.
+func (w *axisWeights) sample(p, in []int32, i, lo, stride, ch int, deep bool) {
+	start, taps := w.start[i], i*w.n
+	if w.near != nil {
+		var acc [4]float32
+		var sum float32
+		for j := 0; j < w.n; j++ {
+			if !w.near[taps+j] {
+				continue
+			}
+			k := (w.clamp(start+j) - lo) * stride
+			for c := 0; c < ch; c++ {
+				acc[c] += float32(in[k+c])
+			}
+			sum++
+		}
+		for c := 0; c < ch; c++ {
+			v := acc[c] / sum
+			switch {
+			case deep && v > 0xfffe:
+				p[c] = 0xffff
+			case deep:
+				p[c] = int32(uint16(v))
+			case v > 0xfe:
+				p[c] = 0xff
+			default:
+				p[c] = int32(uint8(v))
+			}
+		}
+		return
+	}
+
+	var acc [4]int64
+	var sum int64
+	for j := 0; j < w.n; j++ {
+		coeff := int64(w.coeffs[taps+j])
+		if coeff == 0 {
+			continue
+		}
+		k := (w.clamp(start+j) - lo) * stride
+		for c := 0; c < ch; c++ {
+			acc[c] += coeff * int64(in[k+c])
+		}
+		sum += coeff
+	}
+	max := int64(0xff)
+	if deep {
+		max = 0xffff
+	}
+	for c := 0; c < ch; c++ {
+		v := acc[c] / sum
+		switch {
+		case v < 0:
+			v = 0
+		case v > max:
+			v = max
+		}
+		p[c] = int32(v)
+	}
+}
+
+// nfntKernel returns the taps and kernel of interp, copied from
+// nfnt/resize, which does not export them.
+func nfntKernel(interp resize.InterpolationFunction) (int, func(float64) float64) {
+	switch interp {
+	case resize.Bilinear:
+		return 2, func(in float64) float64 {
+			in = math.Abs(in)
+			if in <= 1 {
+				return 1 - in
+			}
+			return 0
+		}
+	case resize.Bicubic:
+		return 4, func(in float64) float64 {
+			in = math.Abs(in)
+			if in <= 1 {
+				return in*in*(1.5*in-2.5) + 1.0
+			}
+			if in <= 2 {
+				return in*(in*(2.5-0.5*in)-4.0) + 2.0
+			}
+			return 0
+		}
+	case resize.MitchellNetravali:
+		return 4, func(in float64) float64 {
+			in = math.Abs(in)
+			if in <= 1 {
+				return (7.0*in*in*in - 12.0*in*in + 5.33333333333) * 0.16666666666
+			}
+			if in <= 2 {
+				return (-2.33333333333*in*in*in + 12.0*in*in - 20.0*in + 10.6666666667) * 0.16666666666
+			}
+			return 0
+		}
+	case resize.Lanczos2:
+		return 4, func(in float64) float64 {
+			if in > -2 && in < 2 {
+				return sinc(in) * sinc(in*0.5)
+			}
+			return 0
+		}
+	case resize.Lanczos3:
+		return 6, func(in float64) float64 {
+			if in > -3 && in < 3 {
+				return sinc(in) * sinc(in*0.3333333333333333)
+			}
+			return 0
+		}
+	}
+	// NearestNeighbor weighs nothing: taps are picked by axisWeights.near.
+	return 2, nil
+}
+
+func sinc(x float64) float64 {
+	x = math.Abs(x) * math.Pi
+	if x >= 1.220703e-4 {
+		return math.Sin(x) / x
+	}
+	return 1
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"runtime"
+	"sync"
+)
+
+var flagJobs int
+
+func init() {
+	flag.IntVar(&flagJobs, "j", runtime.NumCPU(), "number of tiles to render at once")
+}
+
+// workerPool runs tile jobs on -j workers, which it starts the first time
+// it is given a job. Go blocks while every worker is busy, so a level is
+// never queued much further ahead than it is being written.
+type workerPool struct {
+	once sync.Once
+	jobs chan func()
+}
+
+var workers workerPool
+
+// Go runs fn on the next free worker.
+func (p *workerPool) Go(fn func()) {
+	p.once.Do(func() {
+		p.jobs = make(chan func())
+		for i := 0; i < flagJobs; i++ {
+			go func() {
+				for fn := range p.jobs {
+					fn()
+				}
+			}()
+		}
+	})
+	p.jobs <- fn
+}
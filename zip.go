@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var flagZip string
+
+func init() {
+	flag.StringVar(&flagZip, "zip", "", "write the tiles into this ZIP archive instead of the output directory; archives past 4 GB or 65535 tiles are written as ZIP64")
+}
+
+// zipWriter stores tiles as entries of a ZIP archive. Entries are added
+// in the order tiles finish, and the archive is only complete once
+// Close has written its central directory.
+type zipWriter struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	w    *zip.Writer
+}
+
+// zipStored lists the extensions of already compressed files, which are
+// stored rather than deflated again.
+var zipStored = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".webp": true,
+	".avif": true,
+	".gz":   true,
+}
+
+// openZip starts the archive at path. It is written next to path and
+// renamed into place by Close, so an interrupted run leaves no truncated
+// archive behind.
+func openZip(path string) (*zipWriter, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &zipWriter{path: path, f: f, w: zip.NewWriter(f)}, nil
+}
+
+// Mkdir does nothing: entry names carry their directories.
+func (*zipWriter) Mkdir(string) error { return nil }
+
+func (z *zipWriter) WriteTile(name string, data []byte) error {
+	name = filepath.ToSlash(name)
+	h := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()}
+	if zipStored[strings.ToLower(path.Ext(name))] {
+		h.Method = zip.Store
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	w, err := z.w.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Close finishes the archive and moves it into place.
+func (z *zipWriter) Close() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if err := z.w.Close(); err != nil {
+		z.f.Close()
+		return err
+	}
+	if err := z.f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(z.path+".tmp", z.path)
+}
+
+// zipOut is the archive for -zip, closed by finishRun.
+var zipOut *zipWriter
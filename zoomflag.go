@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// zoomFlag is a flag.Value holding a setting that may differ per zoom: a
+// comma separated list of a default value and zoom=value or
+// first-last=value overrides, e.g. "gray,12=palette" or "1h,0-5=720h".
+type zoomFlag struct {
+	def   string
+	zooms map[int]string
+	check func(string) error
+}
+
+func (f *zoomFlag) String() string {
+	s := []string{f.def}
+	for z, v := range f.zooms {
+		s = append(s, strconv.Itoa(z)+"="+v)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *zoomFlag) Set(v string) error {
+	zooms := make(map[int]string)
+	def := f.def
+	for _, e := range strings.Split(v, ",") {
+		e = strings.TrimSpace(e)
+		value := e
+		first, last := -1, -1
+		if i := strings.Index(e, "="); i >= 0 {
+			var err error
+			first, last, err = parseZoomRange(e[:i])
+			if err != nil {
+				return err
+			}
+			value = e[i+1:]
+		}
+		if f.check != nil {
+			if err := f.check(value); err != nil {
+				return err
+			}
+		}
+		if first < 0 {
+			def = value
+			continue
+		}
+		for z := first; z <= last; z++ {
+			zooms[z] = value
+		}
+	}
+	f.def, f.zooms = def, zooms
+	return nil
+}
+
+// parseZoomRange parses a zoom "z" or inclusive range "first-last".
+func parseZoomRange(s string) (int, int, error) {
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	first, err1 := strconv.Atoi(lo)
+	last, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil || first < 0 || last < first {
+		return 0, 0, fmt.Errorf("invalid zoom %q", s)
+	}
+	return first, last, nil
+}
+
+// For returns the value set for zoom.
+func (f *zoomFlag) For(zoom int) string {
+	if v, ok := f.zooms[zoom]; ok {
+		return v
+	}
+	return f.def
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var (
+	flagMinZoom int
+	flagMaxZoom int
+)
+
+func init() {
+	flag.IntVar(&flagMinZoom, "min-zoom", 0, "shallowest level to generate; levels above it are left as they are in the output")
+	flag.IntVar(&flagMaxZoom, "max-zoom", -1, "deepest level to generate, at most the level argument, which still sets the geometry (-1 for the level argument)")
+}
+
+// checkZoomRange validates -min-zoom and -max-zoom for a pyramid whose
+// deepest level is level.
+func checkZoomRange(level int) error {
+	max := flagMaxZoom
+	if max < 0 {
+		max = level
+	}
+	switch {
+	case flagMinZoom < 0:
+		return fmt.Errorf("-min-zoom %d is negative", flagMinZoom)
+	case max > level:
+		return fmt.Errorf("-max-zoom %d is deeper than level %d", flagMaxZoom, level)
+	case flagMinZoom > max:
+		return fmt.Errorf("-min-zoom %d is deeper than the deepest level generated, %d", flagMinZoom, max)
+	}
+	return nil
+}
+
+// zoomWanted reports whether level z is within -min-zoom and -max-zoom.
+func zoomWanted(z int) bool {
+	return z >= flagMinZoom && (flagMaxZoom < 0 || z <= flagMaxZoom)
+}